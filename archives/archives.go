@@ -2,17 +2,19 @@ package archives
 
 import (
 	"bufio"
-	"compress/gzip"
 	"context"
 	"crypto/md5"
 	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
@@ -37,28 +39,157 @@ const (
 
 	// SessionType for session archives
 	SessionType = ArchiveType("session")
+
+	// ChannelLogType for channel log archives
+	ChannelLogType = ArchiveType("channel_log")
+
+	// HTTPLogType for HTTP log archives, e.g. of webhook calls
+	HTTPLogType = ArchiveType("http_log")
+
+	// TicketType for closed ticket archives
+	TicketType = ArchiveType("ticket")
 )
 
 // ArchivePeriod is the period of data in the archive
 type ArchivePeriod string
 
 const (
+	// HourPeriod is the period of an hour from archive start date, used for orgs with too many records for dailies
+	HourPeriod = ArchivePeriod("H")
+
 	// DayPeriod id the period of a day (24 hours) from archive start date
 	DayPeriod = ArchivePeriod("D")
 
 	// MonthPeriod is the period of a month from archive start date
 	MonthPeriod = ArchivePeriod("M")
+
+	// YearPeriod is the period of a year from archive start date, only ever rolled up from monthlies
+	YearPeriod = ArchivePeriod("Y")
 )
 
+// returns the period of the archives which are rolled up into archives of this period, if any
+func (p ArchivePeriod) childPeriod() ArchivePeriod {
+	switch p {
+	case DayPeriod:
+		return HourPeriod
+	case MonthPeriod:
+		return DayPeriod
+	case YearPeriod:
+		return MonthPeriod
+	default:
+		return ""
+	}
+}
+
 // Org represents the model for an org
 type Org struct {
-	ID              int       `db:"id"`
-	Name            string    `db:"name"`
-	CreatedOn       time.Time `db:"created_on"`
-	IsAnon          bool      `db:"is_anon"`
-	RetentionPeriod int
+	ID        int       `db:"id"`
+	Name      string    `db:"name"`
+	CreatedOn time.Time `db:"created_on"`
+	IsAnon    bool      `db:"is_anon"`
+
+	// number of days records are kept before archiving, with optional overrides by archive type
+	RetentionPeriod  int           `db:"retention_period"`
+	RetentionPeriods null.Map[int] `db:"retention_periods"`
+
+	// whether records are archived hourly, with dailies rolled up from hourlies
+	HourlyArchives bool `db:"hourly_archives"`
+
+	// whether archive boundaries are in the org's own timezone rather than UTC
+	LocalArchives bool `db:"local_archives"`
+
+	// the timezone of archive boundaries, which is UTC unless the org has local archives
+	Timezone string `db:"timezone"`
+
+	loc *time.Location
+}
+
+// an org's archives are UTC archives if they were created with a zero offset at a time when its timezone wasn't UTC
+const sqlSelectOrgHasUTCArchives = `
+SELECT EXISTS(
+  SELECT 1 
+    FROM archives_archive 
+   WHERE org_id = $1 AND utc_offset = 0 AND 
+         (start_date::timestamp with time zone AT TIME ZONE $2) != (start_date::timestamp with time zone AT TIME ZONE 'UTC')
+)`
+
+// ignores any archive settings of the org which the database schema or its existing archives don't support, and loads
+// the location of its archive boundaries
+func (o *Org) prepare(ctx context.Context, rt *runtime.Runtime) error {
+	if o.HourlyArchives && !rt.Schema.TimestampStartDates {
+		slog.Warn("ignoring hourly archives for org as archive start dates aren't timestamps", "org_id", o.ID)
+		o.HourlyArchives = false
+	}
+
+	if o.LocalArchives {
+		if !rt.Schema.TimestampStartDates || !rt.Schema.UTCOffsets {
+			slog.Warn("ignoring local archives for org as archives can't store when they start in its timezone", "org_id", o.ID)
+			o.LocalArchives = false
+		} else {
+			// local days wouldn't line up with the UTC days of existing archives
+			var hasUTCArchives bool
+			if err := rt.DB.GetContext(ctx, &hasUTCArchives, sqlSelectOrgHasUTCArchives, o.ID, o.Timezone); err != nil {
+				return fmt.Errorf("error checking for UTC archives for org: %d: %w", o.ID, err)
+			}
+			if hasUTCArchives {
+				slog.Warn("ignoring local archives for org as it already has UTC archives", "org_id", o.ID)
+				o.LocalArchives = false
+			}
+		}
+	}
+	if !o.LocalArchives {
+		o.Timezone = "UTC"
+	}
+
+	return o.loadLocation()
 }
 
+// loads the location of the org's timezone
+func (o *Org) loadLocation() error {
+	loc, err := time.LoadLocation(o.Timezone)
+	if err != nil {
+		return fmt.Errorf("error loading timezone for org: %d: %w", o.ID, err)
+	}
+	o.loc = loc
+	return nil
+}
+
+// returns the location archive boundaries are in for this org
+func (o *Org) location() *time.Location {
+	if o.loc == nil {
+		return time.UTC
+	}
+	return o.loc
+}
+
+// returns midnight in the org's timezone of the day of the given time
+func (o *Org) startOfDay(t time.Time) time.Time {
+	t = t.In(o.location())
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, o.location())
+}
+
+// returns the offset in seconds from UTC of the org's timezone at the given time
+func (o *Org) utcOffset(t time.Time) int {
+	_, offset := t.In(o.location()).Zone()
+	return offset
+}
+
+// returns the number of days records of the given type are kept before archiving
+func (o *Org) retentionPeriod(archiveType ArchiveType) int {
+	if days, ok := o.RetentionPeriods[string(archiveType)]; ok {
+		return days
+	}
+	return o.RetentionPeriod
+}
+
+// the encryption columns are added by a migration so they're read from the row as JSON, which gives archives in databases
+// without them no encryption, as they can't have been encrypted
+const sqlSelectEncryption = `to_jsonb(archives_archive) ->> 'encryption_algorithm' AS encryption_algorithm, to_jsonb(archives_archive) ->> 'encryption_key' AS encryption_key`
+
+// the utc_offset column is added by a migration so it's read from the row as JSON, which gives archives in databases
+// without it the zero offset of the UTC archives they must be
+const sqlSelectUTCOffset = `COALESCE((to_jsonb(archives_archive) ->> 'utc_offset')::int, 0) AS utc_offset`
+
 // Archive represents the model for an archive
 type Archive struct {
 	UUID        uuids.UUID  `db:"uuid"`
@@ -69,6 +200,7 @@ type Archive struct {
 
 	StartDate time.Time     `db:"start_date"`
 	Period    ArchivePeriod `db:"period"`
+	UTCOffset int           `db:"utc_offset"` // seconds east of UTC of the timezone the archive starts in
 
 	RecordCount int         `db:"record_count"`
 	Size        int64       `db:"size"`
@@ -80,34 +212,95 @@ type Archive struct {
 	DeletedOn     *time.Time `db:"deleted_date"`
 	Rollup        *int       `db:"rollup_id"`
 
+	EncryptionAlgorithm null.String `db:"encryption_algorithm"`
+	EncryptionKey       null.String `db:"encryption_key"`
+
 	Org         Org
+	Format      ArchiveFormat
+	Codec       ArchiveCodec
 	ArchiveFile string
-	Dailies     []*Archive
+	Dailies     []*Archive // the archives rolled up into this one, i.e. dailies, hourlies or monthlies
+
+	dataKey []byte
+	index   *ArchiveIndex
 }
 
-// returns location parsed into bucket and key
-func (a *Archive) location() (string, string) {
-	parts := strings.SplitN(string(a.Location), ":", 2)
-	return parts[0], parts[1]
+// returns the format of the archive file, which for existing archives is determined by their location. The format isn't
+// stored in its own column as that would need another migration of RapidPro's archives_archive table, and the extension
+// of the location is already the one place that's always correct for the file, including for archives written before
+// other formats were supported.
+func (a *Archive) format() ArchiveFormat {
+	if a.Format != "" {
+		return a.Format
+	}
+	return formatFromLocation(string(a.Location))
 }
 
-// isUploaded returns true if the archive was uploaded to S3
+// returns the codec of the archive file, which for existing archives is determined by their location
+func (a *Archive) codec() ArchiveCodec {
+	if a.Codec != "" {
+		return a.Codec
+	}
+	return codecFromLocation(string(a.Location))
+}
+
+// isUploaded returns true if the archive was uploaded to storage
 func (a *Archive) isUploaded() bool {
 	return a.Location != ""
 }
 
+// returns the start date of the archive in the timezone it was created in
+func (a *Archive) localStartDate() time.Time {
+	return a.StartDate.In(a.location())
+}
+
+// returns the location of the archive's boundaries, which is its org's timezone if that's what it was created in, as
+// that knows about daylight savings, and otherwise just its offset from UTC
+func (a *Archive) location() *time.Location {
+	if a.Org.utcOffset(a.StartDate) == a.UTCOffset {
+		return a.Org.location()
+	}
+	return time.FixedZone("", a.UTCOffset)
+}
+
 func (a *Archive) endDate() time.Time {
-	endDate := a.StartDate
-	if a.Period == DayPeriod {
-		endDate = endDate.AddDate(0, 0, 1)
-	} else {
-		endDate = endDate.AddDate(0, 1, 0)
+	start := a.localStartDate()
+
+	switch a.Period {
+	case HourPeriod:
+		return start.Add(time.Hour)
+	case DayPeriod:
+		return start.AddDate(0, 0, 1)
+	case YearPeriod:
+		return start.AddDate(1, 0, 0)
+	default:
+		return start.AddDate(0, 1, 0)
 	}
-	return endDate
 }
 
+// returns the start date of the archive as used in its storage key, e.g. 201708 for a monthly
+func (a *Archive) keyDate() string {
+	start := a.localStartDate()
+
+	switch a.Period {
+	case HourPeriod:
+		return start.Format("2006010215")
+	case DayPeriod:
+		return start.Format("20060102")
+	case YearPeriod:
+		return start.Format("2006")
+	default:
+		return start.Format("200601")
+	}
+}
+
+// retention periods can be overridden in the org config, e.g. {"retention_period": 365, "retention_periods": {"run": 180}},
+// very high volume orgs can be archived hourly, e.g. {"hourly_archives": true}, and orgs can have archive boundaries in
+// their own timezone rather than UTC, e.g. {"local_archives": true}
 const sqlLookupActiveOrgs = `
-  SELECT id, name, created_on, is_anon
+  SELECT id, name, created_on, is_anon, COALESCE((config->>'retention_period')::int, $1) AS retention_period, config->'retention_periods' AS retention_periods,
+         COALESCE((config->>'hourly_archives')::bool, FALSE) AS hourly_archives,
+         COALESCE((config->>'local_archives')::bool, FALSE) AS local_archives, timezone
     FROM orgs_org
    WHERE is_active
 ORDER BY id`
@@ -117,7 +310,7 @@ func GetActiveOrgs(ctx context.Context, rt *runtime.Runtime) ([]Org, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Minute)
 	defer cancel()
 
-	rows, err := rt.DB.QueryxContext(ctx, sqlLookupActiveOrgs)
+	rows, err := rt.DB.QueryxContext(ctx, sqlLookupActiveOrgs, rt.Config.RetentionPeriod)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching active orgs: %w", err)
 	}
@@ -125,19 +318,47 @@ func GetActiveOrgs(ctx context.Context, rt *runtime.Runtime) ([]Org, error) {
 
 	orgs := make([]Org, 0, 100)
 	for rows.Next() {
-		org := Org{RetentionPeriod: rt.Config.RetentionPeriod}
+		org := Org{}
 
 		if err := rows.StructScan(&org); err != nil {
 			return nil, fmt.Errorf("error scanning active org: %w", err)
 		}
 		orgs = append(orgs, org)
 	}
+	rows.Close()
+
+	for i := range orgs {
+		if err := orgs[i].prepare(ctx, rt); err != nil {
+			return nil, err
+		}
+	}
 
 	return orgs, nil
 }
 
+const sqlLookupOrg = `
+SELECT id, name, created_on, is_anon, COALESCE((config->>'retention_period')::int, $2) AS retention_period, config->'retention_periods' AS retention_periods,
+       COALESCE((config->>'hourly_archives')::bool, FALSE) AS hourly_archives,
+       COALESCE((config->>'local_archives')::bool, FALSE) AS local_archives, timezone
+  FROM orgs_org
+ WHERE id = $1`
+
+// GetOrg returns the org with the passed in id
+func GetOrg(ctx context.Context, rt *runtime.Runtime, orgID int) (Org, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	org := Org{}
+
+	if err := rt.DB.GetContext(ctx, &org, sqlLookupOrg, orgID, rt.Config.RetentionPeriod); err != nil {
+		return org, fmt.Errorf("error fetching org: %d: %w", orgID, err)
+	}
+
+	return org, org.prepare(ctx, rt)
+}
+
 const sqlLookupOrgArchives = `
-  SELECT uuid, id, org_id, start_date::timestamp with time zone AS start_date, period, archive_type, hash, location, size, record_count, needs_deletion, rollup_id
+  SELECT uuid, id, org_id, start_date::timestamp with time zone AS start_date, period, archive_type, hash, location, size, record_count, needs_deletion, rollup_id, ` + sqlSelectEncryption + `, ` + sqlSelectUTCOffset + `
     FROM archives_archive 
    WHERE org_id = $1 AND archive_type = $2 
 ORDER BY start_date ASC, period DESC`
@@ -157,7 +378,7 @@ func GetCurrentArchives(ctx context.Context, db *sqlx.DB, org Org, archiveType A
 }
 
 const sqlLookupArchivesToPurge = `
-  SELECT uuid, id, org_id, start_date::timestamp with time zone AS start_date, period, archive_type, hash, location, size, record_count, needs_deletion, rollup_id
+  SELECT uuid, id, org_id, start_date::timestamp with time zone AS start_date, period, archive_type, hash, location, size, record_count, needs_deletion, rollup_id, ` + sqlSelectEncryption + `, ` + sqlSelectUTCOffset + `
     FROM archives_archive 
    WHERE org_id = $1 AND archive_type = $2 AND needs_deletion = TRUE
 ORDER BY start_date ASC, period DESC`
@@ -196,8 +417,8 @@ func GetCurrentArchiveCount(ctx context.Context, db *sqlx.DB, org Org, archiveTy
 }
 
 // between is inclusive on both sides
-const sqlLookupOrgDailyArchivesForDateRange = `
-  SELECT uuid, id, org_id, start_date::timestamp with time zone AS start_date, period, archive_type, hash, location, size, record_count, needs_deletion, rollup_id
+const sqlLookupOrgArchivesForDateRange = `
+  SELECT uuid, id, org_id, start_date::timestamp with time zone AS start_date, period, archive_type, hash, location, size, record_count, needs_deletion, rollup_id, ` + sqlSelectEncryption + `, ` + sqlSelectUTCOffset + `
     FROM archives_archive
    WHERE org_id = $1 AND archive_type = $2 AND period = $3 AND start_date BETWEEN $4 AND $5
 ORDER BY start_date ASC`
@@ -209,7 +430,7 @@ func GetDailyArchivesForDateRange(ctx context.Context, db *sqlx.DB, org Org, arc
 
 	existingArchives := make([]*Archive, 0, 1)
 
-	err := db.SelectContext(ctx, &existingArchives, sqlLookupOrgDailyArchivesForDateRange, org.ID, archiveType, DayPeriod, startDate, endDate)
+	err := db.SelectContext(ctx, &existingArchives, sqlLookupOrgArchivesForDateRange, org.ID, archiveType, DayPeriod, startDate, endDate)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, fmt.Errorf("error selecting daily archives for org: %d and type: %s: %w", org.ID, archiveType, err)
 	}
@@ -217,34 +438,79 @@ func GetDailyArchivesForDateRange(ctx context.Context, db *sqlx.DB, org Org, arc
 	return existingArchives, nil
 }
 
+// GetMonthlyArchivesForDateRange returns all the current monthly archives for the passed in org and record type and date range
+func GetMonthlyArchivesForDateRange(ctx context.Context, db *sqlx.DB, org Org, archiveType ArchiveType, startDate time.Time, endDate time.Time) ([]*Archive, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	existingArchives := make([]*Archive, 0, 1)
+
+	err := db.SelectContext(ctx, &existingArchives, sqlLookupOrgArchivesForDateRange, org.ID, archiveType, MonthPeriod, startDate, endDate)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("error selecting monthly archives for org: %d and type: %s: %w", org.ID, archiveType, err)
+	}
+
+	return existingArchives, nil
+}
+
+// GetHourlyArchivesForDateRange returns all the current hourly archives for the passed in org and record type and date range
+func GetHourlyArchivesForDateRange(ctx context.Context, db *sqlx.DB, org Org, archiveType ArchiveType, startDate time.Time, endDate time.Time) ([]*Archive, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	existingArchives := make([]*Archive, 0, 1)
+
+	err := db.SelectContext(ctx, &existingArchives, sqlLookupOrgArchivesForDateRange, org.ID, archiveType, HourPeriod, startDate, endDate)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("error selecting hourly archives for org: %d and type: %s: %w", org.ID, archiveType, err)
+	}
+
+	return existingArchives, nil
+}
+
+// returns a new archive for the org which is missing, starting at the given date in the org's timezone
+func newMissingArchive(org Org, archiveType ArchiveType, period ArchivePeriod, startDate time.Time) *Archive {
+	return &Archive{
+		UUID:        uuids.NewV7(),
+		Org:         org,
+		OrgID:       org.ID,
+		StartDate:   startDate.In(org.location()),
+		UTCOffset:   org.utcOffset(startDate),
+		ArchiveType: archiveType,
+		Period:      period,
+	}
+}
+
 // GetMissingDailyArchives calculates what archives need to be generated for the passed in org this is calculated per day
 func GetMissingDailyArchives(ctx context.Context, db *sqlx.DB, now time.Time, org Org, archiveType ArchiveType) ([]*Archive, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Minute)
 	defer cancel()
 
-	// our first archive would be active days from today
-	endDate := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -org.RetentionPeriod)
-	orgUTC := org.CreatedOn.In(time.UTC)
-	startDate := time.Date(orgUTC.Year(), orgUTC.Month(), orgUTC.Day(), 0, 0, 0, 0, time.UTC)
+	// our first archive would be active days from today, where days start at midnight in the org's timezone
+	endDate := org.startOfDay(now).AddDate(0, 0, -org.retentionPeriod(archiveType))
+	startDate := org.startOfDay(org.CreatedOn)
 
 	return GetMissingDailyArchivesForDateRange(ctx, db, startDate, endDate, org, archiveType)
 }
 
+// days are generated in the org's timezone so they start at its midnight, and hourly archives don't count as their day
+// having an archive, as they're rolled up into one
 const sqlLookupMissingDailyArchive = `
 WITH month_days(missing_day) AS (
-  select GENERATE_SERIES($1::timestamp with time zone, $2::timestamp with time zone, '1 day')::date
+  select GENERATE_SERIES($1::timestamp with time zone AT TIME ZONE $6, $2::timestamp with time zone AT TIME ZONE $6, '1 day') AT TIME ZONE $6
 ), curr_archives AS (
-  SELECT start_date FROM archives_archive WHERE org_id = $3 AND period = $4 AND archive_type=$5
+  SELECT start_date::timestamp with time zone AS start_date FROM archives_archive WHERE org_id = $3 AND period = $4 AND archive_type=$5
 UNION DISTINCT
-  -- also get the overlapping days for the monthly rolled up archives
-  SELECT GENERATE_SERIES(start_date, (start_date + '1 month'::interval) - '1 second'::interval, '1 day')::date AS start_date
+  -- also get the overlapping days for the monthly and yearly rolled up archives
+  SELECT GENERATE_SERIES(start_date::timestamp with time zone AT TIME ZONE $6, ((start_date::timestamp with time zone AT TIME ZONE $6) + (CASE WHEN period = 'M' THEN '1 month' ELSE '1 year' END)::interval) - '1 second'::interval, '1 day') AT TIME ZONE $6 AS start_date
   FROM archives_archive 
-  WHERE org_id = $3 AND period = 'M' AND archive_type = $5
+  WHERE org_id = $3 AND period IN ('M', 'Y') AND archive_type = $5
 )
-   SELECT missing_day::timestamp with time zone
+   SELECT missing_day
      FROM month_days 
 LEFT JOIN curr_archives ON curr_archives.start_date = month_days.missing_day
-    WHERE curr_archives.start_date IS NULL`
+    WHERE curr_archives.start_date IS NULL
+ ORDER BY missing_day`
 
 // GetMissingDailyArchivesForDateRange returns all them missing daily archives between the two passed in date ranges
 func GetMissingDailyArchivesForDateRange(ctx context.Context, db *sqlx.DB, startDate time.Time, endDate time.Time, org Org, archiveType ArchiveType) ([]*Archive, error) {
@@ -253,7 +519,7 @@ func GetMissingDailyArchivesForDateRange(ctx context.Context, db *sqlx.DB, start
 
 	missing := make([]*Archive, 0, 1)
 
-	rows, err := db.QueryxContext(ctx, sqlLookupMissingDailyArchive, startDate, endDate, org.ID, DayPeriod, archiveType)
+	rows, err := db.QueryxContext(ctx, sqlLookupMissingDailyArchive, startDate, endDate, org.ID, DayPeriod, archiveType, org.Timezone)
 	if err != nil {
 		return nil, fmt.Errorf("error getting missing daily archives for org: %d and type: %s: %w", org.ID, archiveType, err)
 	}
@@ -265,47 +531,108 @@ func GetMissingDailyArchivesForDateRange(ctx context.Context, db *sqlx.DB, start
 			return nil, fmt.Errorf("error scanning missing daily archive for org: %d and type: %s: %w", org.ID, archiveType, err)
 		}
 
-		missing = append(missing, &Archive{
-			UUID:        uuids.NewV7(),
-			Org:         org,
-			OrgID:       org.ID,
-			StartDate:   missingDay,
-			ArchiveType: archiveType,
-			Period:      DayPeriod,
-		})
+		missing = append(missing, newMissingArchive(org, archiveType, DayPeriod, missingDay))
 	}
 
 	return missing, nil
 }
 
-// startDate is truncated to the first of the month
+// GetMissingHourlyArchives calculates what hourly archives need to be generated for the passed in org, which are the
+// hours of the days that GetMissingDailyArchives would return
+func GetMissingHourlyArchives(ctx context.Context, db *sqlx.DB, now time.Time, org Org, archiveType ArchiveType) ([]*Archive, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	// our last hour is the last hour of the last day we'd archive
+	endDate := org.startOfDay(now).AddDate(0, 0, -org.retentionPeriod(archiveType)+1).Add(-time.Hour)
+	startDate := org.startOfDay(org.CreatedOn)
+
+	return GetMissingHourlyArchivesForDateRange(ctx, db, startDate, endDate, org, archiveType)
+}
+
+// hours are covered by hourly archives, or by the daily and monthly archives which have been rolled up from them, whose
+// ends are calculated in the org's timezone so that days with daylight savings changes have the right number of hours
+const sqlLookupMissingHourlyArchive = `
+WITH day_hours(missing_hour) AS (
+  SELECT GENERATE_SERIES($1::timestamp with time zone, $2::timestamp with time zone, '1 hour')
+), curr_archives AS (
+  SELECT start_date::timestamp with time zone AS start_date FROM archives_archive WHERE org_id = $3 AND period = $4 AND archive_type = $5
+UNION DISTINCT
+  -- also get the overlapping hours for the daily, monthly and yearly archives
+  SELECT GENERATE_SERIES(start_date::timestamp with time zone, (((start_date::timestamp with time zone AT TIME ZONE $6) + (CASE WHEN period = 'D' THEN '1 day' WHEN period = 'M' THEN '1 month' ELSE '1 year' END)::interval) AT TIME ZONE $6) - '1 second'::interval, '1 hour') AS start_date
+  FROM archives_archive
+  WHERE org_id = $3 AND period IN ('D', 'M', 'Y') AND archive_type = $5
+)
+   SELECT missing_hour
+     FROM day_hours
+LEFT JOIN curr_archives ON curr_archives.start_date = day_hours.missing_hour
+    WHERE curr_archives.start_date IS NULL
+ ORDER BY missing_hour`
+
+// GetMissingHourlyArchivesForDateRange returns all the missing hourly archives between the two passed in dates
+func GetMissingHourlyArchivesForDateRange(ctx context.Context, db *sqlx.DB, startDate time.Time, endDate time.Time, org Org, archiveType ArchiveType) ([]*Archive, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	missing := make([]*Archive, 0, 1)
+
+	rows, err := db.QueryxContext(ctx, sqlLookupMissingHourlyArchive, startDate, endDate, org.ID, HourPeriod, archiveType, org.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("error getting missing hourly archives for org: %d and type: %s: %w", org.ID, archiveType, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var missingHour time.Time
+		if err := rows.Scan(&missingHour); err != nil {
+			return nil, fmt.Errorf("error scanning missing hourly archive for org: %d and type: %s: %w", org.ID, archiveType, err)
+		}
+
+		missing = append(missing, newMissingArchive(org, archiveType, HourPeriod, missingHour))
+	}
+
+	return missing, nil
+}
+
+// startDate is truncated to the first of the month in the org's timezone
 // endDate for range is not inclusive so we must deduct 1 second
 const sqlLookupMissingMonthlyArchive = `
 WITH month_days(missing_month) AS (
-  SELECT generate_series(date_trunc('month', $1::timestamp with time zone), $2::timestamp with time zone - '1 second'::interval, '1 month')::date
+  SELECT generate_series(date_trunc('month', $1::timestamp with time zone AT TIME ZONE $6), ($2::timestamp with time zone AT TIME ZONE $6) - '1 second'::interval, '1 month') AT TIME ZONE $6
 ), curr_archives AS (
-  SELECT start_date FROM archives_archive WHERE org_id = $3 and period = $4 and archive_type = $5
+  SELECT start_date::timestamp with time zone AS start_date FROM archives_archive WHERE org_id = $3 and period = $4 and archive_type = $5
+UNION DISTINCT
+  -- also get the overlapping months for the yearly rolled up archives
+  SELECT GENERATE_SERIES(start_date::timestamp with time zone AT TIME ZONE $6, ((start_date::timestamp with time zone AT TIME ZONE $6) + '1 year'::interval) - '1 second'::interval, '1 month') AT TIME ZONE $6 AS start_date
+  FROM archives_archive
+  WHERE org_id = $3 AND period = 'Y' AND archive_type = $5
 )
-   SELECT missing_month::timestamp with time zone 
+   SELECT missing_month
      FROM month_days 
 LEFT JOIN curr_archives ON curr_archives.start_date = month_days.missing_month
     WHERE curr_archives.start_date IS NULL
+ ORDER BY missing_month
 `
 
 // GetMissingMonthlyArchives gets which montly archives are currently missing for this org
 func GetMissingMonthlyArchives(ctx context.Context, db *sqlx.DB, now time.Time, org Org, archiveType ArchiveType) ([]*Archive, error) {
-	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
-	defer cancel()
+	lastActive := now.In(org.location()).AddDate(0, 0, -org.retentionPeriod(archiveType))
+	endDate := time.Date(lastActive.Year(), lastActive.Month(), 1, 0, 0, 0, 0, org.location())
 
-	lastActive := now.AddDate(0, 0, -org.RetentionPeriod)
-	endDate := time.Date(lastActive.Year(), lastActive.Month(), 1, 0, 0, 0, 0, time.UTC)
+	orgLocal := org.CreatedOn.In(org.location())
+	startDate := time.Date(orgLocal.Year(), orgLocal.Month(), 1, 0, 0, 0, 0, org.location())
 
-	orgUTC := org.CreatedOn.In(time.UTC)
-	startDate := time.Date(orgUTC.Year(), orgUTC.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return GetMissingMonthlyArchivesForDateRange(ctx, db, startDate, endDate, org, archiveType)
+}
+
+// GetMissingMonthlyArchivesForDateRange returns all the missing monthly archives between the two passed in dates
+func GetMissingMonthlyArchivesForDateRange(ctx context.Context, db *sqlx.DB, startDate time.Time, endDate time.Time, org Org, archiveType ArchiveType) ([]*Archive, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
+	defer cancel()
 
 	missing := make([]*Archive, 0, 1)
 
-	rows, err := db.QueryxContext(ctx, sqlLookupMissingMonthlyArchive, startDate, endDate, org.ID, MonthPeriod, archiveType)
+	rows, err := db.QueryxContext(ctx, sqlLookupMissingMonthlyArchive, startDate, endDate, org.ID, MonthPeriod, archiveType, org.Timezone)
 	if err != nil {
 		return nil, fmt.Errorf("error getting missing monthly archive for org: %d and type: %s: %w", org.ID, archiveType, err)
 	}
@@ -317,132 +644,337 @@ func GetMissingMonthlyArchives(ctx context.Context, db *sqlx.DB, now time.Time,
 			return nil, fmt.Errorf("error scanning missing monthly archive for org: %d and type: %s: %w", org.ID, archiveType, err)
 		}
 
-		missing = append(missing, &Archive{
-			UUID:        uuids.NewV7(),
-			Org:         org,
-			OrgID:       org.ID,
-			StartDate:   missingMonth,
-			ArchiveType: archiveType,
-			Period:      MonthPeriod,
-		})
+		missing = append(missing, newMissingArchive(org, archiveType, MonthPeriod, missingMonth))
 	}
 
 	return missing, nil
 }
 
-// BuildRollupArchive builds a monthly archive from the files present on S3
-func BuildRollupArchive(ctx context.Context, rt *runtime.Runtime, monthlyArchive *Archive, now time.Time, org Org, archiveType ArchiveType) error {
-	ctx, cancel := context.WithTimeout(ctx, time.Hour)
+// startDate is truncated to the first of the year in the org's timezone
+// endDate for range is not inclusive so we must deduct 1 second
+const sqlLookupMissingYearlyArchive = `
+WITH years(missing_year) AS (
+  SELECT generate_series(date_trunc('year', $1::timestamp with time zone AT TIME ZONE $6), ($2::timestamp with time zone AT TIME ZONE $6) - '1 second'::interval, '1 year') AT TIME ZONE $6
+), curr_archives AS (
+  SELECT start_date::timestamp with time zone AS start_date FROM archives_archive WHERE org_id = $3 and period = $4 and archive_type = $5
+)
+   SELECT missing_year
+     FROM years
+LEFT JOIN curr_archives ON curr_archives.start_date = years.missing_year
+    WHERE curr_archives.start_date IS NULL
+ ORDER BY missing_year
+`
+
+// GetMissingYearlyArchives gets which yearly archives are currently missing for this org, which are the years of which
+// every month would have a monthly archive
+func GetMissingYearlyArchives(ctx context.Context, db *sqlx.DB, now time.Time, org Org, archiveType ArchiveType) ([]*Archive, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
 	defer cancel()
 
-	start := dates.Now()
+	lastActive := now.In(org.location()).AddDate(0, 0, -org.retentionPeriod(archiveType))
+	endDate := time.Date(lastActive.Year(), 1, 1, 0, 0, 0, 0, org.location())
 
-	// figure out the first day in the monthlyArchive we'll archive
-	startDate := monthlyArchive.StartDate
-	endDate := startDate.AddDate(0, 1, 0).Add(time.Nanosecond * -1)
-	if monthlyArchive.StartDate.Before(org.CreatedOn) {
-		orgUTC := org.CreatedOn.In(time.UTC)
-		startDate = time.Date(orgUTC.Year(), orgUTC.Month(), orgUTC.Day(), 0, 0, 0, 0, time.UTC)
-	}
+	orgLocal := org.CreatedOn.In(org.location())
+	startDate := time.Date(orgLocal.Year(), 1, 1, 0, 0, 0, 0, org.location())
+
+	missing := make([]*Archive, 0, 1)
 
-	// grab all the daily archives we need
-	missingDailies, err := GetMissingDailyArchivesForDateRange(ctx, rt.DB, startDate, endDate, org, archiveType)
+	rows, err := db.QueryxContext(ctx, sqlLookupMissingYearlyArchive, startDate, endDate, org.ID, YearPeriod, archiveType, org.Timezone)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("error getting missing yearly archive for org: %d and type: %s: %w", org.ID, archiveType, err)
 	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var missingYear time.Time
+		if err := rows.Scan(&missingYear); err != nil {
+			return nil, fmt.Errorf("error scanning missing yearly archive for org: %d and type: %s: %w", org.ID, archiveType, err)
+		}
 
-	if len(missingDailies) != 0 {
-		return fmt.Errorf("missing %d daily archives", len(missingDailies))
+		missing = append(missing, newMissingArchive(org, archiveType, YearPeriod, missingYear))
 	}
 
-	// great, we have all the dailies we need, download them
-	filename := fmt.Sprintf("%s_%d_%s_%d_%02d_", monthlyArchive.ArchiveType, monthlyArchive.Org.ID, monthlyArchive.Period, monthlyArchive.StartDate.Year(), monthlyArchive.StartDate.Month())
+	return missing, nil
+}
+
+// BuildRollupArchive builds a monthly archive from the daily files present on S3, or a daily archive from the hourly
+// files, or a yearly archive from the monthly files
+func BuildRollupArchive(ctx context.Context, rt *runtime.Runtime, rollup *Archive, now time.Time, org Org, archiveType ArchiveType) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Hour)
+	defer cancel()
+
+	start := dates.Now()
+
+	children, err := getRollupChildren(ctx, rt, rollup, org, archiveType)
+	if err != nil {
+		return err
+	}
+
+	// great, we have all the children we need, download them
+	filename := fmt.Sprintf("%s_%d_%s%s_", rollup.ArchiveType, rollup.Org.ID, rollup.Period, rollup.keyDate())
 	file, err := os.CreateTemp(rt.Config.TempDir, filename)
 	if err != nil {
 		return fmt.Errorf("error creating temp file: %s: %w", filename, err)
 	}
-	writerHash := md5.New()
-	gzWriter := gzip.NewWriter(io.MultiWriter(file, writerHash))
-	writer := bufio.NewWriter(gzWriter)
+
+	defer func() {
+		// we only set the archive filename when we succeed
+		if rollup.ArchiveFile == "" {
+			if err := os.Remove(file.Name()); err != nil {
+				slog.Error("error cleaning up rollup archive file", "error", err, "filename", file.Name())
+			}
+		}
+	}()
 	defer file.Close()
 
-	recordCount := 0
+	writerHash := md5.New()
+	recordCount, err := writeRollupRecords(ctx, rt, rollup, children, io.MultiWriter(file, writerHash))
+	if err != nil {
+		return err
+	}
+
+	if recordCount > 0 {
+		// calculate our size and hash
+		rollup.Hash = null.String(hex.EncodeToString(writerHash.Sum(nil)))
+		stat, err := file.Stat()
+		if err != nil {
+			return fmt.Errorf("error statting file: %s: %w", file.Name(), err)
+		}
 
-	dailies, err := GetDailyArchivesForDateRange(ctx, rt.DB, org, archiveType, startDate, endDate)
+		rollup.Size = stat.Size()
+	}
+
+	rollup.ArchiveFile = file.Name()
+	rollup.RecordCount = recordCount
+	rollup.BuildTime = int(dates.Since(start) / time.Millisecond)
+	rollup.Dailies = children
+	rollup.NeedsDeletion = false
+
+	return nil
+}
+
+// StreamRollupArchive builds a rollup archive from the files present in storage like BuildRollupArchive, but rather
+// than writing it to a temp file first, streams it straight to storage whilst calculating its size and hash
+func StreamRollupArchive(ctx context.Context, rt *runtime.Runtime, rollup *Archive, now time.Time, org Org, archiveType ArchiveType) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Hour*3)
+	defer cancel()
+
+	start := dates.Now()
+
+	children, err := getRollupChildren(ctx, rt, rollup, org, archiveType)
 	if err != nil {
 		return err
 	}
 
-	// calculate total expected size
-	estimatedSize := int64(0)
-	for _, d := range dailies {
-		estimatedSize += d.Size
+	totalRecords := 0
+	for _, c := range children {
+		totalRecords += c.RecordCount
+	}
+
+	// only upload if there are records
+	if totalRecords > 0 {
+		// we don't know our hash until we've finished uploading so our key uses our UUID instead
+		key := fmt.Sprintf(
+			"%d/%s_%s%s_%s.%s.%s",
+			rollup.Org.ID, rollup.ArchiveType, rollup.Period, rollup.keyDate(),
+			rollup.UUID, rollup.format().extension(), rollup.codec().extension())
+
+		reader, writer := io.Pipe()
+		hash := md5.New()
+		counter := &countingWriter{}
+		recordCount := 0
+		written := make(chan error, 1)
+
+		go func() {
+			n, err := writeRollupRecords(ctx, rt, rollup, children, io.MultiWriter(writer, hash, counter))
+			recordCount = n
+			writer.CloseWithError(err)
+			written <- err
+		}()
+
+		storage := storageFor(rt)
+		err := storage.PutStream(ctx, key, rollup, reader)
+
+		// if the upload failed before reading everything, this unblocks our writer
+		reader.CloseWithError(err)
+		writeErr := <-written
+
+		if err != nil {
+			return fmt.Errorf("error streaming rollup archive to storage: %w", err)
+		}
+		if writeErr != nil {
+			return fmt.Errorf("error writing rollup archive: %w", writeErr)
+		}
+		if err := putArchiveIndex(ctx, storage, rollup, key); err != nil {
+			return err
+		}
+
+		rollup.Hash = null.String(hex.EncodeToString(hash.Sum(nil)))
+		rollup.Size = counter.count
+		rollup.RecordCount = recordCount
+
+		// building and uploading happen together when streaming
+		observeUpload(rollup, dates.Since(start))
+	}
+
+	rollup.BuildTime = int(dates.Since(start) / time.Millisecond)
+	rollup.Dailies = children
+	rollup.NeedsDeletion = rollup.RecordCount > 0
+
+	slog.Debug("completed streaming rollup archive", "org_id", rollup.Org.ID, "archive_type", rollup.ArchiveType, "start_date", rollup.StartDate, "location", rollup.Location, "file_size", rollup.Size, "file_hash", rollup.Hash)
+
+	return nil
+}
+
+// gets the archives to be rolled up into the passed in archive, i.e. the dailies of a monthly, the hourlies of a daily or
+// the monthlies of a yearly, erroring if any are missing, and sets the format and codec of the rollup
+func getRollupChildren(ctx context.Context, rt *runtime.Runtime, rollup *Archive, org Org, archiveType ArchiveType) ([]*Archive, error) {
+	// figure out the first day (or month for yearlies) in the rollup we'll archive, our end is inclusive so we deduct a second
+	startDate := rollup.StartDate
+	endDate := rollup.endDate().Add(-time.Second)
+	if rollup.StartDate.Before(org.CreatedOn) {
+		startDate = org.startOfDay(org.CreatedOn)
+		if rollup.Period == YearPeriod {
+			startDate = startDate.AddDate(0, 0, 1-startDate.Day())
+		}
+	}
+
+	getMissing, getChildren := GetMissingDailyArchivesForDateRange, GetDailyArchivesForDateRange
+	switch rollup.Period {
+	case DayPeriod:
+		getMissing, getChildren = GetMissingHourlyArchivesForDateRange, GetHourlyArchivesForDateRange
+	case YearPeriod:
+		getMissing, getChildren = GetMissingMonthlyArchivesForDateRange, GetMonthlyArchivesForDateRange
+	}
+
+	// grab all the child archives we need
+	missing, err := getMissing(ctx, rt.DB, startDate, endDate, org, archiveType)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(missing) != 0 {
+		return nil, fmt.Errorf("missing %d %s archives", len(missing), missing[0].Period)
+	}
+
+	children, err := getChildren(ctx, rt.DB, org, archiveType, startDate, endDate)
+	if err != nil {
+		return nil, err
+	}
+
+	// children are decompressed so our rollup can use the configured codec regardless of theirs
+	rollup.Codec = ArchiveCodec(rt.Config.ArchiveCodec)
+
+	// and their records are converted to the configured format, except that CSV records can't be converted back to JSON
+	// without losing their types, so a rollup with any CSV children is CSV
+	rollup.Format = ArchiveFormat(rt.Config.ArchiveFormat)
+	for _, c := range children {
+		if c.RecordCount > 0 && c.format() == FormatCSV {
+			rollup.Format = FormatCSV
+		}
+	}
+
+	// children are also decrypted so our rollup is encrypted with the org's current key if encryption is enabled
+	if err := prepareEncryption(ctx, rt, rollup); err != nil {
+		return nil, fmt.Errorf("error preparing rollup encryption: %w", err)
+	}
+
+	return children, nil
+}
+
+// writes the records of the passed in children to the given writer, compressed with the codec of the rollup archive
+// and encrypted if it has a key, and indexes them
+func writeRollupRecords(ctx context.Context, rt *runtime.Runtime, rollup *Archive, children []*Archive, w io.Writer) (int, error) {
+	encWriter, err := encryptWriter(rollup, w)
+	if err != nil {
+		return 0, err
+	}
+	compWriter, err := rollup.codec().newWriter(encWriter)
+	if err != nil {
+		return 0, err
 	}
 
-	// for each daily
-	for _, daily := range dailies {
-		// if there are no records in this daily, just move on
-		if daily.RecordCount == 0 {
+	// everything written is also read back by our indexer
+	indexer := newArchiveIndexer(rollup.Format, rollup.ArchiveType)
+	defer indexer.abort()
+
+	writer := bufio.NewWriter(io.MultiWriter(compWriter, indexer))
+
+	recordCount := 0
+
+	// for each child
+	for _, child := range children {
+		// if there are no records in this child, just move on
+		if child.RecordCount == 0 {
 			continue
 		}
 
-		bucket, key := daily.location()
-		reader, err := GetS3File(ctx, rt.S3, bucket, key)
+		reader, err := storageFor(rt).Get(ctx, string(child.Location))
 		if err != nil {
-			return fmt.Errorf("error reading daily S3 object: %w", err)
+			return 0, fmt.Errorf("error reading child archive file: %w", err)
 		}
 
 		// set up our reader to calculate our hash along the way
 		readerHash := md5.New()
-		teeReader := io.TeeReader(reader, readerHash)
-		gzipReader, err := gzip.NewReader(teeReader)
+		decReader, err := decryptReader(rt, child, io.TeeReader(reader, readerHash))
 		if err != nil {
-			return fmt.Errorf("error creating gzip reader: %w", err)
+			reader.Close()
+			return 0, fmt.Errorf("error decrypting child archive %s: %w", child.UUID, err)
 		}
-
-		// copy this daily file (uncompressed) to our new monthly file
-		if _, err := io.Copy(writer, gzipReader); err != nil {
-			return fmt.Errorf("error copying from S3 to disk %s:%s: %w", bucket, key, err)
+		compReader, err := child.codec().newReader(decReader)
+		if err != nil {
+			reader.Close()
+			return 0, fmt.Errorf("error creating %s reader: %w", child.codec(), err)
 		}
 
+		// copy this child file (uncompressed) to our new rollup file, converting its records if it's in another format
+		err = rollup.Format.convertRecords(writer, compReader, child.format(), rollup.ArchiveType, recordCount > 0)
+
 		reader.Close()
-		gzipReader.Close()
+		compReader.Close()
+
+		if err != nil {
+			return 0, fmt.Errorf("error copying from storage %s: %w", child.Location, err)
+		}
 
 		// check our hash that everything was written out
 		hash := hex.EncodeToString(readerHash.Sum(nil))
-		if hash != string(daily.Hash) {
-			return fmt.Errorf("daily hash mismatch. expected: %s, got %s", daily.Hash, hash)
+		if hash != string(child.Hash) {
+			return 0, fmt.Errorf("child hash mismatch. expected: %s, got %s", child.Hash, hash)
 		}
 
-		recordCount += daily.RecordCount
+		recordCount += child.RecordCount
 	}
 
-	monthlyArchive.ArchiveFile = file.Name()
-
 	if err := writer.Flush(); err != nil {
-		return err
+		return 0, err
 	}
-	if err := gzWriter.Close(); err != nil {
-		return err
+	if err := compWriter.Close(); err != nil {
+		return 0, err
+	}
+	if err := encWriter.Close(); err != nil {
+		return 0, err
 	}
 
+	index, err := indexer.finish()
+	if err != nil {
+		return 0, err
+	}
 	if recordCount > 0 {
-		// calculate our size and hash
-		monthlyArchive.Hash = null.String(hex.EncodeToString(writerHash.Sum(nil)))
-		stat, err := file.Stat()
-		if err != nil {
-			return fmt.Errorf("error statting file: %s: %w", file.Name(), err)
-		}
-
-		monthlyArchive.Size = stat.Size()
+		rollup.index = index
 	}
 
-	monthlyArchive.RecordCount = recordCount
-	monthlyArchive.BuildTime = int(dates.Since(start) / time.Millisecond)
-	monthlyArchive.Dailies = dailies
-	monthlyArchive.NeedsDeletion = false
+	return recordCount, nil
+}
 
-	return nil
+// writer which just counts the bytes written to it
+type countingWriter struct {
+	count int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.count += int64(len(p))
+	return len(p), nil
 }
 
 // EnsureTempArchiveDirectory checks that we can write to our archive directory, creating it first if needbe
@@ -485,7 +1017,7 @@ func CreateArchiveFile(ctx context.Context, db *sqlx.DB, archive *Archive, archi
 
 	log := slog.With("org_id", archive.Org.ID, "archive_type", archive.ArchiveType, "start_date", archive.StartDate, "end_date", archive.endDate(), "period", archive.Period)
 
-	filename := fmt.Sprintf("%s_%d_%s%d%02d%02d_", archive.ArchiveType, archive.Org.ID, archive.Period, archive.StartDate.Year(), archive.StartDate.Month(), archive.StartDate.Day())
+	filename := fmt.Sprintf("%s_%d_%s%s_", archive.ArchiveType, archive.Org.ID, archive.Period, archive.keyDate())
 	file, err := os.CreateTemp(archivePath, filename)
 	if err != nil {
 		return fmt.Errorf("error creating temp file: %s: %w", filename, err)
@@ -501,19 +1033,31 @@ func CreateArchiveFile(ctx context.Context, db *sqlx.DB, archive *Archive, archi
 	}()
 
 	hash := md5.New()
-	gzWriter := gzip.NewWriter(io.MultiWriter(file, hash))
-	writer := bufio.NewWriter(gzWriter)
+	encWriter, err := encryptWriter(archive, io.MultiWriter(file, hash))
+	if err != nil {
+		return err
+	}
+	compWriter, err := archive.codec().newWriter(encWriter)
+	if err != nil {
+		return err
+	}
 	defer file.Close()
 
+	// everything written is also read back by our indexer
+	indexer := newArchiveIndexer(archive.format(), archive.ArchiveType)
+	defer indexer.abort()
+
+	writer, err := newRecordWriter(archive.format(), archive.ArchiveType, io.MultiWriter(compWriter, indexer))
+	if err != nil {
+		return err
+	}
+
 	log.Debug("creating new archive file", "filename", file.Name())
 
 	recordCount := 0
-	switch archive.ArchiveType {
-	case MessageType:
-		recordCount, err = writeMessageRecords(ctx, db, archive, writer)
-	case RunType:
-		recordCount, err = writeRunRecords(ctx, db, archive, writer)
-	default:
+	if spec := GetArchiveTypeSpec(archive.ArchiveType); spec != nil {
+		recordCount, err = spec.WriteRecords(ctx, db, archive, writer)
+	} else {
 		err = fmt.Errorf("unknown archive type: %s", archive.ArchiveType)
 	}
 
@@ -524,11 +1068,21 @@ func CreateArchiveFile(ctx context.Context, db *sqlx.DB, archive *Archive, archi
 	if err := writer.Flush(); err != nil {
 		return fmt.Errorf("error flushing archive file: %w", err)
 	}
-	if err := gzWriter.Close(); err != nil {
-		return fmt.Errorf("error closing archive gzip writer: %w", err)
+	if err := compWriter.Close(); err != nil {
+		return fmt.Errorf("error closing archive %s writer: %w", archive.codec(), err)
+	}
+	if err := encWriter.Close(); err != nil {
+		return fmt.Errorf("error closing archive encryption writer: %w", err)
+	}
+
+	index, err := indexer.finish()
+	if err != nil {
+		return err
 	}
 
 	if recordCount > 0 {
+		archive.index = index
+
 		// calculate our size and hash
 		archive.Hash = null.String(hex.EncodeToString(hash.Sum(nil)))
 		stat, err := file.Stat()
@@ -548,29 +1102,30 @@ func CreateArchiveFile(ctx context.Context, db *sqlx.DB, archive *Archive, archi
 	return nil
 }
 
-// UploadArchive uploads the passed archive file to S3
+// returns the storage key of an archive file, which includes its hash
+func archiveKey(archive *Archive) string {
+	return fmt.Sprintf(
+		"%d/%s_%s%s_%s.%s.%s",
+		archive.Org.ID, archive.ArchiveType, archive.Period, archive.keyDate(),
+		archive.Hash, archive.format().extension(), archive.codec().extension())
+}
+
+// UploadArchive uploads the passed archive file to storage
 func UploadArchive(ctx context.Context, rt *runtime.Runtime, archive *Archive) error {
 	ctx, cancel := context.WithTimeout(ctx, time.Minute*15)
 	defer cancel()
 
-	archivePath := ""
-	if archive.Period == DayPeriod {
-		archivePath = fmt.Sprintf(
-			"%d/%s_%s%d%02d%02d_%s.jsonl.gz",
-			archive.Org.ID, archive.ArchiveType, archive.Period,
-			archive.StartDate.Year(), archive.StartDate.Month(), archive.StartDate.Day(),
-			archive.Hash)
-	} else {
-		archivePath = fmt.Sprintf(
-			"%d/%s_%s%d%02d_%s.jsonl.gz",
-			archive.Org.ID, archive.ArchiveType, archive.Period,
-			archive.StartDate.Year(), archive.StartDate.Month(),
-			archive.Hash)
-	}
+	start := dates.Now()
+	storage, key := storageFor(rt), archiveKey(archive)
 
-	if err := UploadToS3(ctx, rt.S3, rt.Config.S3Bucket, archivePath, archive); err != nil {
-		return fmt.Errorf("error uploading archive to S3: %w", err)
+	if err := storage.Put(ctx, key, archive); err != nil {
+		return fmt.Errorf("error uploading archive to storage: %w", err)
 	}
+	if err := putArchiveIndex(ctx, storage, archive, key); err != nil {
+		return err
+	}
+
+	observeUpload(archive, dates.Since(start))
 
 	archive.NeedsDeletion = archive.RecordCount > 0
 
@@ -579,10 +1134,25 @@ func UploadArchive(ctx context.Context, rt *runtime.Runtime, archive *Archive) e
 	return nil
 }
 
-const sqlInsertArchive = `
-INSERT INTO archives_archive(uuid, archive_type, org_id, created_on, start_date, period, record_count, size, hash, location, needs_deletion, build_time, rollup_id)
-    VALUES(:uuid, :archive_type, :org_id, :created_on, :start_date, :period, :record_count, :size, :hash, :location, :needs_deletion, :build_time, :rollup_id)
-  RETURNING id`
+// the columns every archive is inserted with
+var sqlInsertArchiveColumns = []string{
+	"uuid", "archive_type", "org_id", "created_on", "start_date", "period", "record_count", "size", "hash", "location",
+	"needs_deletion", "build_time", "rollup_id",
+}
+
+// returns the query to insert the archive, which only includes the columns added by migrations if the archive needs
+// them, as an archive is only encrypted or has an offset if the database has the columns for it
+func insertArchiveSQL(archive *Archive) string {
+	columns := slices.Clone(sqlInsertArchiveColumns)
+	if archive.isEncrypted() {
+		columns = append(columns, "encryption_algorithm", "encryption_key")
+	}
+	if archive.UTCOffset != 0 {
+		columns = append(columns, "utc_offset")
+	}
+
+	return fmt.Sprintf("INSERT INTO archives_archive(%s) VALUES(:%s) RETURNING id", strings.Join(columns, ", "), strings.Join(columns, ", :"))
+}
 
 // WriteArchiveToDB write an archive to the Database
 func WriteArchiveToDB(ctx context.Context, db *sqlx.DB, archive *Archive) error {
@@ -597,7 +1167,7 @@ func WriteArchiveToDB(ctx context.Context, db *sqlx.DB, archive *Archive) error
 		return fmt.Errorf("error starting transaction: %w", err)
 	}
 
-	rows, err := tx.NamedQuery(sqlInsertArchive, archive)
+	rows, err := tx.NamedQuery(insertArchiveSQL(archive), archive)
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("error inserting archive: %w", err)
@@ -659,7 +1229,8 @@ func DeleteArchiveTempFile(archive *Archive) error {
 	return nil
 }
 
-// CreateOrgArchives builds all the missing archives for the passed in org
+// CreateOrgArchives builds all the missing archives for the passed in org, where for orgs archived hourly, the hourlies
+// are returned as the dailies created
 func CreateOrgArchives(ctx context.Context, rt *runtime.Runtime, now time.Time, org Org, archiveType ArchiveType) ([]*Archive, []*Archive, []*Archive, []*Archive, error) {
 	archiveCount, err := GetCurrentArchiveCount(ctx, rt.DB, org, archiveType)
 	if err != nil {
@@ -668,8 +1239,10 @@ func CreateOrgArchives(ctx context.Context, rt *runtime.Runtime, now time.Time,
 
 	var dailiesCreated, dailiesFailed, monthliesCreated, monthliesFailed []*Archive
 
-	// no existing archives means this might be a backfill, figure out if there are full months we can build first
-	if archiveCount == 0 {
+	// no existing archives means this might be a backfill, figure out if there are full months we can build first, unless
+	// the org is archived hourly as its months are too big to build from the database, so they are rolled up from the
+	// dailies which are rolled up from its hourlies
+	if archiveCount == 0 && !org.HourlyArchives {
 		archives, err := GetMissingMonthlyArchives(ctx, rt.DB, now, org, archiveType)
 		if err != nil {
 			return nil, nil, nil, nil, fmt.Errorf("error getting missing monthly archives: %w", err)
@@ -679,25 +1252,80 @@ func CreateOrgArchives(ctx context.Context, rt *runtime.Runtime, now time.Time,
 		monthliesCreated, monthliesFailed = createArchives(ctx, rt, org, archives)
 	}
 
-	// then add in daily archives taking into account the monthly that have been built
-	daily, err := GetMissingDailyArchives(ctx, rt.DB, now, org, archiveType)
-	if err != nil {
-		return nil, nil, nil, nil, fmt.Errorf("error getting missing daily archives: %w", err)
-	}
+	// orgs archived hourly get hourlies instead of dailies which are then rolled up into dailies
+	if org.HourlyArchives {
+		hourly, err := GetMissingHourlyArchives(ctx, rt.DB, now, org, archiveType)
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("error getting missing hourly archives: %w", err)
+		}
 
-	// we then create missing daily archives
-	dailiesCreated, dailiesFailed = createArchives(ctx, rt, org, daily)
+		dailiesCreated, dailiesFailed = createArchives(ctx, rt, org, hourly)
+	} else {
+		// then add in daily archives taking into account the monthly that have been built
+		daily, err := GetMissingDailyArchives(ctx, rt.DB, now, org, archiveType)
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("error getting missing daily archives: %w", err)
+		}
+
+		// we then create missing daily archives
+		dailiesCreated, dailiesFailed = createArchives(ctx, rt, org, daily)
+	}
 
 	defer ctx.Done()
 
 	return dailiesCreated, dailiesFailed, monthliesCreated, monthliesFailed, nil
 }
 
+const sqlSumArchiveSizes = `
+SELECT COALESCE(SUM(size), 0) FROM archives_archive WHERE org_id = $1 AND archive_type = $2 AND period = $3 AND start_date >= $4 AND start_date < $5`
+
+const sqlMaxArchiveSize = `
+SELECT COALESCE(MAX(size), 0) FROM archives_archive WHERE org_id = $1 AND archive_type = $2 AND period = $3`
+
+// estimates the size of the file of the passed in archive so that we can reserve temp space for it. A rollup will be
+// about the size of the archives it's rolled up from, and otherwise we assume it will be no bigger than the org's
+// largest archive of the same type and period so far.
+func estimateArchiveSize(ctx context.Context, db *sqlx.DB, archive *Archive) (int64, error) {
+	var size int64
+	var err error
+
+	if childPeriod := archive.Period.childPeriod(); childPeriod != "" {
+		err = db.GetContext(ctx, &size, sqlSumArchiveSizes, archive.Org.ID, archive.ArchiveType, childPeriod, archive.StartDate, archive.endDate())
+	}
+	if err == nil && size == 0 {
+		err = db.GetContext(ctx, &size, sqlMaxArchiveSize, archive.Org.ID, archive.ArchiveType, archive.Period)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error estimating archive size for org: %d: %w", archive.Org.ID, err)
+	}
+	return size, nil
+}
+
 func createArchive(ctx context.Context, rt *runtime.Runtime, archive *Archive) error {
-	if err := CreateArchiveFile(ctx, rt.DB, archive, rt.Config.TempDir); err != nil {
+	archive.Format = ArchiveFormat(rt.Config.ArchiveFormat)
+	archive.Codec = ArchiveCodec(rt.Config.ArchiveCodec)
+
+	if err := prepareEncryption(ctx, rt, archive); err != nil {
+		return fmt.Errorf("error preparing archive encryption: %w", err)
+	}
+
+	estimate, err := estimateArchiveSize(ctx, rt.DB, archive)
+	if err != nil {
+		return err
+	}
+
+	tempSpace, err := acquireTempSpace(ctx, rt, estimate)
+	if err != nil {
+		return fmt.Errorf("error waiting for temp space: %w", err)
+	}
+	defer tempSpace.release()
+
+	if err := CreateArchiveFile(ctx, readerDB(ctx, rt), archive, rt.Config.TempDir); err != nil {
 		return fmt.Errorf("error writing archive file: %w", err)
 	}
 
+	tempSpace.resize(archive.Size)
+
 	defer func() {
 		if err := DeleteArchiveTempFile(archive); err != nil {
 			slog.Error("error deleting temporary archive file", "error", err)
@@ -728,11 +1356,15 @@ func createArchives(ctx context.Context, rt *runtime.Runtime, org Org, archives
 		log.With("start_date", archive.StartDate, "end_date", archive.endDate(), "period", archive.Period, "archive_type", archive.ArchiveType).Debug("starting archive")
 		start := dates.Now()
 
-		if err := createArchive(ctx, rt, archive); err != nil {
+		err := createArchive(ctx, rt, archive)
+		observeArchive(archive, err)
+
+		if err != nil {
 			log.Error("error creating archive", "error", err)
 			failed = append(failed, archive)
 		} else {
 			log.Debug("archive complete", "id", archive.ID, "record_count", archive.RecordCount, "elapsed", dates.Since(start))
+			metricRecordsArchived.WithLabelValues(string(archive.ArchiveType)).Add(float64(archive.RecordCount))
 			created = append(created, archive)
 		}
 	}
@@ -745,55 +1377,133 @@ func RollupOrgArchives(ctx context.Context, rt *runtime.Runtime, now time.Time,
 	ctx, cancel := context.WithTimeout(ctx, time.Hour*3)
 	defer cancel()
 
-	log := slog.With("org_id", org.ID, "org_name", org.Name, "archive_type", archiveType)
-
 	// get our missing monthly archives
 	archives, err := GetMissingMonthlyArchives(ctx, rt.DB, now, org, archiveType)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	created, failed := rollupArchives(ctx, rt, now, org, archiveType, archives)
+	return created, failed, nil
+}
+
+// RollupOrgDailyArchives rolls up daily archives from our hourly archives for orgs which are archived hourly
+func RollupOrgDailyArchives(ctx context.Context, rt *runtime.Runtime, now time.Time, org Org, archiveType ArchiveType) ([]*Archive, []*Archive, error) {
+	if !org.HourlyArchives {
+		return nil, nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Hour*3)
+	defer cancel()
+
+	// get our missing daily archives
+	archives, err := GetMissingDailyArchives(ctx, rt.DB, now, org, archiveType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	created, failed := rollupArchives(ctx, rt, now, org, archiveType, archives)
+	return created, failed, nil
+}
+
+// RollupOrgYearlyArchives rolls up yearly archives from our monthly archives if yearly rollups are enabled
+func RollupOrgYearlyArchives(ctx context.Context, rt *runtime.Runtime, now time.Time, org Org, archiveType ArchiveType) ([]*Archive, []*Archive, error) {
+	if !rt.Config.YearlyRollups {
+		return nil, nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Hour*6)
+	defer cancel()
+
+	// get our missing yearly archives
+	archives, err := GetMissingYearlyArchives(ctx, rt.DB, now, org, archiveType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	created, failed := rollupArchives(ctx, rt, now, org, archiveType, archives)
+	return created, failed, nil
+}
+
+func rollupArchives(ctx context.Context, rt *runtime.Runtime, now time.Time, org Org, archiveType ArchiveType, archives []*Archive) ([]*Archive, []*Archive) {
+	log := slog.With("org_id", org.ID, "org_name", org.Name, "archive_type", archiveType)
+
 	created := make([]*Archive, 0, len(archives))
 	failed := make([]*Archive, 0, 1)
 
 	// build them from rollups
 	for _, archive := range archives {
-		log := log.With("start_date", archive.StartDate)
+		log := log.With("start_date", archive.StartDate, "period", archive.Period)
 		start := dates.Now()
 
-		if err := BuildRollupArchive(ctx, rt, archive, now, org, archiveType); err != nil {
-			log.Error("error building monthly archive", "error", err)
+		err := rollupArchive(ctx, rt, archive, now, org, archiveType)
+		observeArchive(archive, err)
+
+		if err != nil {
+			log.Error("error creating rollup archive", "error", err)
 			failed = append(failed, archive)
 			continue
 		}
 
-		// only upload to S3 if there are records
-		if archive.RecordCount > 0 {
-			if err := UploadArchive(ctx, rt, archive); err != nil {
-				log.Error("error writing archive to s3", "error", err)
-				failed = append(failed, archive)
-				continue
-			}
+		log.Info("rollup created", "id", archive.ID, "record_count", archive.RecordCount, "elapsed", dates.Since(start))
+		created = append(created, archive)
+	}
+
+	return created, failed
+}
+
+func rollupArchive(ctx context.Context, rt *runtime.Runtime, archive *Archive, now time.Time, org Org, archiveType ArchiveType) error {
+	// streamed rollups don't use any temp space
+	if rt.Config.StreamRollups {
+		if err := StreamRollupArchive(ctx, rt, archive, now, org, archiveType); err != nil {
+			return fmt.Errorf("error streaming rollup archive: %w", err)
 		}
 
 		if err := WriteArchiveToDB(ctx, rt.DB, archive); err != nil {
-			log.Error("error writing record to db", "error", err)
-			failed = append(failed, archive)
-			continue
+			return fmt.Errorf("error writing record to db: %w", err)
 		}
+		return nil
+	}
+
+	// encryption is prepared by getRollupChildren once the rollup's children are known
+	estimate, err := estimateArchiveSize(ctx, rt.DB, archive)
+	if err != nil {
+		return err
+	}
+
+	tempSpace, err := acquireTempSpace(ctx, rt, estimate)
+	if err != nil {
+		return fmt.Errorf("error waiting for temp space: %w", err)
+	}
+	defer tempSpace.release()
 
+	if err := BuildRollupArchive(ctx, rt, archive, now, org, archiveType); err != nil {
+		return fmt.Errorf("error building rollup archive: %w", err)
+	}
+
+	tempSpace.resize(archive.Size)
+
+	defer func() {
 		if err := DeleteArchiveTempFile(archive); err != nil {
-			log.Error("error deleting temporary file", "error", err)
-			continue
+			slog.Error("error deleting temporary archive file", "error", err)
 		}
+	}()
 
-		log.Info("rollup created", "id", archive.ID, "record_count", archive.RecordCount, "elapsed", dates.Since(start))
-		created = append(created, archive)
+	// only upload to S3 if there are records
+	if archive.RecordCount > 0 {
+		if err := UploadArchive(ctx, rt, archive); err != nil {
+			return fmt.Errorf("error writing archive to s3: %w", err)
+		}
 	}
 
-	return created, failed, nil
+	if err := WriteArchiveToDB(ctx, rt.DB, archive); err != nil {
+		return fmt.Errorf("error writing record to db: %w", err)
+	}
+
+	return nil
 }
 
+// number of records deleted in each purge transaction to begin with, which is then adjusted by a purgeThrottle
 var deleteTransactionSize = 100
 
 // PurgeArchivedRecords deletes all the database records for the given org based on archives already created
@@ -806,22 +1516,20 @@ func PurgeArchivedRecords(ctx context.Context, rt *runtime.Runtime, now time.Tim
 
 	purged := make([]*Archive, 0, len(archives))
 	for _, a := range archives {
+		a.Org = org // so that date ranges are calculated in the org's timezone
+
 		log := slog.With("archive_id", a.ID, "org_id", a.OrgID, "type", a.ArchiveType, "count", a.RecordCount, "start", a.StartDate, "period", a.Period)
 
 		start := dates.Now()
 
-		switch a.ArchiveType {
-		case MessageType:
-			err = DeleteArchivedMessages(ctx, rt, a)
-			if err == nil {
-				err = DeleteBroadcasts(ctx, rt, now, org)
-			}
-		case RunType:
-			err = DeleteArchivedRuns(ctx, rt, a)
-			if err == nil {
-				err = DeleteFlowStarts(ctx, rt, now, org)
+		if spec := GetArchiveTypeSpec(a.ArchiveType); spec != nil {
+			err = spec.purge(ctx, rt, a)
+
+			// purging may leave other things of the org unused which can now be deleted too
+			if err == nil && spec.Cleanup != nil {
+				err = spec.Cleanup(ctx, rt, now, org)
 			}
-		default:
+		} else {
 			err = fmt.Errorf("unknown archive type: %s", a.ArchiveType)
 		}
 		if err != nil {
@@ -838,6 +1546,8 @@ func PurgeArchivedRecords(ctx context.Context, rt *runtime.Runtime, now time.Tim
 		a.NeedsDeletion = false
 		a.DeletedOn = &purgedOn
 
+		metricRecordsPurged.WithLabelValues(string(a.ArchiveType)).Add(float64(a.RecordCount))
+
 		purged = append(purged, a)
 		log.Debug("purged archive records", "elapsed", dates.Since(start))
 	}
@@ -846,52 +1556,66 @@ func PurgeArchivedRecords(ctx context.Context, rt *runtime.Runtime, now time.Tim
 }
 
 const sqlSelectDeletableArchives = `
-  SELECT uuid, id, org_id, start_date::timestamp with time zone AS start_date, period, archive_type, hash, location, size, record_count, needs_deletion, rollup_id
+  SELECT uuid, id, org_id, start_date::timestamp with time zone AS start_date, period, archive_type, hash, location, size, record_count, needs_deletion, rollup_id, ` + sqlSelectEncryption + `, ` + sqlSelectUTCOffset + `
     FROM archives_archive 
-   WHERE org_id = $1 AND archive_type = $2 AND period = 'D' AND rollup_id IS NOT NULL AND NOT needs_deletion`
+   WHERE org_id = $1 AND archive_type = $2 AND period = ANY($3) AND rollup_id IS NOT NULL AND NOT needs_deletion`
 
-// DeleteRolledUpDailyArchives deletes daily archives that have been rolled up into monthlies and had their records purged
+// DeleteRolledUpDailyArchives deletes daily archives that have been rolled up into monthlies and had their records purged,
+// as well as hourly archives that have been rolled up into dailies
 func DeleteRolledUpDailyArchives(ctx context.Context, rt *runtime.Runtime, org Org, archiveType ArchiveType) (int, error) {
+	return deleteRolledUpArchives(ctx, rt, org, archiveType, HourPeriod, DayPeriod)
+}
+
+// DeleteRolledUpMonthlyArchives deletes monthly archives that have been rolled up into yearlies and had their records purged
+func DeleteRolledUpMonthlyArchives(ctx context.Context, rt *runtime.Runtime, org Org, archiveType ArchiveType) (int, error) {
+	return deleteRolledUpArchives(ctx, rt, org, archiveType, MonthPeriod)
+}
+
+func deleteRolledUpArchives(ctx context.Context, rt *runtime.Runtime, org Org, archiveType ArchiveType, periods ...ArchivePeriod) (int, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
 	defer cancel()
 
-	log := slog.With("org_id", org.ID, "org_name", org.Name, "archive_type", archiveType)
+	log := slog.With("org_id", org.ID, "org_name", org.Name, "archive_type", archiveType, "periods", periods)
+
+	periodCodes := make([]string, len(periods))
+	for i, p := range periods {
+		periodCodes[i] = string(p)
+	}
 
 	var toDelete []*Archive
-	if err := rt.DB.SelectContext(ctx, &toDelete, sqlSelectDeletableArchives, org.ID, archiveType); err != nil {
-		return 0, fmt.Errorf("error selecting rolled up daily archives: %w", err)
+	if err := rt.DB.SelectContext(ctx, &toDelete, sqlSelectDeletableArchives, org.ID, archiveType, pq.Array(periodCodes)); err != nil {
+		return 0, fmt.Errorf("error selecting rolled up archives: %w", err)
 	}
 
 	if len(toDelete) == 0 {
 		return 0, nil
 	}
 
-	// collect IDs and S3 keys grouped by bucket
+	// collect IDs and locations of uploaded files
 	ids := make([]int, 0, len(toDelete))
-	keysByBucket := make(map[string][]string)
+	locations := make([]string, 0, len(toDelete))
 	for _, a := range toDelete {
 		ids = append(ids, a.ID)
 		if a.isUploaded() {
-			bucket, key := a.location()
-			keysByBucket[bucket] = append(keysByBucket[bucket], key)
+			locations = append(locations, string(a.Location))
 		}
 	}
 
-	// delete S3 files
-	s3DeletedCount := 0
-	for bucket, keys := range keysByBucket {
-		deleted, err := DeleteS3Files(ctx, rt.S3, bucket, keys)
-		s3DeletedCount += deleted
-		if err != nil {
-			log.Error("error deleting S3 files for rolled up daily archives", "bucket", bucket, "error", err)
-			// continue to try deleting database records
-		}
+	// delete stored files and their indexes
+	storage := storageFor(rt)
+	filesDeletedCount, err := storage.Delete(ctx, locations)
+	if err != nil {
+		log.Error("error deleting files for rolled up archives", "error", err)
+		// continue to try deleting database records
+	}
+	if _, err := storage.Delete(ctx, indexLocations(locations)); err != nil {
+		log.Error("error deleting indexes for rolled up archives", "error", err)
 	}
 
 	// delete archives from database by their IDs
 	result, err := rt.DB.ExecContext(ctx, `DELETE FROM archives_archive WHERE id = ANY($1)`, pq.Array(ids))
 	if err != nil {
-		return 0, fmt.Errorf("error deleting rolled up daily archives: %w", err)
+		return 0, fmt.Errorf("error deleting rolled up archives: %w", err)
 	}
 
 	deletedCount, err := result.RowsAffected()
@@ -900,7 +1624,7 @@ func DeleteRolledUpDailyArchives(ctx context.Context, rt *runtime.Runtime, org O
 	}
 
 	if deletedCount > 0 {
-		log.Info("deleted rolled up daily archives", "count", deletedCount, "s3_files_deleted", s3DeletedCount)
+		log.Info("deleted rolled up archives", "count", deletedCount, "files_deleted", filesDeletedCount)
 	}
 
 	return int(deletedCount), nil
@@ -908,9 +1632,24 @@ func DeleteRolledUpDailyArchives(ctx context.Context, rt *runtime.Runtime, org O
 
 // ArchiveOrg looks for any missing archives for the passed in org, creating and uploading them as necessary, returning the created archives
 func ArchiveOrg(ctx context.Context, rt *runtime.Runtime, now time.Time, org Org, archiveType ArchiveType) ([]*Archive, []*Archive, []*Archive, []*Archive, []*Archive, error) {
+	claim, err := ClaimOrg(org, archiveType)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+
+	return ArchiveClaimedOrg(ctx, rt, now, claim)
+}
+
+// ArchiveClaimedOrg archives the org and type of the passed in claim like ArchiveOrg, releasing the claim when done
+func ArchiveClaimedOrg(ctx context.Context, rt *runtime.Runtime, now time.Time, claim *OrgClaim) ([]*Archive, []*Archive, []*Archive, []*Archive, []*Archive, error) {
+	defer claim.Release()
+
+	org, archiveType, setStage := claim.org, claim.archiveType, claim.setStage
 	log := slog.With("org_id", org.ID, "org_name", org.Name)
 	start := dates.Now()
 
+	setStage("creating")
+
 	dailiesCreated, dailiesFailed, monthliesCreated, monthliesFailed, err := CreateOrgArchives(ctx, rt, now, org, archiveType)
 	if err != nil {
 		return nil, nil, nil, nil, nil, fmt.Errorf("error creating archives: %w", err)
@@ -922,6 +1661,17 @@ func ArchiveOrg(ctx context.Context, rt *runtime.Runtime, now time.Time, org Org
 		log.Info("completed archival for org", "elapsed", elapsed, "records_per_second", rate)
 	}
 
+	setStage("rolling_up")
+
+	// orgs archived hourly have their dailies rolled up from hourlies before they can be rolled up into monthlies
+	dailyRollupsCreated, dailyRollupsFailed, err := RollupOrgDailyArchives(ctx, rt, now, org, archiveType)
+	if err != nil {
+		return nil, nil, nil, nil, nil, fmt.Errorf("error rolling up daily archives: %w", err)
+	}
+
+	dailiesCreated = append(dailiesCreated, dailyRollupsCreated...)
+	dailiesFailed = append(dailiesFailed, dailyRollupsFailed...)
+
 	rollupsCreated, rollupsFailed, err := RollupOrgArchives(ctx, rt, now, org, archiveType)
 	if err != nil {
 		return nil, nil, nil, nil, nil, fmt.Errorf("error rolling up archives: %w", err)
@@ -931,22 +1681,68 @@ func ArchiveOrg(ctx context.Context, rt *runtime.Runtime, now time.Time, org Org
 	monthliesFailed = append(monthliesFailed, rollupsFailed...)
 	monthliesFailed = removeDuplicates(monthliesFailed) // don't double report monthlies that fail being built from db and rolled up from dailies
 
+	// yearlies are rolled up from monthlies and reported with them
+	yearliesCreated, yearliesFailed, err := RollupOrgYearlyArchives(ctx, rt, now, org, archiveType)
+	if err != nil {
+		return nil, nil, nil, nil, nil, fmt.Errorf("error rolling up yearly archives: %w", err)
+	}
+
+	monthliesCreated = append(monthliesCreated, yearliesCreated...)
+	monthliesFailed = append(monthliesFailed, yearliesFailed...)
+
+	setStage("purging")
+
 	// purge records from the database for dailies that still need it
 	dailiesPurged, err := PurgeArchivedRecords(ctx, rt, now, org, archiveType)
 	if err != nil {
 		return dailiesCreated, dailiesFailed, monthliesCreated, monthliesFailed, nil, fmt.Errorf("error purging archived records: %w", err)
 	}
 
+	setStage("deleting")
+
 	// delete daily archives that have been rolled up into monthlies and had their records purged
 	_, err = DeleteRolledUpDailyArchives(ctx, rt, org, archiveType)
 	if err != nil {
 		return dailiesCreated, dailiesFailed, monthliesCreated, monthliesFailed, dailiesPurged, fmt.Errorf("error deleting rolled up daily archives: %w", err)
 	}
 
+	// and optionally monthly archives that have been rolled up into yearlies
+	if rt.Config.DeleteRolledUpMonthlies {
+		if _, err := DeleteRolledUpMonthlyArchives(ctx, rt, org, archiveType); err != nil {
+			return dailiesCreated, dailiesFailed, monthliesCreated, monthliesFailed, dailiesPurged, fmt.Errorf("error deleting rolled up monthly archives: %w", err)
+		}
+	}
+
 	return dailiesCreated, dailiesFailed, monthliesCreated, monthliesFailed, dailiesPurged, nil
 }
 
-// ArchiveActiveOrgs fetches active orgs and archives messages and runs
+// returns the archive types which are enabled in the given config
+func enabledArchiveTypes(cfg *runtime.Config) []ArchiveType {
+	archiveTypes := make([]ArchiveType, 0, len(archiveTypeOrder))
+	for _, archiveType := range archiveTypeOrder {
+		if archiveType.IsEnabled(cfg) {
+			archiveTypes = append(archiveTypes, archiveType)
+		}
+	}
+	return archiveTypes
+}
+
+// totals of archiving a single type across all orgs
+type archiveTotals struct {
+	recordsArchived int
+	archivesCreated int
+	archivesFailed  int
+	rollupsCreated  int
+	rollupsFailed   int
+	orgsFailed      int
+}
+
+// returns the number of failures, i.e. orgs which errored and archives or rollups which couldn't be created
+func (t *archiveTotals) failures() int {
+	return t.archivesFailed + t.rollupsFailed + t.orgsFailed
+}
+
+// ArchiveActiveOrgs fetches active orgs and archives records of each enabled archive type
 func ArchiveActiveOrgs(rt *runtime.Runtime) error {
 	start := dates.Now()
 
@@ -959,69 +1755,100 @@ func ArchiveActiveOrgs(rt *runtime.Runtime) error {
 		return fmt.Errorf("error getting active orgs: %w", err)
 	}
 
-	totalRunsRecordsArchived, totalMsgsRecordsArchived := 0, 0
-	totalRunsArchivesCreated, totalMsgsArchivesCreated := 0, 0
-	totalRunsArchivesFailed, totalMsgsArchivesFailed := 0, 0
-	totalRunsRollupsCreated, totalMsgsRollupsCreated := 0, 0
-	totalRunsRollupsFailed, totalMsgsRollupsFailed := 0, 0
-
-	// for each org, do our export
-	for _, org := range orgs {
-		// no single org should take more than 12 hours
-		ctx, cancel := context.WithTimeout(context.Background(), time.Hour*12)
-		log := slog.With("org_id", org.ID, "org_name", org.Name)
-
-		if rt.Config.ArchiveMessages {
-			dailiesCreated, dailiesFailed, monthliesCreated, monthliesFailed, _, err := ArchiveOrg(ctx, rt, start, org, MessageType)
-			if err != nil {
-				log.Error("error archiving org messages", "error", err, "archive_type", MessageType)
-			}
-			totalMsgsRecordsArchived += countRecords(dailiesCreated)
-			totalMsgsArchivesCreated += len(dailiesCreated)
-			totalMsgsArchivesFailed += len(dailiesFailed)
-			totalMsgsRollupsCreated += len(monthliesCreated)
-			totalMsgsRollupsFailed += len(monthliesFailed)
-		}
-		if rt.Config.ArchiveRuns {
-			dailiesCreated, dailiesFailed, monthliesCreated, monthliesFailed, _, err := ArchiveOrg(ctx, rt, start, org, RunType)
-			if err != nil {
-				log.Error("error archiving org runs", "error", err, "archive_type", RunType)
+	archiveTypes := enabledArchiveTypes(rt.Config)
+
+	totals := make(map[ArchiveType]*archiveTotals, len(archiveTypes))
+	for _, archiveType := range archiveTypes {
+		totals[archiveType] = &archiveTotals{}
+	}
+	totalsMutex := &sync.Mutex{}
+
+	// orgs are archived by a pool of workers which each take the next org from this channel
+	orgsQueue := make(chan Org)
+	wg := &sync.WaitGroup{}
+
+	for range max(rt.Config.OrgWorkers, 1) {
+		wg.Go(func() {
+			for org := range orgsQueue {
+				// no single org should take more than 12 hours
+				ctx, cancel := context.WithTimeout(context.Background(), time.Hour*12)
+				log := slog.With("org_id", org.ID, "org_name", org.Name)
+
+				for _, archiveType := range archiveTypes {
+					dailiesCreated, dailiesFailed, monthliesCreated, monthliesFailed, _, err := ArchiveOrg(ctx, rt, start, org, archiveType)
+
+					// an org which is still being archived from a previous run or by a command isn't a failure
+					if errors.Is(err, ErrAlreadyArchiving) {
+						log.Info("skipping org which is already being archived", "archive_type", archiveType)
+						continue
+					}
+					if err != nil {
+						log.Error("error archiving org", "error", err, "archive_type", archiveType)
+					}
+
+					totalsMutex.Lock()
+					t := totals[archiveType]
+					t.recordsArchived += countRecords(dailiesCreated)
+					t.archivesCreated += len(dailiesCreated)
+					t.archivesFailed += len(dailiesFailed)
+					t.rollupsCreated += len(monthliesCreated)
+					t.rollupsFailed += len(monthliesFailed)
+					if err != nil {
+						t.orgsFailed++
+					}
+					totalsMutex.Unlock()
+				}
+
+				cancel()
 			}
-			totalRunsRecordsArchived += countRecords(dailiesCreated)
-			totalRunsArchivesCreated += len(dailiesCreated)
-			totalRunsArchivesFailed += len(dailiesFailed)
-			totalRunsRollupsCreated += len(monthliesCreated)
-			totalRunsRollupsFailed += len(monthliesFailed)
-		}
+		})
+	}
 
-		cancel()
+	for _, org := range orgs {
+		orgsQueue <- org
 	}
+	close(orgsQueue)
+	wg.Wait()
 
 	timeTaken := dates.Now().Sub(start)
 	slog.Info("archiving of active orgs complete", "time_taken", timeTaken, "num_orgs", len(orgs))
 
-	msgsDim := cwatch.Dimension("ArchiveType", "msgs")
-	runsDim := cwatch.Dimension("ArchiveType", "runs")
-
 	metrics := []types.MetricDatum{
 		cwatch.Datum("ArchivingElapsed", timeTaken.Seconds(), types.StandardUnitSeconds),
-		cwatch.Datum("RecordsArchived", float64(totalMsgsRecordsArchived), types.StandardUnitCount, msgsDim),
-		cwatch.Datum("RecordsArchived", float64(totalRunsRecordsArchived), types.StandardUnitCount, runsDim),
-		cwatch.Datum("ArchivesCreated", float64(totalMsgsArchivesCreated), types.StandardUnitCount, msgsDim),
-		cwatch.Datum("ArchivesCreated", float64(totalRunsArchivesCreated), types.StandardUnitCount, runsDim),
-		cwatch.Datum("ArchivesFailed", float64(totalMsgsArchivesFailed), types.StandardUnitCount, msgsDim),
-		cwatch.Datum("ArchivesFailed", float64(totalRunsArchivesFailed), types.StandardUnitCount, runsDim),
-		cwatch.Datum("RollupsCreated", float64(totalMsgsRollupsCreated), types.StandardUnitCount, msgsDim),
-		cwatch.Datum("RollupsCreated", float64(totalRunsRollupsCreated), types.StandardUnitCount, runsDim),
-		cwatch.Datum("RollupsFailed", float64(totalMsgsRollupsFailed), types.StandardUnitCount, msgsDim),
-		cwatch.Datum("RollupsFailed", float64(totalRunsRollupsFailed), types.StandardUnitCount, runsDim),
-	}
-
-	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
-	if err = rt.CW.Send(ctx, metrics...); err != nil {
-		slog.Error("error sending metrics", "error", err)
 	}
-	cancel()
+
+	for _, archiveType := range archiveTypes {
+		t := totals[archiveType]
+		dim := cwatch.Dimension("ArchiveType", archiveTypeSpecs[archiveType].MetricName)
+
+		metrics = append(metrics,
+			cwatch.Datum("RecordsArchived", float64(t.recordsArchived), types.StandardUnitCount, dim),
+			cwatch.Datum("ArchivesCreated", float64(t.archivesCreated), types.StandardUnitCount, dim),
+			cwatch.Datum("ArchivesFailed", float64(t.archivesFailed), types.StandardUnitCount, dim),
+			cwatch.Datum("RollupsCreated", float64(t.rollupsCreated), types.StandardUnitCount, dim),
+			cwatch.Datum("RollupsFailed", float64(t.rollupsFailed), types.StandardUnitCount, dim),
+		)
+	}
+
+	// only a run without any failures counts as a success, so that alerts on our last success fire if orgs keep failing
+	failures := 0
+	for _, t := range totals {
+		failures += t.failures()
+	}
+	if failures == 0 {
+		metricLastSuccess.SetToCurrentTime()
+	} else {
+		slog.Warn("archiving of active orgs completed with failures", "failures", failures)
+	}
+
+	// cloudwatch is optional if we're only using prometheus metrics
+	if rt.CW != nil {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+		if err = rt.CW.Send(ctx, metrics...); err != nil {
+			slog.Error("error sending metrics", "error", err)
+		}
+		cancel()
+	}
 
 	return nil
 }
@@ -3,9 +3,12 @@ package archives
 import (
 	"compress/gzip"
 	"context"
+	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -14,7 +17,9 @@ import (
 	_ "github.com/lib/pq"
 	"github.com/nyaruka/gocommon/aws/cwatch"
 	"github.com/nyaruka/gocommon/dbutil/assertdb"
+	"github.com/nyaruka/null/v3"
 	"github.com/nyaruka/rp-archiver/runtime"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/vinovest/sqlx"
@@ -58,7 +63,21 @@ func setup(t *testing.T) (context.Context, *runtime.Runtime) {
 		s3Client.EmptyBucket(ctx, "temba-archives")
 	})
 
-	return ctx, &runtime.Runtime{Config: config, DB: db, S3: s3Client, CW: CW}
+	schema, err := CheckSchema(ctx, db)
+	require.NoError(t, err)
+
+	return ctx, &runtime.Runtime{Config: config, DB: db, S3: s3Client, CW: CW, Schema: schema}
+}
+
+// setupLocal is setup using local storage, without the test database's archives as they point to files in S3
+func setupLocal(t *testing.T) (context.Context, *runtime.Runtime) {
+	ctx, rt := setup(t)
+
+	rt.DB.MustExec(`DELETE FROM archives_archive`)
+	rt.Config.StorageType = StorageTypeLocal
+	rt.Config.StorageDir = t.TempDir()
+
+	return ctx, rt
 }
 
 func TestGetMissingDayArchives(t *testing.T) {
@@ -135,6 +154,127 @@ func TestGetMissingMonthArchives(t *testing.T) {
 
 }
 
+func TestArchiveDates(t *testing.T) {
+	start := time.Date(2017, 8, 10, 5, 0, 0, 0, time.UTC)
+
+	tcs := []struct {
+		period  ArchivePeriod
+		endDate time.Time
+		key     string
+	}{
+		{HourPeriod, time.Date(2017, 8, 10, 6, 0, 0, 0, time.UTC), "2/message_H2017081005_abc.jsonl.gz"},
+		{DayPeriod, time.Date(2017, 8, 11, 5, 0, 0, 0, time.UTC), "2/message_D20170810_abc.jsonl.gz"},
+		{MonthPeriod, time.Date(2017, 9, 10, 5, 0, 0, 0, time.UTC), "2/message_M201708_abc.jsonl.gz"},
+		{YearPeriod, time.Date(2018, 8, 10, 5, 0, 0, 0, time.UTC), "2/message_Y2017_abc.jsonl.gz"},
+	}
+
+	for _, tc := range tcs {
+		archive := &Archive{Org: Org{ID: 2}, ArchiveType: MessageType, Period: tc.period, StartDate: start, Hash: "abc", Format: FormatJSONL, Codec: CodecGzip}
+
+		assert.Equal(t, tc.endDate, archive.endDate(), "end date mismatch for period %s", tc.period)
+		assert.Equal(t, tc.key, archiveKey(archive), "key mismatch for period %s", tc.period)
+	}
+}
+
+func TestArchiveLocalDates(t *testing.T) {
+	org := Org{ID: 2, Timezone: "America/Los_Angeles"}
+	require.NoError(t, org.loadLocation())
+
+	// the day the clocks went back in 2017 was 25 hours long
+	start := time.Date(2017, 11, 5, 0, 0, 0, 0, org.location())
+	archive := &Archive{Org: org, ArchiveType: MessageType, Period: DayPeriod, StartDate: start.UTC(), UTCOffset: org.utcOffset(start), Hash: "abc", Format: FormatJSONL, Codec: CodecGzip}
+
+	assert.Equal(t, -7*60*60, archive.UTCOffset)
+	assert.Equal(t, time.Date(2017, 11, 6, 8, 0, 0, 0, time.UTC), archive.endDate().UTC())
+	assert.Equal(t, "2/message_D20171105_abc.jsonl.gz", archiveKey(archive))
+
+	// an archive whose org has since changed timezone keeps its boundaries by using its own offset
+	archive.Org = Org{ID: 2}
+	assert.Equal(t, time.Date(2017, 11, 6, 7, 0, 0, 0, time.UTC), archive.endDate().UTC())
+	assert.Equal(t, "2/message_D20171105_abc.jsonl.gz", archiveKey(archive))
+
+	// an invalid timezone is an error
+	assert.EqualError(t, (&Org{ID: 3, Timezone: "Mars/Olympus"}).loadLocation(), "error loading timezone for org: 3: unknown time zone Mars/Olympus")
+}
+
+func TestGetMissingHourArchives(t *testing.T) {
+	ctx, rt := setup(t)
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	assert.NoError(t, err)
+
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	// org 1 is too new, no tasks
+	tasks, err := GetMissingHourlyArchives(ctx, rt.DB, now, orgs[0], MessageType)
+	assert.NoError(t, err)
+	assert.Len(t, tasks, 0)
+
+	// org 2 has the hours of the same days as its missing dailies, so not those of its existing daily
+	tasks, err = GetMissingHourlyArchives(ctx, rt.DB, now, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Len(t, tasks, 61*24)
+	assert.Equal(t, time.Date(2017, 8, 10, 0, 0, 0, 0, time.UTC), tasks[0].StartDate)
+	assert.Equal(t, time.Date(2017, 8, 10, 1, 0, 0, 0, time.UTC), tasks[1].StartDate)
+	assert.Equal(t, time.Date(2017, 10, 10, 23, 0, 0, 0, time.UTC), tasks[61*24-1].StartDate)
+	assert.Equal(t, HourPeriod, tasks[0].Period)
+	assert.Equal(t, time.Date(2017, 8, 10, 1, 0, 0, 0, time.UTC), tasks[0].endDate())
+
+	// org 3 also has its hours covered by an existing monthly
+	tasks, err = GetMissingHourlyArchives(ctx, rt.DB, now, orgs[2], MessageType)
+	assert.NoError(t, err)
+	assert.Len(t, tasks, 31*24)
+	assert.Equal(t, time.Date(2017, 8, 11, 0, 0, 0, 0, time.UTC), tasks[0].StartDate)
+
+	// hourlies don't count as their day having a daily
+	rt.DB.MustExec(`INSERT INTO archives_archive(uuid, org_id, archive_type, created_on, start_date, period, record_count, size, needs_deletion, build_time) 
+	VALUES('019c2a0b-47ae-7a53-a1c4-7d3c6a1e0d01', $1, 'message', NOW(), '2017-08-10 05:00:00+00', 'H', 0, 0, FALSE, 0)`, orgs[1].ID)
+
+	tasks, err = GetMissingDailyArchives(ctx, rt.DB, now, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Len(t, tasks, 61)
+
+	tasks, err = GetMissingHourlyArchives(ctx, rt.DB, now, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Len(t, tasks, 61*24-1)
+}
+
+func TestOrgRetentionPeriods(t *testing.T) {
+	ctx, rt := setup(t)
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	assert.NoError(t, err)
+
+	// org 1 has no config and org 2 has no overrides so both use the default
+	assert.Equal(t, 90, orgs[0].retentionPeriod(MessageType))
+	assert.Equal(t, 90, orgs[1].retentionPeriod(MessageType))
+
+	// org 3 overrides the retention period of sessions only
+	assert.Equal(t, 90, orgs[2].retentionPeriod(MessageType))
+	assert.Equal(t, 90, orgs[2].retentionPeriod(RunType))
+	assert.Equal(t, 120, orgs[2].retentionPeriod(SessionType))
+
+	// org 4 overrides the retention period of all types
+	org4, err := GetOrg(ctx, rt, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, 365, org4.retentionPeriod(MessageType))
+	assert.Equal(t, 365, org4.retentionPeriod(SessionType))
+
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	// which is used when working out which archives are missing
+	tasks, err := GetMissingDailyArchives(ctx, rt.DB, now, orgs[2], SessionType)
+	assert.NoError(t, err)
+	assert.Len(t, tasks, 32)
+	assert.Equal(t, time.Date(2017, 8, 10, 0, 0, 0, 0, time.UTC), tasks[0].StartDate)
+	assert.Equal(t, time.Date(2017, 9, 10, 0, 0, 0, 0, time.UTC), tasks[31].StartDate)
+
+	tasks, err = GetMissingMonthlyArchives(ctx, rt.DB, now, orgs[2], SessionType)
+	assert.NoError(t, err)
+	assert.Len(t, tasks, 1)
+	assert.Equal(t, time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), tasks[0].StartDate)
+}
+
 func TestCreateMsgArchive(t *testing.T) {
 	ctx, rt := setup(t)
 
@@ -539,68 +679,1323 @@ func TestArchiveOrgRuns(t *testing.T) {
 	assert.Equal(t, 0, len(monthliesFailed))
 }
 
-func TestArchiveActiveOrgs(t *testing.T) {
-	_, rt := setup(t)
+func TestArchiveOrgRunsCSV(t *testing.T) {
+	ctx, rt := setupLocal(t)
 
-	err := ArchiveActiveOrgs(rt)
+	rt.Config.ArchiveFormat = "csv"
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	_, _, monthliesCreated, _, _, err := ArchiveOrg(ctx, rt, now, orgs[1], RunType)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, len(monthliesCreated))
+	assert.Equal(t, 4, monthliesCreated[0].RecordCount)
+	assert.True(t, strings.HasSuffix(string(monthliesCreated[0].Location), ".csv.gz"))
+	assert.Equal(t, FormatCSV, formatFromLocation(string(monthliesCreated[0].Location)))
+
+	reader, err := storageFor(rt).Get(ctx, string(monthliesCreated[0].Location))
+	require.NoError(t, err)
+	defer reader.Close()
+	gzipReader, err := gzip.NewReader(reader)
+	require.NoError(t, err)
+	contents, err := io.ReadAll(gzipReader)
+	require.NoError(t, err)
+
+	assert.True(t, strings.HasPrefix(string(contents), "id,uuid,flow.uuid,flow.name,contact.uuid,contact.name,responded,path,values,created_on,modified_on,exited_on,exit_type\n"))
+
+	// a deep verify decompresses the CSV files to check their record counts
+	report, err := VerifyArchives(ctx, rt, orgs[1].ID, true)
 	assert.NoError(t, err)
+	assert.Len(t, report.Issues, 0)
 
+	// CSV archives can't be restored
+	_, _, err = RestoreArchivedRecords(ctx, rt, orgs[1], RunType, time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC))
+	assert.ErrorContains(t, err, "restoring not supported for archive format: csv")
 }
 
-func TestDeleteRolledUpDailyArchives(t *testing.T) {
+func TestCreateSessionArchive(t *testing.T) {
 	ctx, rt := setup(t)
 
 	orgs, err := GetActiveOrgs(ctx, rt)
 	assert.NoError(t, err)
 	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
 
-	org := orgs[1]
+	tasks, err := GetMissingDailyArchives(ctx, rt.DB, now, orgs[1], SessionType)
+	assert.NoError(t, err)
+	assert.Equal(t, 62, len(tasks))
 
-	// Step 1: Create daily archives (monthlies are created via RollupOrgArchives, not CreateOrgArchives unless it's a backfill)
-	dailiesCreated, _, _, _, err := CreateOrgArchives(ctx, rt, now, org, MessageType)
+	// first task has no ended sessions
+	task := tasks[0]
+	err = CreateArchiveFile(ctx, rt.DB, task, "/tmp")
 	assert.NoError(t, err)
-	assert.Greater(t, len(dailiesCreated), 0, "should have created daily archives")
 
-	// Step 2: Roll up daily archives into monthlies
-	rollupsCreated, _, err := RollupOrgArchives(ctx, rt, now, org, MessageType)
+	assert.Equal(t, 0, task.RecordCount)
+	assert.Equal(t, int64(0), task.Size)
+	assert.Equal(t, "", string(task.Hash))
+
+	DeleteArchiveTempFile(task)
+
+	// third task has two ended sessions, the waiting session isn't included
+	task = tasks[2]
+	err = CreateArchiveFile(ctx, rt.DB, task, "/tmp")
 	assert.NoError(t, err)
-	assert.Greater(t, len(rollupsCreated), 0, "should have created rollup archives")
 
-	// Step 3: Delete archived records (this sets deleted_on on archives)
-	deleted, err := PurgeArchivedRecords(ctx, rt, now, org, MessageType)
+	assert.Equal(t, time.Date(2017, 8, 12, 0, 0, 0, 0, time.UTC), task.StartDate)
+	assert.Equal(t, 2, task.RecordCount)
+	assert.Greater(t, task.Size, int64(0))
+	assert.NotEqual(t, "", string(task.Hash))
+
+	DeleteArchiveTempFile(task)
+}
+
+func TestArchiveOrgSessions(t *testing.T) {
+	ctx, rt := setup(t)
+
+	orgs, err := GetActiveOrgs(ctx, rt)
 	assert.NoError(t, err)
-	assert.Greater(t, len(deleted), 0, "should have deleted some archived records")
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
 
-	// Count total archives before deletion
-	var countBefore int
-	err = rt.DB.Get(&countBefore, "SELECT count(*) FROM archives_archive WHERE org_id = $1 AND archive_type = $2", org.ID, MessageType)
+	// no existing session archives so we backfill monthlies for 2017-08 and 2017-09 and then dailies for 2017-10-01 to 2017-10-10
+	dailiesCreated, dailiesFailed, monthliesCreated, monthliesFailed, deleted, err := ArchiveOrg(ctx, rt, now, orgs[1], SessionType)
 	assert.NoError(t, err)
 
-	// Count daily archives that have been rolled up and are ready for cleanup (needs_deletion = false means records have been deleted or archive was empty)
-	var countRolledUp int
-	err = rt.DB.Get(&countRolledUp, "SELECT count(*) FROM archives_archive WHERE org_id = $1 AND archive_type = $2 AND period = $3 AND rollup_id IS NOT NULL AND needs_deletion = FALSE", org.ID, MessageType, DayPeriod)
+	assert.Equal(t, 10, len(dailiesCreated))
+	assert.Equal(t, 0, len(dailiesFailed))
+	assert.Equal(t, 2, len(monthliesCreated))
+	assert.Equal(t, 0, len(monthliesFailed))
+	assert.Equal(t, time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), monthliesCreated[0].StartDate)
+	assert.Equal(t, 2, monthliesCreated[0].RecordCount)
+	assert.NotEmpty(t, monthliesCreated[0].Location)
+
+	assert.Equal(t, 1, len(deleted))
+	assert.Equal(t, monthliesCreated[0].ID, deleted[0].ID)
+
+	// only the waiting session remains for this org
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM flows_flowsession WHERE org_id = $1", orgs[1].ID).Returns(1)
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM flows_flowsession WHERE org_id = $1 AND ended_on IS NULL", orgs[1].ID).Returns(1)
+
+	// and sessions for other orgs are unaffected
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM flows_flowsession WHERE org_id = $1", orgs[2].ID).Returns(1)
+}
+
+func TestArchiveOrgChannelLogs(t *testing.T) {
+	ctx, rt := setup(t)
+
+	orgs, err := GetActiveOrgs(ctx, rt)
 	assert.NoError(t, err)
-	assert.Greater(t, countRolledUp, 0, "should have some daily archives that were rolled up and ready for cleanup")
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
 
-	// Now call the function explicitly to delete rolled up dailies
-	deletedCount, err := DeleteRolledUpDailyArchives(ctx, rt, org, MessageType)
+	dailiesCreated, _, monthliesCreated, _, deleted, err := ArchiveOrg(ctx, rt, now, orgs[1], ChannelLogType)
 	assert.NoError(t, err)
-	assert.Equal(t, countRolledUp, deletedCount, "should delete all rolled up daily archives")
 
-	// After deletion, count should be reduced
-	var countAfter int
-	err = rt.DB.Get(&countAfter, "SELECT count(*) FROM archives_archive WHERE org_id = $1 AND archive_type = $2", org.ID, MessageType)
+	assert.Equal(t, 10, len(dailiesCreated))
+	assert.Equal(t, 2, len(monthliesCreated))
+	assert.Equal(t, 2, monthliesCreated[0].RecordCount)
+	assert.Equal(t, 1, len(deleted))
+
+	// only the recent log remains for this org's channel, and logs of other orgs' channels are unaffected
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM channels_channellog WHERE channel_id = 2").Returns(1)
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM channels_channellog WHERE channel_id = 2 AND created_on > '2017-12-01'").Returns(1)
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM channels_channellog WHERE channel_id = 3").Returns(1)
+}
+
+func TestArchiveOrgHTTPLogs(t *testing.T) {
+	ctx, rt := setup(t)
+
+	orgs, err := GetActiveOrgs(ctx, rt)
 	assert.NoError(t, err)
-	assert.Equal(t, countBefore-countRolledUp, countAfter, "archive count should be reduced by deleted count")
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
 
-	// No more rolled up daily archives ready for cleanup should exist
-	err = rt.DB.Get(&countRolledUp, "SELECT count(*) FROM archives_archive WHERE org_id = $1 AND archive_type = $2 AND period = $3 AND rollup_id IS NOT NULL AND needs_deletion = FALSE", org.ID, MessageType, DayPeriod)
+	_, _, monthliesCreated, _, deleted, err := ArchiveOrg(ctx, rt, now, orgs[1], HTTPLogType)
 	assert.NoError(t, err)
-	assert.Equal(t, 0, countRolledUp, "no rolled up daily archives should remain")
 
-	// Monthly archives should still exist
-	var countMonthly int
-	err = rt.DB.Get(&countMonthly, "SELECT count(*) FROM archives_archive WHERE org_id = $1 AND archive_type = $2 AND period = $3", org.ID, MessageType, MonthPeriod)
+	assert.Equal(t, 2, len(monthliesCreated))
+	assert.Equal(t, 1, monthliesCreated[0].RecordCount)
+	assert.Equal(t, 1, monthliesCreated[1].RecordCount)
+	assert.Equal(t, 2, len(deleted))
+
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM request_logs_httplog WHERE org_id = $1", orgs[1].ID).Returns(1)
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM request_logs_httplog WHERE org_id = $1", orgs[2].ID).Returns(1)
+}
+
+func TestArchiveOrgTickets(t *testing.T) {
+	ctx, rt := setup(t)
+
+	orgs, err := GetActiveOrgs(ctx, rt)
 	assert.NoError(t, err)
-	assert.Greater(t, countMonthly, 0, "monthly archives should still exist")
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	_, _, monthliesCreated, _, deleted, err := ArchiveOrg(ctx, rt, now, orgs[1], TicketType)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, len(monthliesCreated))
+	assert.Equal(t, 1, monthliesCreated[0].RecordCount)
+	assert.Equal(t, 1, len(deleted))
+
+	// open tickets and recently closed tickets remain, as do the events of the open ticket
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM tickets_ticket WHERE org_id = $1", orgs[1].ID).Returns(2)
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM tickets_ticket WHERE org_id = $1 AND status = 'O'", orgs[1].ID).Returns(1)
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM tickets_ticketevent WHERE ticket_id = 1").Returns(0)
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM tickets_ticketevent WHERE ticket_id = 2").Returns(1)
+}
+
+func TestArchiveOrgHourly(t *testing.T) {
+	ctx, rt := setupLocal(t)
+
+	rt.DB.MustExec(`UPDATE orgs_org SET config = '{"hourly_archives": true}' WHERE id = 2`)
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	require.NoError(t, err)
+	require.True(t, orgs[1].HourlyArchives)
+	assert.False(t, orgs[2].HourlyArchives)
+
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	// a fresh org doesn't have monthlies built from the database as they'd be too big, instead its backfill builds
+	// hourlies for 2017-08-10 to 2017-10-10 which are rolled up into dailies, and the dailies of full months into monthlies
+	dailiesCreated, dailiesFailed, monthliesCreated, monthliesFailed, _, err := ArchiveOrg(ctx, rt, now, orgs[1], MessageType)
+	require.NoError(t, err)
+	assert.Len(t, dailiesFailed, 0)
+	assert.Len(t, monthliesFailed, 0)
+	require.Len(t, dailiesCreated, 62*24+62)
+
+	hourlies, dailies := dailiesCreated[:62*24], dailiesCreated[62*24:]
+	hourlyRecords, dailyRecords, monthlyRecords := 0, 0, 0
+	for _, a := range hourlies {
+		assert.Equal(t, HourPeriod, a.Period)
+		hourlyRecords += a.RecordCount
+	}
+	for _, a := range dailies {
+		assert.Equal(t, DayPeriod, a.Period)
+		assert.Len(t, a.Dailies, 24)
+		dailyRecords += a.RecordCount
+
+		if a.RecordCount > 0 {
+			assert.Contains(t, string(a.Location), fmt.Sprintf("/message_D%s_", a.StartDate.Format("20060102")))
+		}
+	}
+	assert.Equal(t, time.Date(2017, 8, 10, 0, 0, 0, 0, time.UTC), hourlies[0].StartDate)
+	assert.Equal(t, time.Date(2017, 10, 10, 23, 0, 0, 0, time.UTC), hourlies[len(hourlies)-1].StartDate)
+	assert.Greater(t, hourlyRecords, 0)
+	assert.Equal(t, hourlyRecords, dailyRecords)
+
+	require.Len(t, monthliesCreated, 2)
+	for _, a := range monthliesCreated {
+		assert.Equal(t, MonthPeriod, a.Period)
+		assert.Greater(t, len(a.Dailies), 0)
+		monthlyRecords += a.RecordCount
+	}
+	assert.Equal(t, time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), monthliesCreated[0].StartDate)
+	assert.Equal(t, time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC), monthliesCreated[1].StartDate)
+	assert.Greater(t, monthlyRecords, 0)
+
+	// hourlies have been rolled up, purged and deleted
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM archives_archive WHERE org_id = 2 AND period = 'H'").Returns(0)
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM archives_archive WHERE org_id = 2 AND period = 'D'").Returns(10)
+
+	// and nothing is missing next time
+	dailiesCreated, _, monthliesCreated, _, _, err = ArchiveOrg(ctx, rt, now, orgs[1], MessageType)
+	require.NoError(t, err)
+	assert.Len(t, dailiesCreated, 0)
+	assert.Len(t, monthliesCreated, 0)
+}
+
+func TestArchiveOrgHourlyWithDateStartDates(t *testing.T) {
+	ctx, rt := setupLocal(t)
+
+	rt.DB.MustExec(`UPDATE orgs_org SET config = '{"hourly_archives": true}' WHERE id = 2`)
+
+	// a database which hasn't had the timestamp start dates migration run
+	rt.DB.MustExec(`ALTER TABLE archives_archive ALTER COLUMN start_date TYPE date`)
+
+	var err error
+	rt.Schema, err = CheckSchema(ctx, rt.DB)
+	require.NoError(t, err)
+	assert.True(t, rt.Schema.PurgeProgress)
+	assert.False(t, rt.Schema.TimestampStartDates)
+
+	// can't store the start of an hour so the org is archived daily
+	orgs, err := GetActiveOrgs(ctx, rt)
+	require.NoError(t, err)
+	assert.False(t, orgs[1].HourlyArchives)
+
+	org, err := GetOrg(ctx, rt, 2)
+	require.NoError(t, err)
+	assert.False(t, org.HourlyArchives)
+
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	dailiesCreated, dailiesFailed, monthliesCreated, monthliesFailed, _, err := ArchiveOrg(ctx, rt, now, orgs[1], MessageType)
+	require.NoError(t, err)
+	assert.Len(t, dailiesFailed, 0)
+	assert.Len(t, monthliesFailed, 0)
+	assert.Len(t, monthliesCreated, 2)
+	assert.Len(t, dailiesCreated, 10)
+
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM archives_archive WHERE org_id = 2 AND period = 'H'").Returns(0)
+}
+
+func TestArchiveOrgLocalTimezone(t *testing.T) {
+	ctx, rt := setupLocal(t)
+
+	rt.DB.MustExec(`UPDATE orgs_org SET config = '{"local_archives": true}' WHERE id = 2`)
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	require.NoError(t, err)
+	assert.Equal(t, "America/Los_Angeles", orgs[1].Timezone)
+	assert.Equal(t, "UTC", orgs[2].Timezone)
+
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	// days start at midnight in Los Angeles
+	tasks, err := GetMissingDailyArchives(ctx, rt.DB, now, orgs[1], MessageType)
+	require.NoError(t, err)
+	require.Len(t, tasks, 62)
+	assert.Equal(t, time.Date(2017, 8, 10, 7, 0, 0, 0, time.UTC), tasks[0].StartDate.UTC())
+	assert.Equal(t, time.Date(2017, 10, 10, 7, 0, 0, 0, time.UTC), tasks[61].StartDate.UTC())
+	assert.Equal(t, -7*60*60, tasks[0].UTCOffset)
+
+	// backfill builds monthlies for 2017-08 and 2017-09 and dailies for 2017-10-01 to 2017-10-10, all in local time
+	dailiesCreated, dailiesFailed, monthliesCreated, monthliesFailed, _, err := ArchiveOrg(ctx, rt, now, orgs[1], MessageType)
+	require.NoError(t, err)
+	assert.Len(t, dailiesFailed, 0)
+	assert.Len(t, monthliesFailed, 0)
+	require.Len(t, dailiesCreated, 10)
+	require.Len(t, monthliesCreated, 2)
+
+	assert.Equal(t, time.Date(2017, 8, 1, 7, 0, 0, 0, time.UTC), monthliesCreated[0].StartDate.UTC())
+	assert.Equal(t, time.Date(2017, 10, 1, 7, 0, 0, 0, time.UTC), dailiesCreated[0].StartDate.UTC())
+
+	for _, a := range append(dailiesCreated, monthliesCreated...) {
+		if a.RecordCount > 0 {
+			assert.Contains(t, string(a.Location), fmt.Sprintf("/message_%s%s_", a.Period, a.keyDate()))
+		}
+	}
+
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM archives_archive WHERE org_id = 2 AND utc_offset = -25200").Returns(12)
+
+	// and nothing is missing next time
+	dailiesCreated, _, monthliesCreated, _, _, err = ArchiveOrg(ctx, rt, now, orgs[1], MessageType)
+	require.NoError(t, err)
+	assert.Len(t, dailiesCreated, 0)
+	assert.Len(t, monthliesCreated, 0)
+
+	// an org which already has UTC archives can't switch to local archives as its days wouldn't line up
+	_, _, monthliesCreated, _, _, err = ArchiveOrg(ctx, rt, now, orgs[2], MessageType)
+	require.NoError(t, err)
+	require.Greater(t, len(monthliesCreated), 0)
+
+	rt.DB.MustExec(`UPDATE orgs_org SET config = '{"local_archives": true}' WHERE id = 3`)
+
+	org, err := GetOrg(ctx, rt, 3)
+	require.NoError(t, err)
+	assert.False(t, org.LocalArchives)
+	assert.Equal(t, "UTC", org.Timezone)
+
+	// but the org with local archives keeps them
+	org, err = GetOrg(ctx, rt, 2)
+	require.NoError(t, err)
+	assert.True(t, org.LocalArchives)
+	assert.Equal(t, "America/Los_Angeles", org.Timezone)
+}
+
+func TestArchiveOrgLocalTimezoneWithoutUTCOffsets(t *testing.T) {
+	ctx, rt := setupLocal(t)
+
+	rt.DB.MustExec(`UPDATE orgs_org SET config = '{"local_archives": true}' WHERE id = 2`)
+
+	// a database which hasn't had the UTC offsets migration run
+	rt.DB.MustExec(`ALTER TABLE archives_archive DROP COLUMN utc_offset`)
+
+	var err error
+	rt.Schema, err = CheckSchema(ctx, rt.DB)
+	require.NoError(t, err)
+	assert.True(t, rt.Schema.TimestampStartDates)
+	assert.False(t, rt.Schema.UTCOffsets)
+
+	// so the org is archived in UTC
+	orgs, err := GetActiveOrgs(ctx, rt)
+	require.NoError(t, err)
+	assert.False(t, orgs[1].LocalArchives)
+	assert.Equal(t, "UTC", orgs[1].Timezone)
+
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	dailiesCreated, dailiesFailed, monthliesCreated, monthliesFailed, _, err := ArchiveOrg(ctx, rt, now, orgs[1], MessageType)
+	require.NoError(t, err)
+	assert.Len(t, dailiesFailed, 0)
+	assert.Len(t, monthliesFailed, 0)
+	require.Len(t, dailiesCreated, 10)
+	require.Len(t, monthliesCreated, 2)
+	assert.Equal(t, time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), monthliesCreated[0].StartDate)
+
+	// and its archives can be read back without the column
+	archives, err := GetCurrentArchives(ctx, rt.DB, orgs[1], MessageType)
+	require.NoError(t, err)
+	require.Len(t, archives, 12)
+	assert.Equal(t, 0, archives[0].UTCOffset)
+}
+
+func TestResumeInterruptedPurge(t *testing.T) {
+	ctx, rt := setupLocal(t)
+
+	defer func(size, pageSize int) { deleteTransactionSize, purgePageSize = size, pageSize }(deleteTransactionSize, purgePageSize)
+	deleteTransactionSize = 1
+	purgePageSize = 2
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	require.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	monthlies, err := GetMissingMonthlyArchives(ctx, rt.DB, now, orgs[1], MessageType)
+	require.NoError(t, err)
+
+	archive := monthlies[0]
+	assert.Equal(t, time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), archive.StartDate)
+
+	require.NoError(t, CreateArchiveFile(ctx, rt.DB, archive, t.TempDir()))
+	require.NoError(t, UploadArchive(ctx, rt, archive))
+	require.NoError(t, WriteArchiveToDB(ctx, rt.DB, archive))
+
+	var firstID int64
+	require.NoError(t, rt.DB.Get(&firstID, `SELECT min(id) FROM msgs_msg WHERE org_id = $1 AND created_on >= $2 AND created_on < $3`, orgs[1].ID, archive.StartDate, archive.endDate()))
+
+	// simulate a purge which was interrupted after deleting the first message
+	rt.DB.MustExec(`INSERT INTO archives_purgeprogress(archive_id, last_id, deleted_count, updated_on) VALUES($1, $2, 1, NOW())`, archive.ID, firstID)
+
+	err = DeleteArchivedMessages(ctx, rt, archive)
+	assert.NoError(t, err)
+
+	// purge resumed after the checkpoint so only the message we pretended was deleted remains
+	assertdb.Query(t, rt.DB, getMsgCount, orgs[1].ID, archive.StartDate, archive.endDate()).Returns(1)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE id = $1`, firstID).Returns(1)
+
+	// and our checkpoint is removed now that the purge is complete
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM archives_purgeprogress`).Returns(0)
+}
+
+func TestPurgeWithoutProgressTable(t *testing.T) {
+	ctx, rt := setupLocal(t)
+
+	// a database which hasn't had the purge progress migration run
+	rt.DB.MustExec(`DROP TABLE archives_purgeprogress`)
+
+	var err error
+	rt.Schema, err = CheckSchema(ctx, rt.DB)
+	require.NoError(t, err)
+	assert.False(t, rt.Schema.PurgeProgress)
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	require.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	monthlies, err := GetMissingMonthlyArchives(ctx, rt.DB, now, orgs[1], MessageType)
+	require.NoError(t, err)
+
+	archive := monthlies[0]
+	require.NoError(t, CreateArchiveFile(ctx, rt.DB, archive, t.TempDir()))
+	require.NoError(t, UploadArchive(ctx, rt, archive))
+	require.NoError(t, WriteArchiveToDB(ctx, rt.DB, archive))
+
+	// records are still purged, just without checkpoints
+	err = DeleteArchivedMessages(ctx, rt, archive)
+	assert.NoError(t, err)
+
+	assertdb.Query(t, rt.DB, getMsgCount, orgs[1].ID, archive.StartDate, archive.endDate()).Returns(0)
+}
+
+func TestPurgeThrottled(t *testing.T) {
+	ctx, rt := setupLocal(t)
+
+	defer func(interval time.Duration) { throttleCheckInterval = interval }(throttleCheckInterval)
+	throttleCheckInterval = 0
+
+	// any other active connection means the database is under load
+	rt.Config.PurgeMaxLag = 0
+	rt.Config.PurgeMaxActive = 1
+	rt.Config.PurgeMaxSleep = 500
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	require.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	monthlies, err := GetMissingMonthlyArchives(ctx, rt.DB, now, orgs[1], MessageType)
+	require.NoError(t, err)
+
+	archive := monthlies[0]
+	require.NoError(t, CreateArchiveFile(ctx, rt.DB, archive, t.TempDir()))
+	require.NoError(t, UploadArchive(ctx, rt, archive))
+	require.NoError(t, WriteArchiveToDB(ctx, rt.DB, archive))
+
+	// keep another connection busy for the duration of the purge
+	busyCtx, cancelBusy := context.WithCancel(ctx)
+	defer cancelBusy()
+	go rt.DB.ExecContext(busyCtx, `SELECT pg_sleep(30)`)
+
+	require.Eventually(t, func() bool {
+		var active int
+		rt.DB.Get(&active, sqlSelectActiveConnections)
+		return active > 1
+	}, time.Second*5, time.Millisecond*50)
+
+	// so the purge sleeps before each transaction
+	start := time.Now()
+	err = DeleteArchivedMessages(ctx, rt, archive)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), throttleMinSleep)
+
+	assertdb.Query(t, rt.DB, getMsgCount, orgs[1].ID, archive.StartDate, archive.endDate()).Returns(0)
+}
+
+func TestArchiveFromReadonlyDB(t *testing.T) {
+	ctx, rt := setupLocal(t)
+
+	// without a readonly database, records are read from the primary
+	assert.Equal(t, rt.DB, readerDB(ctx, rt))
+
+	// our test database isn't a replica so it never lags and can stand in for one
+	readonlyDB, err := sqlx.Open("postgres", rt.Config.DB)
+	require.NoError(t, err)
+	defer readonlyDB.Close()
+
+	rt.ReadonlyDB = readonlyDB
+
+	lag, err := replicaLag(ctx, rt.ReadonlyDB)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), lag)
+	assert.Equal(t, rt.ReadonlyDB, readerDB(ctx, rt))
+
+	// a replica lagging more than our limit is skipped in favor of the primary
+	defer func(query string) { replicaLagQuery = query }(replicaLagQuery)
+	replicaLagQuery = `SELECT 600`
+	rt.Config.ReadonlyMaxLag = 300
+
+	lag, err = replicaLag(ctx, rt.ReadonlyDB)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute*10, lag)
+	assert.Equal(t, rt.DB, readerDB(ctx, rt))
+
+	// unless there's no limit
+	rt.Config.ReadonlyMaxLag = 0
+	assert.Equal(t, rt.ReadonlyDB, readerDB(ctx, rt))
+
+	// as is one we can't check
+	rt.Config.ReadonlyMaxLag = 300
+	replicaLagQuery = `SELECT x`
+	assert.Equal(t, rt.DB, readerDB(ctx, rt))
+
+	replicaLagQuery = sqlSelectReplicaLag
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	require.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	_, dailiesFailed, monthliesCreated, monthliesFailed, _, err := ArchiveOrg(ctx, rt, now, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Len(t, dailiesFailed, 0)
+	assert.Len(t, monthliesFailed, 0)
+	assert.Equal(t, 4, monthliesCreated[0].RecordCount)
+}
+
+func TestEraseContactsFromArchives(t *testing.T) {
+	ctx, rt := setupLocal(t)
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	require.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	_, _, monthliesCreated, _, _, err := ArchiveOrg(ctx, rt, now, orgs[1], MessageType)
+	require.NoError(t, err)
+	_, _, _, _, _, err = ArchiveOrg(ctx, rt, now, orgs[1], RunType)
+	require.NoError(t, err)
+
+	august := monthliesCreated[0]
+	assert.Equal(t, 4, august.RecordCount)
+
+	// erasing a contact without any archived records doesn't rewrite anything
+	report, err := EraseContacts(ctx, rt, orgs[1].ID, []string{"9195c8b7-6138-4d84-ac56-5192cc3d8ceb"})
+	require.NoError(t, err)
+	assert.Greater(t, report.ArchivesChecked, 0)
+	assert.Equal(t, 0, report.ArchivesRewritten)
+	assert.Equal(t, 0, report.RecordsErased)
+
+	// all of this org's messages in August are from this contact
+	report, err = EraseContacts(ctx, rt, orgs[1].ID, []string{"3e814add-e614-41f7-8b5d-a07f670a698f"})
+	require.NoError(t, err)
+	assert.Greater(t, report.ArchivesRewritten, 0)
+	assert.Greater(t, report.RecordsErased, 0)
+
+	// so that archive no longer has any records or a file
+	assertdb.Query(t, rt.DB, `SELECT record_count, size, hash, location FROM archives_archive WHERE id = $1`, august.ID).Columns(map[string]any{
+		"record_count": int64(0), "size": int64(0), "hash": nil, "location": nil,
+	})
+	_, _, err = storageFor(rt).Info(ctx, string(august.Location))
+	assert.Error(t, err)
+
+	// and no archived records of that contact remain
+	report, err = EraseContacts(ctx, rt, orgs[1].ID, []string{"3e814add-e614-41f7-8b5d-a07f670a698f"})
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.RecordsErased)
+
+	// and our rewritten archives still match their files
+	verifyReport, err := VerifyArchives(ctx, rt, orgs[1].ID, true)
+	assert.NoError(t, err)
+	assert.Len(t, verifyReport.Issues, 0)
+}
+
+func TestEraseContactsFromUnpurgedArchives(t *testing.T) {
+	ctx, rt := setupLocal(t)
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	require.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	monthlies, err := GetMissingMonthlyArchives(ctx, rt.DB, now, orgs[1], MessageType)
+	require.NoError(t, err)
+
+	// an archive whose records haven't been purged from the database yet
+	august := monthlies[0]
+	require.NoError(t, CreateArchiveFile(ctx, rt.DB, august, t.TempDir()))
+	require.NoError(t, UploadArchive(ctx, rt, august))
+	require.NoError(t, WriteArchiveToDB(ctx, rt.DB, august))
+	assert.Equal(t, 4, august.RecordCount)
+
+	// is skipped rather than rewritten with fewer records than will be purged
+	report, err := EraseContacts(ctx, rt, orgs[1].ID, []string{"3e814add-e614-41f7-8b5d-a07f670a698f"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.ArchivesSkipped)
+	assert.Equal(t, 0, report.ArchivesRewritten)
+	assert.Equal(t, 0, report.RecordsErased)
+	assertdb.Query(t, rt.DB, `SELECT record_count FROM archives_archive WHERE id = $1`, august.ID).Returns(4)
+
+	// so it can still be purged
+	_, err = PurgeArchivedRecords(ctx, rt, now, orgs[1], MessageType)
+	require.NoError(t, err)
+	assertdb.Query(t, rt.DB, `SELECT needs_deletion FROM archives_archive WHERE id = $1`, august.ID).Returns(false)
+
+	// after which the contact can be erased from it
+	report, err = EraseContacts(ctx, rt, orgs[1].ID, []string{"3e814add-e614-41f7-8b5d-a07f670a698f"})
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.ArchivesSkipped)
+	assert.Equal(t, 4, report.RecordsErased)
+	assertdb.Query(t, rt.DB, `SELECT record_count FROM archives_archive WHERE id = $1`, august.ID).Returns(0)
+}
+
+func TestEraseContactsSkipsLogArchives(t *testing.T) {
+	ctx, rt := setupLocal(t)
+
+	rt.Config.ArchiveFormat = "csv"
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	require.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	for _, archiveType := range []ArchiveType{MessageType, ChannelLogType, HTTPLogType} {
+		_, _, _, _, _, err = ArchiveOrg(ctx, rt, now, orgs[1], archiveType)
+		require.NoError(t, err)
+	}
+
+	// reads all the archived records of a type
+	readRecords := func(archiveType ArchiveType) string {
+		archives, err := GetArchivesToRestore(ctx, rt.DB, orgs[1], archiveType, time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), now)
+		require.NoError(t, err)
+		require.Greater(t, len(archives), 0)
+
+		records := &strings.Builder{}
+		for _, archive := range archives {
+			_, _, err := readArchiveRecords(ctx, rt, archive, func(batch [][]byte) (int, int, error) {
+				for _, record := range batch {
+					records.Write(record)
+				}
+				return len(batch), 0, nil
+			})
+			require.NoError(t, err)
+		}
+		return records.String()
+	}
+
+	assert.Contains(t, readRecords(ChannelLogType), "foo.bar/send")
+	assert.Contains(t, readRecords(HTTPLogType), `"request":"GET /hook HTTP/1.1"`)
+
+	var logArchives int
+	rt.DB.Get(&logArchives, `SELECT count(*) FROM archives_archive WHERE org_id = $1 AND archive_type IN ('channel_log', 'http_log') AND record_count > 0`, orgs[1].ID)
+	require.Greater(t, logArchives, 0)
+
+	// log archives don't have contacts to match so are skipped rather than having unrelated records redacted
+	report, err := EraseContacts(ctx, rt, orgs[1].ID, []string{"3e814add-e614-41f7-8b5d-a07f670a698f"})
+	require.NoError(t, err)
+	assert.Greater(t, report.RecordsErased, 0)
+	assert.Equal(t, 0, report.RecordsRedacted)
+	assert.Equal(t, logArchives, report.ArchivesSkipped)
+
+	assert.Contains(t, readRecords(ChannelLogType), "foo.bar/send")
+	assert.Contains(t, readRecords(HTTPLogType), `"request":"GET /hook HTTP/1.1"`)
+
+	verifyReport, err := VerifyArchives(ctx, rt, orgs[1].ID, true)
+	assert.NoError(t, err)
+	assert.Len(t, verifyReport.Issues, 0)
+}
+
+func TestQueryArchivedRecords(t *testing.T) {
+	ctx, rt := setupLocal(t)
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	require.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	_, _, _, _, _, err = ArchiveOrg(ctx, rt, now, orgs[1], MessageType)
+	require.NoError(t, err)
+
+	query := func(q *RecordQuery) []string {
+		out := &strings.Builder{}
+		matched, err := QueryArchivedRecords(ctx, rt, orgs[1], q, out)
+		require.NoError(t, err)
+
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		if out.Len() == 0 {
+			lines = []string{}
+		}
+		assert.Len(t, lines, matched)
+		return lines
+	}
+
+	aug, oct := time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), time.Date(2017, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	// everything of this contact across the monthly and daily archives
+	assert.Len(t, query(&RecordQuery{ArchiveType: MessageType, From: aug, To: now, ContactUUID: "3e814add-e614-41f7-8b5d-a07f670a698f"}), 5)
+
+	// dates within an archive are filtered
+	assert.Len(t, query(&RecordQuery{ArchiveType: MessageType, From: time.Date(2017, 8, 13, 0, 0, 0, 0, time.UTC), To: oct}), 1)
+
+	// as are directions and text
+	assert.Len(t, query(&RecordQuery{ArchiveType: MessageType, From: aug, To: oct, Direction: "out"}), 2)
+
+	records := query(&RecordQuery{ArchiveType: MessageType, From: aug, To: now, Text: "MESSAGE 4"})
+	if assert.Len(t, records, 1) {
+		assert.Contains(t, records[0], `"text":"message 4"`)
+	}
+
+	// and no archives means no records
+	assert.Len(t, query(&RecordQuery{ArchiveType: SessionType, From: aug, To: now}), 0)
+
+	// CSV archives can be queried too
+	rt.Config.ArchiveFormat = "csv"
+
+	_, _, _, _, _, err = ArchiveOrg(ctx, rt, now, orgs[1], RunType)
+	require.NoError(t, err)
+
+	runs := query(&RecordQuery{ArchiveType: RunType, From: aug, To: now, ContactUUID: "3e814add-e614-41f7-8b5d-a07f670a698f"})
+	if assert.NotEmpty(t, runs) {
+		assert.Contains(t, runs[0], `"contact":{"name":"Ajodinabiff Dane","uuid":"3e814add-e614-41f7-8b5d-a07f670a698f"}`)
+	}
+}
+
+func TestArchiveIndexes(t *testing.T) {
+	ctx, rt := setupLocal(t)
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	require.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	_, _, monthliesCreated, _, _, err := ArchiveOrg(ctx, rt, now, orgs[1], MessageType)
+	require.NoError(t, err)
+	require.Greater(t, len(monthliesCreated), 0)
+
+	// August monthly has an index next to it
+	monthly := monthliesCreated[0]
+	assert.FileExists(t, filepath.Join(rt.Config.StorageDir, strings.TrimPrefix(indexLocation(string(monthly.Location)), "local:")))
+
+	index, err := GetArchiveIndex(ctx, rt, monthly)
+	require.NoError(t, err)
+	require.NotNil(t, index)
+	assert.Equal(t, monthly.RecordCount, index.RecordCount)
+	assert.True(t, index.MayContainContact("3e814add-e614-41f7-8b5d-a07f670a698f"))
+	assert.False(t, index.MayContainContact("9195c8b7-6138-4d84-ac56-5192cc3d8ceb"))
+	assert.False(t, index.MayContainDates(time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC), now))
+
+	// indexes aren't reported as orphaned or counted as archive files
+	report, err := VerifyArchives(ctx, rt, orgs[1].ID, false)
+	require.NoError(t, err)
+	assert.Len(t, report.Issues, 0)
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM archives_archive WHERE org_id = $1 AND location IS NOT NULL", orgs[1].ID).Returns(report.FilesChecked)
+
+	orphaned, _, err := CollectOrphanedFiles(ctx, rt, orgs[1].ID, 0, false)
+	require.NoError(t, err)
+	assert.Len(t, orphaned, 0)
+
+	// archives without an index are read without one
+	require.NoError(t, os.Remove(filepath.Join(rt.Config.StorageDir, strings.TrimPrefix(indexLocation(string(monthly.Location)), "local:"))))
+
+	index, err = GetArchiveIndex(ctx, rt, monthly)
+	assert.NoError(t, err)
+	assert.Nil(t, index)
+
+	// but other errors reading an index aren't ignored
+	elsewhere := *monthly
+	elsewhere.Location = null.String("temba-archives:2/" + filepath.Base(string(monthly.Location)))
+
+	_, err = GetArchiveIndex(ctx, rt, &elsewhere)
+	assert.ErrorContains(t, err, "error reading archive index: invalid local location")
+}
+
+func TestRestoreArchivedRecords(t *testing.T) {
+	ctx, rt := setup(t)
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+	aug1, sep1 := time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	_, _, _, _, _, err = ArchiveOrg(ctx, rt, now, orgs[1], MessageType)
+	assert.NoError(t, err)
+
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM msgs_msg WHERE org_id = $1 AND created_on >= $2 AND created_on < $3", orgs[1].ID, aug1, sep1).Returns(0)
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM msgs_msg_labels").Returns(0)
+
+	// restore the visible messages from the monthly archive for August
+	restored, skipped, err := RestoreArchivedRecords(ctx, rt, orgs[1], MessageType, aug1, sep1)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, restored)
+	assert.Equal(t, 0, skipped)
+
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM msgs_msg WHERE org_id = $1 AND created_on >= $2 AND created_on < $3", orgs[1].ID, aug1, sep1).Returns(4)
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM msgs_msg_labels").Returns(3)
+	assertdb.Query(t, rt.DB, "SELECT contact_urn_id FROM msgs_msg WHERE id = 1").Returns(7)
+	assertdb.Query(t, rt.DB, "SELECT attachments[2] FROM msgs_msg WHERE id = 3").Returns("image/png:https://foo.bar/image2.png")
+
+	// restoring again skips all the messages which now exist
+	restored, skipped, err = RestoreArchivedRecords(ctx, rt, orgs[1], MessageType, aug1, sep1)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, restored)
+	assert.Equal(t, 4, skipped)
+
+	_, _, _, _, _, err = ArchiveOrg(ctx, rt, now, orgs[1], RunType)
+	assert.NoError(t, err)
+
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM flows_flowrun WHERE org_id = $1 AND modified_on >= $2 AND modified_on < $3", orgs[1].ID, aug1, sep1).Returns(0)
+
+	// one of the runs belongs to a contact from another org so can't be restored
+	restored, skipped, err = RestoreArchivedRecords(ctx, rt, orgs[1], RunType, aug1, sep1)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, restored)
+	assert.Equal(t, 1, skipped)
+
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM flows_flowrun WHERE org_id = $1 AND modified_on >= $2 AND modified_on < $3", orgs[1].ID, aug1, sep1).Returns(3)
+	assertdb.Query(t, rt.DB, "SELECT array_length(path_nodes, 1) FROM flows_flowrun WHERE id = 8").Returns(3)
+	assertdb.Query(t, rt.DB, "SELECT results::jsonb->'agree'->>'category' FROM flows_flowrun WHERE id = 2").Returns("Strongly agree")
+	assertdb.Query(t, rt.DB, "SELECT status FROM flows_flowrun WHERE id = 2").Returns("C")
+
+	// sessions can't be restored
+	_, _, err = RestoreArchivedRecords(ctx, rt, orgs[1], SessionType, aug1, sep1)
+	assert.EqualError(t, err, "restoring not supported for archive type: session")
+}
+
+func TestVerifyArchives(t *testing.T) {
+	ctx, rt := setupLocal(t)
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	_, _, monthliesCreated, _, _, err := ArchiveOrg(ctx, rt, now, orgs[1], MessageType)
+	assert.NoError(t, err)
+
+	report, err := VerifyArchives(ctx, rt, orgs[1].ID, true)
+	assert.NoError(t, err)
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM archives_archive WHERE org_id = $1", orgs[1].ID).Returns(report.ArchivesChecked)
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM archives_archive WHERE org_id = $1 AND location IS NOT NULL", orgs[1].ID).Returns(report.FilesChecked)
+	assert.Len(t, report.Issues, 0)
+
+	filesChecked := report.FilesChecked
+
+	// truncate the archive file and add a file which isn't referenced by any archive
+	monthly := monthliesCreated[0]
+	monthlyPath := filepath.Join(rt.Config.StorageDir, strings.TrimPrefix(string(monthly.Location), "local:"))
+	require.NoError(t, os.Truncate(monthlyPath, 10))
+	require.NoError(t, os.WriteFile(filepath.Join(rt.Config.StorageDir, "2", "orphan.jsonl.gz"), []byte("hello"), 0600))
+
+	report, err = VerifyArchives(ctx, rt, orgs[1].ID, false)
+	assert.NoError(t, err)
+	assert.Equal(t, filesChecked+1, report.FilesChecked)
+	if assert.Len(t, report.Issues, 2) {
+		assert.Equal(t, VerifyTruncated, report.Issues[0].Problem)
+		assert.Equal(t, monthly.ID, report.Issues[0].ArchiveID)
+		assert.Equal(t, VerifyOrphaned, report.Issues[1].Problem)
+		assert.Equal(t, "local:2/orphan.jsonl.gz", report.Issues[1].Location)
+	}
+
+	// remove the archive file entirely
+	require.NoError(t, os.Remove(monthlyPath))
+
+	report, err = VerifyArchives(ctx, rt, 0, false)
+	assert.NoError(t, err)
+	if assert.Len(t, report.Issues, 2) {
+		assert.Equal(t, VerifyMissing, report.Issues[0].Problem)
+		assert.Equal(t, monthly.ID, report.Issues[0].ArchiveID)
+		assert.Equal(t, VerifyOrphaned, report.Issues[1].Problem)
+	}
+}
+
+func TestCollectOrphanedFiles(t *testing.T) {
+	ctx, rt := setupLocal(t)
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	_, _, _, _, _, err = ArchiveOrg(ctx, rt, now, orgs[1], MessageType)
+	assert.NoError(t, err)
+
+	// add an old file and a recent file which aren't referenced by any archive
+	oldPath := filepath.Join(rt.Config.StorageDir, "2", "message_D20170812_old.jsonl.gz")
+	newPath := filepath.Join(rt.Config.StorageDir, "2", "message_D20170813_new.jsonl.gz")
+	require.NoError(t, os.WriteFile(oldPath, []byte("old"), 0600))
+	require.NoError(t, os.WriteFile(newPath, []byte("new"), 0600))
+	require.NoError(t, os.Chtimes(oldPath, time.Now().Add(-time.Hour*72), time.Now().Add(-time.Hour*72)))
+
+	// by default orphaned files are only reported
+	orphaned, deleted, err := CollectOrphanedFiles(ctx, rt, 0, time.Hour*48, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+	if assert.Len(t, orphaned, 1) {
+		assert.Equal(t, "local:2/message_D20170812_old.jsonl.gz", orphaned[0].Location)
+	}
+	assert.FileExists(t, oldPath)
+
+	orphaned, deleted, err = CollectOrphanedFiles(ctx, rt, orgs[1].ID, time.Hour*48, true)
+	assert.NoError(t, err)
+	assert.Len(t, orphaned, 1)
+	assert.Equal(t, 1, deleted)
+	assert.NoFileExists(t, oldPath)
+	assert.FileExists(t, newPath)
+
+	// files referenced by archives are untouched
+	report, err := VerifyArchives(ctx, rt, orgs[1].ID, false)
+	assert.NoError(t, err)
+	if assert.Len(t, report.Issues, 1) {
+		assert.Equal(t, "local:2/message_D20170813_new.jsonl.gz", report.Issues[0].Location)
+	}
+}
+
+func TestRollupWithZstd(t *testing.T) {
+	ctx, rt := setupLocal(t)
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	// create gzipped dailies
+	dailiesCreated, _, _, _, err := CreateOrgArchives(ctx, rt, now, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, CodecGzip, dailiesCreated[2].codec())
+	assert.True(t, strings.HasSuffix(string(dailiesCreated[2].Location), ".jsonl.gz"))
+
+	// and then roll them up with zstd
+	rt.Config.ArchiveCodec = "zstd"
+
+	rollupsCreated, rollupsFailed, err := RollupOrgArchives(ctx, rt, now, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Len(t, rollupsFailed, 0)
+	assert.Equal(t, time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), rollupsCreated[0].StartDate)
+	assert.Equal(t, 4, rollupsCreated[0].RecordCount)
+	assert.True(t, strings.HasSuffix(string(rollupsCreated[0].Location), ".jsonl.zst"))
+
+	// a deep verify decodes files of both codecs
+	report, err := VerifyArchives(ctx, rt, orgs[1].ID, true)
+	assert.NoError(t, err)
+	assert.Len(t, report.Issues, 0)
+
+	// and we can restore from the zstd rollup
+	_, err = PurgeArchivedRecords(ctx, rt, now, orgs[1], MessageType)
+	assert.NoError(t, err)
+
+	restored, _, err := RestoreArchivedRecords(ctx, rt, orgs[1], MessageType, time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, restored)
+}
+
+func TestRollupMixedFormats(t *testing.T) {
+	ctx, rt := setupLocal(t)
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	require.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	// the first few days of August are archived as JSONL
+	missing, err := GetMissingDailyArchivesForDateRange(ctx, rt.DB, time.Date(2017, 8, 10, 0, 0, 0, 0, time.UTC), time.Date(2017, 8, 15, 0, 0, 0, 0, time.UTC), orgs[1], MessageType)
+	require.NoError(t, err)
+	_, failed := createArchives(ctx, rt, orgs[1], missing)
+	require.Len(t, failed, 0)
+
+	// and then the format is switched to CSV for the rest of the month
+	rt.Config.ArchiveFormat = "csv"
+
+	_, dailiesFailed, _, _, err := CreateOrgArchives(ctx, rt, now, orgs[1], MessageType)
+	require.NoError(t, err)
+	require.Len(t, dailiesFailed, 0)
+
+	// the rollup converts the JSONL dailies to CSV
+	rollupsCreated, rollupsFailed, err := RollupOrgArchives(ctx, rt, now, orgs[1], MessageType)
+	require.NoError(t, err)
+	assert.Len(t, rollupsFailed, 0)
+	assert.Equal(t, time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), rollupsCreated[0].StartDate)
+	assert.Equal(t, 4, rollupsCreated[0].RecordCount)
+	assert.True(t, strings.HasSuffix(string(rollupsCreated[0].Location), ".csv.gz"))
+
+	// and a deep verify counts all its records
+	report, err := VerifyArchives(ctx, rt, orgs[1].ID, true)
+	assert.NoError(t, err)
+	assert.Len(t, report.Issues, 0)
+}
+
+func TestStreamRollups(t *testing.T) {
+	ctx, rt := setupLocal(t)
+
+	rt.Config.StreamRollups = true
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	_, _, _, _, err = CreateOrgArchives(ctx, rt, now, orgs[1], MessageType)
+	assert.NoError(t, err)
+
+	rollupsCreated, rollupsFailed, err := RollupOrgArchives(ctx, rt, now, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assert.Len(t, rollupsFailed, 0)
+	assert.Len(t, rollupsCreated, 2)
+
+	// streamed rollups use their UUID in their key as their hash isn't known until they're written
+	aug := rollupsCreated[0]
+	assert.Equal(t, time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), aug.StartDate)
+	assert.Equal(t, 4, aug.RecordCount)
+	assert.Equal(t, fmt.Sprintf("local:2/message_M201708_%s.jsonl.gz", aug.UUID), string(aug.Location))
+	assert.Empty(t, aug.ArchiveFile)
+	assert.True(t, aug.NeedsDeletion)
+
+	// empty rollups aren't uploaded
+	sep := rollupsCreated[1]
+	assert.Equal(t, 0, sep.RecordCount)
+	assert.Empty(t, sep.Location)
+
+	// the size and hash calculated whilst streaming match the stored file
+	size, hash, err := storageFor(rt).Info(ctx, string(aug.Location))
+	assert.NoError(t, err)
+	assert.Equal(t, aug.Size, size)
+	assert.Equal(t, string(aug.Hash), hash)
+
+	report, err := VerifyArchives(ctx, rt, orgs[1].ID, true)
+	assert.NoError(t, err)
+	assert.Len(t, report.Issues, 0)
+
+	// and records can be purged using the rollup
+	_, err = PurgeArchivedRecords(ctx, rt, now, orgs[1], MessageType)
+	assert.NoError(t, err)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM archives_archive WHERE id = $1 AND deleted_on IS NOT NULL`, aug.ID).Returns(1)
+}
+
+func TestEncryptedArchives(t *testing.T) {
+	ctx, rt := setupLocal(t)
+
+	rt.Config.EncryptionKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+	aug1, sep1 := time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	_, _, _, _, _, err = ArchiveOrg(ctx, rt, now, orgs[1], MessageType)
+	assert.NoError(t, err)
+
+	// every archive is encrypted with the same org key
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM archives_archive WHERE encryption_algorithm IS NULL`).Returns(0)
+	assertdb.Query(t, rt.DB, `SELECT count(DISTINCT encryption_key) FROM archives_archive WHERE org_id = $1`, orgs[1].ID).Returns(1)
+
+	// stored files aren't readable without decrypting them
+	var location string
+	rt.DB.Get(&location, `SELECT location FROM archives_archive WHERE period = 'M' AND record_count > 0 LIMIT 1`)
+	reader, err := storageFor(rt).Get(ctx, location)
+	require.NoError(t, err)
+	_, err = CodecGzip.newReader(reader)
+	assert.Error(t, err)
+	reader.Close()
+
+	// but can be verified and restored
+	report, err := VerifyArchives(ctx, rt, orgs[1].ID, true)
+	assert.NoError(t, err)
+	assert.Len(t, report.Issues, 0)
+
+	restored, _, err := RestoreArchivedRecords(ctx, rt, orgs[1], MessageType, aug1, sep1)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, restored)
+
+	shredded, err := ShredOrgEncryptionKeys(ctx, rt, orgs[1].ID)
+	assert.NoError(t, err)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM archives_archive WHERE org_id = $1`, orgs[1].ID).Returns(shredded)
+
+	// once shredded, files can still be checked for existence but not read
+	report, err = VerifyArchives(ctx, rt, orgs[1].ID, true)
+	assert.NoError(t, err)
+	assert.Len(t, report.Issues, 0)
+
+	_, _, err = RestoreArchivedRecords(ctx, rt, orgs[1], MessageType, aug1, sep1)
+	assert.ErrorContains(t, err, "has been shredded")
+}
+
+func TestArchivesWithoutEncryptionKeys(t *testing.T) {
+	ctx, rt := setupLocal(t)
+
+	// a database which hasn't had the encryption keys migration run
+	rt.DB.MustExec(`ALTER TABLE archives_archive DROP COLUMN encryption_algorithm, DROP COLUMN encryption_key`)
+
+	var err error
+	rt.Schema, err = CheckSchema(ctx, rt.DB)
+	require.NoError(t, err)
+	assert.False(t, rt.Schema.EncryptionKeys)
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	require.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	_, dailiesFailed, monthliesCreated, monthliesFailed, _, err := ArchiveOrg(ctx, rt, now, orgs[1], MessageType)
+	require.NoError(t, err)
+	assert.Len(t, dailiesFailed, 0)
+	assert.Len(t, monthliesFailed, 0)
+	assert.Len(t, monthliesCreated, 2)
+
+	// archives can be read back without the columns and aren't encrypted
+	archives, err := GetCurrentArchives(ctx, rt.DB, orgs[1], MessageType)
+	require.NoError(t, err)
+	require.Len(t, archives, 12)
+	assert.False(t, archives[0].isEncrypted())
+
+	report, err := VerifyArchives(ctx, rt, orgs[1].ID, true)
+	assert.NoError(t, err)
+	assert.Len(t, report.Issues, 0)
+
+	// and there are no keys to shred
+	shredded, err := ShredOrgEncryptionKeys(ctx, rt, orgs[1].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, shredded)
+}
+
+func TestPlanActiveOrgs(t *testing.T) {
+	ctx, rt := setup(t)
+	rt.Config.ArchiveRuns = false
+
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	var archivesBefore, msgsBefore int
+	rt.DB.Get(&archivesBefore, `SELECT count(*) FROM archives_archive`)
+	rt.DB.Get(&msgsBefore, `SELECT count(*) FROM msgs_msg WHERE org_id = 2`)
+
+	plan, err := PlanActiveOrgs(ctx, rt, now)
+	assert.NoError(t, err)
+
+	// nothing has been created or deleted
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM archives_archive`).Returns(archivesBefore)
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE org_id = 2`).Returns(msgsBefore)
+
+	var org2 *OrgPlan
+	for _, o := range plan.Orgs {
+		if o.OrgID == 2 {
+			org2 = o
+		}
+	}
+	require.NotNil(t, org2)
+
+	plannedDailies, plannedRecords, plannedRows := 0, 0, 0
+	var plannedMonthlies []*PlannedArchive
+	for _, a := range org2.Archives {
+		if a.Period == DayPeriod {
+			plannedDailies++
+			plannedRecords += a.RecordCount
+		} else {
+			plannedMonthlies = append(plannedMonthlies, a)
+		}
+	}
+	for _, p := range org2.Purges {
+		plannedRows += p.RowCount
+	}
+
+	// now actually archive and check the plan was right
+	orgs, err := GetActiveOrgs(ctx, rt)
+	assert.NoError(t, err)
+	dailiesCreated, _, monthliesCreated, _, _, err := ArchiveOrg(ctx, rt, now, orgs[1], MessageType)
+	assert.NoError(t, err)
+
+	assert.Equal(t, len(dailiesCreated), plannedDailies)
+	assert.Equal(t, countRecords(dailiesCreated), plannedRecords)
+	require.Len(t, plannedMonthlies, len(monthliesCreated))
+	for i, m := range monthliesCreated {
+		assert.True(t, plannedMonthlies[i].Rollup)
+		assert.Equal(t, m.RecordCount, plannedMonthlies[i].RecordCount)
+	}
+	assertdb.Query(t, rt.DB, `SELECT count(*) FROM msgs_msg WHERE org_id = 2`).Returns(msgsBefore - plannedRows)
+
+	text := &strings.Builder{}
+	assert.NoError(t, plan.WriteText(text))
+	assert.Contains(t, text.String(), "org 2 (Org 2)\n")
+	assert.Contains(t, text.String(), "  create message M 2017-08: 4 records from dailies\n")
+}
+
+func TestArchiveActiveOrgs(t *testing.T) {
+	_, rt := setup(t)
+
+	metricLastSuccess.Set(0)
+
+	err := ArchiveActiveOrgs(rt)
+	assert.NoError(t, err)
+
+	// a run without failures is recorded as our last success
+	assert.Greater(t, testutil.ToFloat64(metricLastSuccess), float64(0))
+}
+
+func TestArchiveActiveOrgsSkipsClaimedOrgs(t *testing.T) {
+	ctx, rt := setup(t)
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	require.NoError(t, err)
+
+	// an org which is still being archived, e.g. by a command
+	claim, err := ClaimOrg(orgs[1], MessageType)
+	require.NoError(t, err)
+	defer claim.Release()
+
+	metricLastSuccess.Set(0)
+
+	err = ArchiveActiveOrgs(rt)
+	assert.NoError(t, err)
+
+	// is skipped rather than failed so the run still counts as a success
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM archives_archive WHERE org_id = $1 AND archive_type = 'message'", orgs[1].ID).Returns(0)
+	assert.Greater(t, testutil.ToFloat64(metricLastSuccess), float64(0))
+}
+
+func TestArchiveActiveOrgsConcurrently(t *testing.T) {
+	_, rt := setupLocal(t)
+
+	rt.Config.OrgWorkers = 3
+	rt.Config.TempDirLimit = 1
+
+	err := ArchiveActiveOrgs(rt)
+	assert.NoError(t, err)
+
+	// every active org was archived by the pool of workers
+	assertdb.Query(t, rt.DB, "SELECT count(DISTINCT org_id) FROM archives_archive WHERE archive_type = 'message'").Returns(3)
+
+	// and released it all once done
+	assert.Equal(t, int64(0), archiverTempSpace.used())
+}
+
+func TestDeleteRolledUpDailyArchives(t *testing.T) {
+	ctx, rt := setup(t)
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	assert.NoError(t, err)
+	now := time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC)
+
+	org := orgs[1]
+
+	// Step 1: Create daily archives (monthlies are created via RollupOrgArchives, not CreateOrgArchives unless it's a backfill)
+	dailiesCreated, _, _, _, err := CreateOrgArchives(ctx, rt, now, org, MessageType)
+	assert.NoError(t, err)
+	assert.Greater(t, len(dailiesCreated), 0, "should have created daily archives")
+
+	// Step 2: Roll up daily archives into monthlies
+	rollupsCreated, _, err := RollupOrgArchives(ctx, rt, now, org, MessageType)
+	assert.NoError(t, err)
+	assert.Greater(t, len(rollupsCreated), 0, "should have created rollup archives")
+
+	// Step 3: Delete archived records (this sets deleted_on on archives)
+	deleted, err := PurgeArchivedRecords(ctx, rt, now, org, MessageType)
+	assert.NoError(t, err)
+	assert.Greater(t, len(deleted), 0, "should have deleted some archived records")
+
+	// Count total archives before deletion
+	var countBefore int
+	err = rt.DB.Get(&countBefore, "SELECT count(*) FROM archives_archive WHERE org_id = $1 AND archive_type = $2", org.ID, MessageType)
+	assert.NoError(t, err)
+
+	// Count daily archives that have been rolled up and are ready for cleanup (needs_deletion = false means records have been deleted or archive was empty)
+	var countRolledUp int
+	err = rt.DB.Get(&countRolledUp, "SELECT count(*) FROM archives_archive WHERE org_id = $1 AND archive_type = $2 AND period = $3 AND rollup_id IS NOT NULL AND needs_deletion = FALSE", org.ID, MessageType, DayPeriod)
+	assert.NoError(t, err)
+	assert.Greater(t, countRolledUp, 0, "should have some daily archives that were rolled up and ready for cleanup")
+
+	// Now call the function explicitly to delete rolled up dailies
+	deletedCount, err := DeleteRolledUpDailyArchives(ctx, rt, org, MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, countRolledUp, deletedCount, "should delete all rolled up daily archives")
+
+	// After deletion, count should be reduced
+	var countAfter int
+	err = rt.DB.Get(&countAfter, "SELECT count(*) FROM archives_archive WHERE org_id = $1 AND archive_type = $2", org.ID, MessageType)
+	assert.NoError(t, err)
+	assert.Equal(t, countBefore-countRolledUp, countAfter, "archive count should be reduced by deleted count")
+
+	// No more rolled up daily archives ready for cleanup should exist
+	err = rt.DB.Get(&countRolledUp, "SELECT count(*) FROM archives_archive WHERE org_id = $1 AND archive_type = $2 AND period = $3 AND rollup_id IS NOT NULL AND needs_deletion = FALSE", org.ID, MessageType, DayPeriod)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, countRolledUp, "no rolled up daily archives should remain")
+
+	// Monthly archives should still exist
+	var countMonthly int
+	err = rt.DB.Get(&countMonthly, "SELECT count(*) FROM archives_archive WHERE org_id = $1 AND archive_type = $2 AND period = $3", org.ID, MessageType, MonthPeriod)
+	assert.NoError(t, err)
+	assert.Greater(t, countMonthly, 0, "monthly archives should still exist")
+}
+
+func TestYearlyRollups(t *testing.T) {
+	ctx, rt := setupLocal(t)
+
+	rt.Config.YearlyRollups = true
+	rt.Config.DeleteRolledUpMonthlies = true
+
+	orgs, err := GetActiveOrgs(ctx, rt)
+	require.NoError(t, err)
+	now := time.Date(2018, 6, 1, 12, 30, 0, 0, time.UTC)
+
+	// 2017 is the only full year before our retention period
+	yearlies, err := GetMissingYearlyArchives(ctx, rt.DB, now, orgs[1], MessageType)
+	require.NoError(t, err)
+	require.Len(t, yearlies, 1)
+	assert.Equal(t, time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), yearlies[0].StartDate)
+
+	// backfill builds monthlies for 2017-08 to 2018-02 and then the 2017 yearly from the first five
+	_, _, monthliesCreated, monthliesFailed, _, err := ArchiveOrg(ctx, rt, now, orgs[1], MessageType)
+	require.NoError(t, err)
+	assert.Len(t, monthliesFailed, 0)
+	require.Len(t, monthliesCreated, 8)
+
+	yearly := monthliesCreated[7]
+	assert.Equal(t, YearPeriod, yearly.Period)
+	assert.Len(t, yearly.Dailies, 5)
+	assert.Equal(t, countRecords(monthliesCreated[:5]), yearly.RecordCount)
+	assert.Greater(t, yearly.RecordCount, 0)
+	assert.Contains(t, string(yearly.Location), "/message_Y2017_")
+
+	// the monthlies of 2017 have been purged and deleted, but those of 2018 are still around
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM archives_archive WHERE org_id = 2 AND period = 'Y'").Returns(1)
+	assertdb.Query(t, rt.DB, "SELECT count(*) FROM archives_archive WHERE org_id = 2 AND period = 'M'").Returns(2)
+
+	// and nothing covered by the yearly is missing
+	missing, err := GetMissingMonthlyArchives(ctx, rt.DB, now, orgs[1], MessageType)
+	require.NoError(t, err)
+	assert.Len(t, missing, 0)
+
+	missing, err = GetMissingDailyArchives(ctx, rt.DB, now, orgs[1], MessageType)
+	require.NoError(t, err)
+	assert.Len(t, missing, 0)
+
+	missing, err = GetMissingHourlyArchives(ctx, rt.DB, now, orgs[1], MessageType)
+	require.NoError(t, err)
+	assert.Len(t, missing, 0)
+
+	yearlies, err = GetMissingYearlyArchives(ctx, rt.DB, now, orgs[1], MessageType)
+	require.NoError(t, err)
+	assert.Len(t, yearlies, 0)
 }
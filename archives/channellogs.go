@@ -0,0 +1,91 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nyaruka/rp-archiver/runtime"
+	"github.com/vinovest/sqlx"
+)
+
+const sqlLookupChannelLogs = `
+SELECT row_to_json(rec)
+FROM (
+	SELECT
+		cl.id,
+		cl.uuid,
+		row_to_json(channel_struct) AS channel,
+		cl.log_type,
+		cl.http_logs,
+		cl.errors,
+		cl.is_error,
+		cl.elapsed_ms,
+		cl.created_on
+
+	FROM channels_channellog cl
+	JOIN channels_channel ch ON ch.id = cl.channel_id
+	JOIN LATERAL (SELECT ch.uuid, ch.name) AS channel_struct ON True
+	WHERE ch.org_id = $1 AND cl.created_on >= $2 AND cl.created_on < $3
+	ORDER BY cl.created_on ASC, cl.id ASC
+) as rec;`
+
+// writeChannelLogRecords writes the channel logs created in the archive's date range to the passed in writer
+func writeChannelLogRecords(ctx context.Context, db *sqlx.DB, archive *Archive, writer RecordWriter) (int, error) {
+	rows, err := db.QueryxContext(ctx, sqlLookupChannelLogs, archive.Org.ID, archive.StartDate, archive.endDate())
+	if err != nil {
+		return 0, fmt.Errorf("error querying channel log records for org: %d: %w", archive.Org.ID, err)
+	}
+	defer rows.Close()
+
+	recordCount := 0
+
+	for rows.Next() {
+		var record string
+
+		if err := rows.Scan(&record); err != nil {
+			return 0, fmt.Errorf("error scanning channel log record for org: %d: %w", archive.Org.ID, err)
+		}
+
+		if err := writer.WriteRecord(record); err != nil {
+			return 0, fmt.Errorf("error writing channel log record for org: %d: %w", archive.Org.ID, err)
+		}
+		recordCount++
+	}
+
+	return recordCount, nil
+}
+
+// channel logs don't have an org of their own so are selected by the org of their channel
+const sqlSelectOrgChannelLogsToPurge = `
+  SELECT cl.id
+    FROM channels_channellog cl
+    JOIN channels_channel ch ON ch.id = cl.channel_id
+   WHERE ch.org_id = $1 AND cl.created_on >= $2 AND cl.created_on < $3 AND cl.id > $4
+ORDER BY cl.id ASC
+   LIMIT $5`
+
+const sqlDeleteChannelLogs = `
+DELETE FROM channels_channellog WHERE id IN(?)`
+
+var channelLogSpec = &ArchiveTypeSpec{
+	Type:         ChannelLogType,
+	RecordName:   "channel logs",
+	MetricName:   "channel_logs",
+	Enabled:      func(cfg *runtime.Config) bool { return cfg.ArchiveChannelLogs },
+	WriteRecords: writeChannelLogRecords,
+	CountSQL:     `SELECT count(*) FROM channels_channellog cl JOIN channels_channel ch ON ch.id = cl.channel_id WHERE ch.org_id = $1 AND cl.created_on >= $2 AND cl.created_on < $3`,
+	PurgeIDsSQL:  sqlSelectOrgChannelLogsToPurge,
+	PurgeSQL:     []string{sqlDeleteChannelLogs},
+	DateField:    "created_on",
+	CSVColumns: []string{
+		"id", "uuid", "channel.uuid", "channel.name", "log_type", "http_logs", "errors", "is_error", "elapsed_ms", "created_on",
+	},
+
+	// channel logs have no contact but the requests and responses they log can include URNs and message text
+	Erase: EraseUnlinked,
+}
+
+// DeleteArchivedChannelLogs deletes the channel logs of the given archive from the database, see deleteArchivedRecords
+func DeleteArchivedChannelLogs(ctx context.Context, rt *runtime.Runtime, archive *Archive) error {
+	return deleteArchivedRecords(ctx, rt, archive, channelLogSpec)
+}
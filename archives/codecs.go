@@ -0,0 +1,81 @@
+package archives
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ArchiveCodec is the compression used for an archive file
+type ArchiveCodec string
+
+const (
+	CodecGzip = ArchiveCodec("gzip")
+	CodecZstd = ArchiveCodec("zstd")
+)
+
+var codecExtensions = map[ArchiveCodec]string{
+	CodecGzip: "gz",
+	CodecZstd: "zst",
+}
+
+// IsValid returns whether this is a codec we can compress archives with
+func (c ArchiveCodec) IsValid() bool {
+	_, ok := codecExtensions[c]
+	return ok
+}
+
+// returns the file extension for this codec
+func (c ArchiveCodec) extension() string {
+	return codecExtensions[c]
+}
+
+// returns the content encoding of files compressed with this codec
+func (c ArchiveCodec) contentEncoding() string {
+	return string(c)
+}
+
+// returns a writer which compresses to the given writer
+func (c ArchiveCodec) newWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case CodecGzip:
+		return gzip.NewWriter(w), nil
+	case CodecZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unknown archive codec: %s", c)
+}
+
+// returns a reader which decompresses from the given reader
+func (c ArchiveCodec) newReader(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case CodecGzip:
+		return gzip.NewReader(r)
+	case CodecZstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unknown archive codec: %s", c)
+}
+
+// returns the codec of an archive file from its location, e.g. temba-archives:1/run_D20170101_xxx.jsonl.zst, archive
+// files from before we supported other codecs are all gzipped
+func codecFromLocation(location string) ArchiveCodec {
+	for codec, ext := range codecExtensions {
+		if strings.HasSuffix(location, "."+ext) {
+			return codec
+		}
+	}
+	return CodecGzip
+}
+
+// returns the location without the codec extension
+func trimCodecExtension(location string) string {
+	return strings.TrimSuffix(location, "."+codecFromLocation(location).extension())
+}
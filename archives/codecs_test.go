@@ -0,0 +1,42 @@
+package archives
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodecs(t *testing.T) {
+	for _, codec := range []ArchiveCodec{CodecGzip, CodecZstd} {
+		buf := &bytes.Buffer{}
+		writer, err := codec.newWriter(buf)
+		require.NoError(t, err)
+
+		_, err = writer.Write([]byte("{\"id\": 1}\n{\"id\": 2}\n"))
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Close())
+
+		reader, err := codec.newReader(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err, "error creating reader for %s", codec)
+
+		decoded, err := io.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.NoError(t, reader.Close())
+		assert.Equal(t, "{\"id\": 1}\n{\"id\": 2}\n", string(decoded), "decoded mismatch for %s", codec)
+	}
+
+	_, err := ArchiveCodec("brotli").newWriter(&bytes.Buffer{})
+	assert.EqualError(t, err, "unknown archive codec: brotli")
+}
+
+func TestCodecFromLocation(t *testing.T) {
+	assert.Equal(t, CodecGzip, codecFromLocation("temba-archives:1/run_D20170101_6f1a8d.jsonl.gz"))
+	assert.Equal(t, CodecZstd, codecFromLocation("temba-archives:1/run_D20170101_6f1a8d.jsonl.zst"))
+	assert.Equal(t, CodecGzip, codecFromLocation(""))
+
+	assert.Equal(t, FormatCSV, formatFromLocation("temba-archives:1/run_D20170101_6f1a8d.csv.zst"))
+	assert.Equal(t, FormatJSONL, formatFromLocation("temba-archives:1/run_D20170101_6f1a8d.jsonl.zst"))
+}
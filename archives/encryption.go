@@ -0,0 +1,369 @@
+package archives
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/nyaruka/null/v3"
+	"github.com/nyaruka/rp-archiver/runtime"
+)
+
+// EncryptionChunkedAESGCM encrypts archive files as a series of AES-256-GCM sealed chunks, which means they can be
+// written and read as streams. The file starts with a random nonce prefix, and each chunk's nonce is that prefix
+// followed by the chunk's index and a flag which is set for the final chunk, so reordered or truncated files are
+// detected.
+const EncryptionChunkedAESGCM = "aes256gcm-chunked"
+
+const (
+	encryptionKeySize    = 32
+	encryptionChunkSize  = 64 * 1024
+	encryptionPrefixSize = 7
+)
+
+// ParseEncryptionKey parses a base64 encoded master key used to wrap per-org data keys
+func ParseEncryptionKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding encryption key: %w", err)
+	}
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", encryptionKeySize, len(key))
+	}
+	return key, nil
+}
+
+// returns whether the archive's file is encrypted
+func (a *Archive) isEncrypted() bool {
+	return a.EncryptionAlgorithm != ""
+}
+
+// returns whether the archive's file is encrypted but the key needed to decrypt it has been destroyed
+func (a *Archive) isShredded() bool {
+	return a.isEncrypted() && a.EncryptionKey == ""
+}
+
+const sqlSelectOrgEncryptionKey = `
+  SELECT encryption_key
+    FROM archives_archive
+   WHERE org_id = $1 AND encryption_algorithm = $2 AND encryption_key IS NOT NULL
+ORDER BY id DESC
+   LIMIT 1`
+
+// sets up encryption of the archive's file if it's enabled, using the org's existing data key if it has one
+func prepareEncryption(ctx context.Context, rt *runtime.Runtime, archive *Archive) error {
+	if rt.Config.EncryptionKey == "" {
+		return nil
+	}
+
+	masterKey, err := ParseEncryptionKey(rt.Config.EncryptionKey)
+	if err != nil {
+		return err
+	}
+
+	var wrapped string
+	err = rt.DB.GetContext(ctx, &wrapped, sqlSelectOrgEncryptionKey, archive.OrgID, EncryptionChunkedAESGCM)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("error looking up encryption key for org: %d: %w", archive.OrgID, err)
+	}
+
+	var dataKey []byte
+	if wrapped != "" {
+		if dataKey, err = unwrapKey(masterKey, wrapped); err != nil {
+			return fmt.Errorf("error unwrapping encryption key for org: %d: %w", archive.OrgID, err)
+		}
+	} else {
+		dataKey = make([]byte, encryptionKeySize)
+		if _, err := rand.Read(dataKey); err != nil {
+			return err
+		}
+		if wrapped, err = wrapKey(masterKey, dataKey); err != nil {
+			return err
+		}
+
+		slog.Info("created new encryption key for org", "org_id", archive.OrgID)
+	}
+
+	archive.EncryptionAlgorithm = null.String(EncryptionChunkedAESGCM)
+	archive.EncryptionKey = null.String(wrapped)
+	archive.dataKey = dataKey
+	return nil
+}
+
+// returns the data key needed to decrypt the archive's file
+func archiveDataKey(rt *runtime.Runtime, archive *Archive) ([]byte, error) {
+	if archive.dataKey != nil {
+		return archive.dataKey, nil
+	}
+	if archive.isShredded() {
+		return nil, fmt.Errorf("encryption key for archive %s has been shredded", archive.UUID)
+	}
+	if archive.EncryptionAlgorithm != EncryptionChunkedAESGCM {
+		return nil, fmt.Errorf("unknown encryption algorithm: %s", archive.EncryptionAlgorithm)
+	}
+	if rt.Config.EncryptionKey == "" {
+		return nil, fmt.Errorf("archive %s is encrypted but no encryption key is configured", archive.UUID)
+	}
+
+	masterKey, err := ParseEncryptionKey(rt.Config.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return unwrapKey(masterKey, string(archive.EncryptionKey))
+}
+
+// returns a writer which encrypts to the given writer if the archive has a data key, which must be closed after
+// everything has been written
+func encryptWriter(archive *Archive, w io.Writer) (io.WriteCloser, error) {
+	if archive.dataKey == nil {
+		return nopWriteCloser{w}, nil
+	}
+	return newEncryptingWriter(w, archive.dataKey)
+}
+
+// returns a reader which decrypts from the given reader if the archive is encrypted
+func decryptReader(rt *runtime.Runtime, archive *Archive, r io.Reader) (io.Reader, error) {
+	if !archive.isEncrypted() {
+		return r, nil
+	}
+
+	dataKey, err := archiveDataKey(rt, archive)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDecryptingReader(r, dataKey)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+const sqlShredOrgEncryptionKeys = `
+UPDATE archives_archive
+   SET encryption_key = NULL
+ WHERE org_id = $1 AND encryption_key IS NOT NULL`
+
+// ShredOrgEncryptionKeys destroys the encryption keys of all the org's archives, which makes their files permanently
+// unreadable. It returns the number of archives which were shredded.
+func ShredOrgEncryptionKeys(ctx context.Context, rt *runtime.Runtime, orgID int) (int, error) {
+	// without the columns to store keys, no archives can have been encrypted
+	if !rt.Schema.EncryptionKeys {
+		return 0, nil
+	}
+
+	result, err := rt.DB.ExecContext(ctx, sqlShredOrgEncryptionKeys, orgID)
+	if err != nil {
+		return 0, fmt.Errorf("error shredding encryption keys for org: %d: %w", orgID, err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	slog.Info("shredded encryption keys for org", "org_id", orgID, "archives", count)
+
+	return int(count), nil
+}
+
+// wraps a data key with the master key, returning the base64 encoded nonce and ciphertext
+func wrapKey(masterKey, dataKey []byte) (string, error) {
+	gcm, err := newGCM(masterKey)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, dataKey, nil)), nil
+}
+
+// unwraps a data key which was wrapped with the master key
+func unwrapKey(masterKey []byte, wrapped string) ([]byte, error) {
+	gcm, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding wrapped key: %w", err)
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// returns the nonce for the given chunk of a file
+func chunkNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, encryptionPrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionPrefixSize:], index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+type encryptingWriter struct {
+	w      io.Writer
+	gcm    cipher.AEAD
+	prefix []byte
+	index  uint32
+	buf    []byte
+}
+
+// returns a writer which encrypts to the given writer with the given data key, and which must be closed to write
+// the final chunk
+func newEncryptingWriter(w io.Writer, dataKey []byte) (io.WriteCloser, error) {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, encryptionPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+
+	return &encryptingWriter{w: w, gcm: gcm, prefix: prefix, buf: make([]byte, 0, encryptionChunkSize)}, nil
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		// we only seal a full chunk once we know it isn't the last one
+		if len(e.buf) == encryptionChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := min(encryptionChunkSize-len(e.buf), len(p))
+		e.buf = append(e.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (e *encryptingWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptingWriter) seal(last bool) error {
+	sealed := e.gcm.Seal(nil, chunkNonce(e.prefix, e.index, last), e.buf, nil)
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+
+	e.index++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+type decryptingReader struct {
+	r      io.Reader
+	gcm    cipher.AEAD
+	prefix []byte
+	index  uint32
+	sealed []byte
+	plain  []byte
+	done   bool
+}
+
+// returns a reader which decrypts from the given reader with the given data key
+func newDecryptingReader(r io.Reader, dataKey []byte) (io.Reader, error) {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, encryptionPrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("error reading encryption header: %w", err)
+	}
+
+	// we read one byte more than a sealed chunk so we can tell if it's the last one
+	return &decryptingReader{r: r, gcm: gcm, prefix: prefix, sealed: make([]byte, 0, encryptionChunkSize+gcm.Overhead()+1)}, nil
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptingReader) open() error {
+	chunkSize := encryptionChunkSize + d.gcm.Overhead()
+
+	// top up our buffer which may contain the first byte of this chunk from the previous read
+	have := len(d.sealed)
+	d.sealed = d.sealed[:cap(d.sealed)]
+	n, err := io.ReadFull(d.r, d.sealed[have:])
+	d.sealed = d.sealed[:have+n]
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		d.done = true
+	} else if err != nil {
+		return err
+	}
+
+	chunk := d.sealed
+	if !d.done {
+		chunk = d.sealed[:chunkSize]
+	}
+
+	plain, err := d.gcm.Open(nil, chunkNonce(d.prefix, d.index, d.done), chunk, nil)
+	if err != nil {
+		return fmt.Errorf("error decrypting chunk %d: %w", d.index, err)
+	}
+
+	// keep the extra byte we read for the next chunk
+	if !d.done {
+		d.sealed = append(d.sealed[:0], d.sealed[chunkSize:]...)
+	}
+
+	d.index++
+	d.plain = plain
+	return nil
+}
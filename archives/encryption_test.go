@@ -0,0 +1,100 @@
+package archives
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryption(t *testing.T) {
+	dataKey := make([]byte, encryptionKeySize)
+	rand.Read(dataKey)
+
+	encrypt := func(plain []byte) []byte {
+		buf := &bytes.Buffer{}
+		writer, err := newEncryptingWriter(buf, dataKey)
+		require.NoError(t, err)
+
+		// write in odd sized pieces to exercise chunk boundaries
+		for len(plain) > 0 {
+			n := min(1000, len(plain))
+			_, err := writer.Write(plain[:n])
+			require.NoError(t, err)
+			plain = plain[n:]
+		}
+		require.NoError(t, writer.Close())
+		return buf.Bytes()
+	}
+
+	decrypt := func(sealed []byte) ([]byte, error) {
+		reader, err := newDecryptingReader(bytes.NewReader(sealed), dataKey)
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(reader)
+	}
+
+	for _, size := range []int{0, 10, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1, encryptionChunkSize*3 + 17} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		sealed := encrypt(plain)
+		decrypted, err := decrypt(sealed)
+		assert.NoError(t, err, "error decrypting %d bytes", size)
+		assert.Equal(t, plain, decrypted, "decrypted mismatch for %d bytes", size)
+
+		// removing the last byte breaks the final chunk
+		_, err = decrypt(sealed[:len(sealed)-1])
+		assert.Error(t, err, "expected error decrypting truncated %d bytes", size)
+	}
+
+	// dropping whole chunks from the end is detected because the new last chunk wasn't sealed as the last chunk
+	plain := make([]byte, encryptionChunkSize*2+100)
+	sealed := encrypt(plain)
+	_, err := decrypt(sealed[:encryptionPrefixSize+encryptionChunkSize+16])
+	assert.ErrorContains(t, err, "error decrypting chunk 0")
+
+	// as is tampering with the contents
+	sealed[encryptionPrefixSize+10] ^= 1
+	_, err = decrypt(sealed)
+	assert.ErrorContains(t, err, "error decrypting chunk 0")
+
+	// and decrypting with another key
+	otherKey := make([]byte, encryptionKeySize)
+	reader, err := newDecryptingReader(bytes.NewReader(encrypt([]byte("hello"))), otherKey)
+	require.NoError(t, err)
+	_, err = io.ReadAll(reader)
+	assert.Error(t, err)
+}
+
+func TestKeyWrapping(t *testing.T) {
+	masterKey := make([]byte, encryptionKeySize)
+	rand.Read(masterKey)
+	dataKey := make([]byte, encryptionKeySize)
+	rand.Read(dataKey)
+
+	wrapped, err := wrapKey(masterKey, dataKey)
+	require.NoError(t, err)
+
+	unwrapped, err := unwrapKey(masterKey, wrapped)
+	assert.NoError(t, err)
+	assert.Equal(t, dataKey, unwrapped)
+
+	_, err = unwrapKey(make([]byte, encryptionKeySize), wrapped)
+	assert.Error(t, err)
+
+	parsed, err := ParseEncryptionKey(base64.StdEncoding.EncodeToString(masterKey))
+	assert.NoError(t, err)
+	assert.Equal(t, masterKey, parsed)
+
+	_, err = ParseEncryptionKey("c2hvcnQ=")
+	assert.EqualError(t, err, "encryption key must be 32 bytes, got 5")
+
+	_, err = ParseEncryptionKey("not base64!")
+	assert.ErrorContains(t, err, "error decoding encryption key")
+}
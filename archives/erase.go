@@ -0,0 +1,245 @@
+package archives
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/null/v3"
+	"github.com/nyaruka/rp-archiver/runtime"
+)
+
+// EraseReport is the result of erasing contacts from an org's archives
+type EraseReport struct {
+	OrgID             int       `json:"org_id"`
+	StartedOn         time.Time `json:"started_on"`
+	CompletedOn       time.Time `json:"completed_on"`
+	ArchivesChecked   int       `json:"archives_checked"`
+	ArchivesRewritten int       `json:"archives_rewritten"`
+	RecordsErased     int       `json:"records_erased"`
+	RecordsRedacted   int       `json:"records_redacted"`
+	ArchivesSkipped   int       `json:"archives_skipped"`
+}
+
+const sqlSelectOrgArchivesToErase = `
+  SELECT uuid, id, org_id, start_date::timestamp with time zone AS start_date, period, archive_type, hash, location, size, record_count, needs_deletion, rollup_id, ` + sqlSelectEncryption + `, ` + sqlSelectUTCOffset + `
+    FROM archives_archive
+   WHERE org_id = $1 AND location IS NOT NULL AND record_count > 0
+ORDER BY archive_type ASC, start_date ASC, period DESC`
+
+const sqlUpdateErasedArchive = `
+UPDATE archives_archive SET record_count = $2, size = $3, hash = $4, location = $5 WHERE id = $1`
+
+// EraseContacts rewrites every archive of the given org which contains records of the given contacts without those
+// records, or with their details redacted, according to the erase strategy of their type, replacing the archive's file
+// in storage. Archives whose keys have been shredded can't be read and so are left as they are. Archives of types whose
+// records can't be matched to contacts, and archives whose records haven't been purged yet, are skipped and counted in
+// the report, the latter so that erasing can be repeated once they have been.
+func EraseContacts(ctx context.Context, rt *runtime.Runtime, orgID int, contactUUIDs []string) (*EraseReport, error) {
+	report := &EraseReport{OrgID: orgID, StartedOn: dates.Now()}
+
+	contacts := make(map[string]bool, len(contactUUIDs))
+	for _, u := range contactUUIDs {
+		contacts[u] = true
+	}
+
+	var archives []*Archive
+	if err := rt.DB.SelectContext(ctx, &archives, sqlSelectOrgArchivesToErase, orgID); err != nil {
+		return nil, fmt.Errorf("error selecting archives to erase from: %w", err)
+	}
+
+	storage := storageFor(rt)
+
+	for _, archive := range archives {
+		log := slog.With("id", archive.ID, "org_id", archive.OrgID, "archive_type", archive.ArchiveType, "start_date", archive.StartDate, "period", archive.Period)
+
+		spec := GetArchiveTypeSpec(archive.ArchiveType)
+		if spec == nil {
+			return nil, fmt.Errorf("unknown archive type: %s", archive.ArchiveType)
+		}
+
+		if archive.isShredded() {
+			log.Debug("skipping archive with shredded key")
+			continue
+		}
+		if spec.Erase == EraseSkip {
+			log.Debug("skipping archive of type without contact details")
+			continue
+		}
+		if spec.Erase == EraseUnlinked {
+			log.Warn("skipping archive of type whose records can't be matched to contacts")
+			report.ArchivesSkipped++
+			continue
+		}
+
+		// rewriting an archive whose records are still in the database would leave it with fewer records than will be
+		// purged, which purging refuses to do, so these have to wait until it has been purged
+		if archive.NeedsDeletion {
+			log.Warn("skipping archive whose records haven't been purged")
+			report.ArchivesSkipped++
+			continue
+		}
+
+		erased, err := eraseFromArchive(ctx, rt, storage, archive, spec, contacts)
+		if err != nil {
+			return nil, fmt.Errorf("error erasing contacts from archive %s: %w", archive.UUID, err)
+		}
+
+		if erased > 0 {
+			report.ArchivesRewritten++
+
+			if spec.Erase == EraseRedact {
+				log.Info("redacted records in archive", "redacted", erased, "record_count", archive.RecordCount, "location", archive.Location)
+				report.RecordsRedacted += erased
+			} else {
+				log.Info("erased contact records from archive", "erased", erased, "record_count", archive.RecordCount, "location", archive.Location)
+				report.RecordsErased += erased
+			}
+		}
+		report.ArchivesChecked++
+	}
+
+	report.CompletedOn = dates.Now()
+
+	slog.Info("erased contacts from archives", "org_id", orgID, "contacts", len(contacts), "archives", report.ArchivesChecked, "rewritten", report.ArchivesRewritten, "erased", report.RecordsErased, "redacted", report.RecordsRedacted, "skipped", report.ArchivesSkipped, "elapsed", report.CompletedOn.Sub(report.StartedOn))
+
+	return report, nil
+}
+
+// rewrites a single archive without the records of the given contacts, or with their records redacted, returning the
+// number of records erased or redacted
+func eraseFromArchive(ctx context.Context, rt *runtime.Runtime, storage Storage, archive *Archive, spec *ArchiveTypeSpec, contacts map[string]bool) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Hour)
+	defer cancel()
+
+	// our new file keeps the format and codec of the existing file, and is encrypted with the same data key
+	archive.Org.ID = archive.OrgID
+	archive.Format = archive.format()
+	archive.Codec = archive.codec()
+
+	if archive.isEncrypted() {
+		dataKey, err := archiveDataKey(rt, archive)
+		if err != nil {
+			return 0, err
+		}
+		archive.dataKey = dataKey
+	}
+
+	// our rewritten file will be no bigger than the one we're rewriting
+	tempSpace, err := acquireTempSpace(ctx, rt, archive.Size)
+	if err != nil {
+		return 0, fmt.Errorf("error waiting for temp space: %w", err)
+	}
+	defer tempSpace.release()
+
+	filename := fmt.Sprintf("%s_%d_%s%s_erase_", archive.ArchiveType, archive.OrgID, archive.Period, archive.keyDate())
+	file, err := os.CreateTemp(rt.Config.TempDir, filename)
+	if err != nil {
+		return 0, fmt.Errorf("error creating temp file: %s: %w", filename, err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	reader, err := storage.Get(ctx, string(archive.Location))
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	decReader, err := decryptReader(rt, archive, reader)
+	if err != nil {
+		return 0, fmt.Errorf("error decrypting archive: %w", err)
+	}
+	compReader, err := archive.codec().newReader(decReader)
+	if err != nil {
+		return 0, fmt.Errorf("error creating %s reader: %w", archive.codec(), err)
+	}
+	defer compReader.Close()
+
+	hash := md5.New()
+	encWriter, err := encryptWriter(archive, io.MultiWriter(file, hash))
+	if err != nil {
+		return 0, err
+	}
+	compWriter, err := archive.codec().newWriter(encWriter)
+	if err != nil {
+		return 0, err
+	}
+
+	indexer := newArchiveIndexer(archive.format(), archive.ArchiveType)
+	defer indexer.abort()
+
+	var kept, erased int
+	if spec.Erase == EraseRedact {
+		kept, erased, err = archive.format().redactFields(io.MultiWriter(compWriter, indexer), compReader, contacts, spec.RedactFields)
+	} else {
+		kept, erased, err = archive.format().eraseContacts(io.MultiWriter(compWriter, indexer), compReader, contacts)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error rewriting archive records: %w", err)
+	}
+	if err := compWriter.Close(); err != nil {
+		return 0, fmt.Errorf("error closing archive %s writer: %w", archive.codec(), err)
+	}
+	if err := encWriter.Close(); err != nil {
+		return 0, fmt.Errorf("error closing archive encryption writer: %w", err)
+	}
+	index, err := indexer.finish()
+	if err != nil {
+		return 0, err
+	}
+
+	// nothing to erase means nothing to rewrite
+	if erased == 0 {
+		return 0, nil
+	}
+
+	oldLocation := string(archive.Location)
+	archive.RecordCount = kept
+
+	// like any other archive, one without records has no file
+	if kept > 0 {
+		stat, err := file.Stat()
+		if err != nil {
+			return 0, fmt.Errorf("error calculating archive size: %w", err)
+		}
+
+		archive.Hash = null.String(hex.EncodeToString(hash.Sum(nil)))
+		archive.Size = stat.Size()
+		archive.ArchiveFile = file.Name()
+		archive.index = index
+
+		key := archiveKey(archive)
+		err = storage.Put(ctx, key, archive)
+		archive.ArchiveFile = ""
+		if err != nil {
+			return 0, fmt.Errorf("error uploading rewritten archive to storage: %w", err)
+		}
+		if err := putArchiveIndex(ctx, storage, archive, key); err != nil {
+			return 0, err
+		}
+	} else {
+		archive.Hash = ""
+		archive.Size = 0
+		archive.Location = ""
+	}
+
+	if _, err := rt.DB.ExecContext(ctx, sqlUpdateErasedArchive, archive.ID, archive.RecordCount, archive.Size, archive.Hash, archive.Location); err != nil {
+		return 0, fmt.Errorf("error updating rewritten archive: %w", err)
+	}
+
+	// only once our archive points at its new file can we delete the old one and its index
+	if oldLocation != string(archive.Location) {
+		if _, err := storage.Delete(ctx, []string{oldLocation, indexLocation(oldLocation)}); err != nil {
+			return 0, fmt.Errorf("error deleting old archive file: %w", err)
+		}
+	}
+
+	return erased, nil
+}
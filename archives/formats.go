@@ -0,0 +1,536 @@
+package archives
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// ArchiveFormat is the format records are written in within an archive file
+type ArchiveFormat string
+
+const (
+	// FormatJSONL writes each record as a JSON object on its own line
+	FormatJSONL = ArchiveFormat("jsonl")
+
+	// FormatCSV writes each record as a row with a fixed set of columns for the archive type, after a header row
+	FormatCSV = ArchiveFormat("csv")
+)
+
+var formatContentTypes = map[ArchiveFormat]string{
+	FormatJSONL: "application/json",
+	FormatCSV:   "text/csv",
+}
+
+// IsValid returns whether this is a format we can write archives in
+func (f ArchiveFormat) IsValid() bool {
+	_, ok := formatContentTypes[f]
+	return ok
+}
+
+// returns the file extension for this format
+func (f ArchiveFormat) extension() string {
+	return string(f)
+}
+
+// returns the content type of files in this format
+func (f ArchiveFormat) contentType() string {
+	return formatContentTypes[f]
+}
+
+// returns the format of an archive file from its location, e.g. temba-archives:1/run_D20170101_xxx.csv.gz, archive
+// files from before we supported other formats are all JSONL
+func formatFromLocation(location string) ArchiveFormat {
+	name := trimCodecExtension(location)
+	if dot := strings.LastIndexByte(name, '.'); dot >= 0 {
+		if f := ArchiveFormat(name[dot+1:]); f.IsValid() {
+			return f
+		}
+	}
+	return FormatJSONL
+}
+
+// RecordWriter writes archive records, which are JSON objects, to an archive file in a particular format
+type RecordWriter interface {
+	WriteRecord(record string) error
+	Flush() error
+}
+
+// returns a record writer for the given format and archive type
+func newRecordWriter(format ArchiveFormat, archiveType ArchiveType, w io.Writer) (RecordWriter, error) {
+	switch format {
+	case FormatJSONL:
+		return &jsonlWriter{w: bufio.NewWriter(w)}, nil
+	case FormatCSV:
+		spec := GetArchiveTypeSpec(archiveType)
+		if spec == nil || len(spec.CSVColumns) == 0 {
+			return nil, fmt.Errorf("no CSV columns defined for archive type: %s", archiveType)
+		}
+		return &csvWriter{w: csv.NewWriter(w), columns: spec.CSVColumns}, nil
+	}
+	return nil, fmt.Errorf("unknown archive format: %s", format)
+}
+
+type jsonlWriter struct {
+	w *bufio.Writer
+}
+
+func (j *jsonlWriter) WriteRecord(record string) error {
+	j.w.WriteString(record)
+	return j.w.WriteByte('\n')
+}
+
+func (j *jsonlWriter) Flush() error {
+	return j.w.Flush()
+}
+
+type csvWriter struct {
+	w             *csv.Writer
+	columns       []string
+	headerWritten bool
+}
+
+func (c *csvWriter) WriteRecord(record string) error {
+	if !c.headerWritten {
+		if err := c.w.Write(c.columns); err != nil {
+			return err
+		}
+		c.headerWritten = true
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(record))
+	decoder.UseNumber()
+
+	var obj map[string]any
+	if err := decoder.Decode(&obj); err != nil {
+		return fmt.Errorf("error decoding record: %w", err)
+	}
+
+	row := make([]string, len(c.columns))
+	for i, col := range c.columns {
+		val, err := csvValue(lookupPath(obj, col))
+		if err != nil {
+			return fmt.Errorf("error encoding column %s: %w", col, err)
+		}
+		row[i] = val
+	}
+
+	return c.w.Write(row)
+}
+
+func (c *csvWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// looks up a dot separated path in a decoded JSON object
+func lookupPath(obj map[string]any, path string) any {
+	var val any = obj
+	for key := range strings.SplitSeq(path, ".") {
+		m, ok := val.(map[string]any)
+		if !ok {
+			return nil
+		}
+		val = m[key]
+	}
+	return val
+}
+
+// converts a decoded JSON value to a CSV value, with objects and arrays written as JSON
+func csvValue(v any) (string, error) {
+	switch typed := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return typed, nil
+	case json.Number:
+		return typed.String(), nil
+	case bool:
+		if typed {
+			return "true", nil
+		}
+		return "false", nil
+	}
+
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// reads the records of an archive file as JSON objects
+type recordReader interface {
+	// reads the next record as a line of JSON, returning io.EOF once there are no more, which may be with the last record
+	readRecord() ([]byte, error)
+}
+
+// returns a reader of the records of an uncompressed archive file of this format. CSV rows are read as objects of their
+// columns, nested by the dots in the column names, with values as strings and empty values as null, as CSV doesn't keep
+// the types of values.
+func (f ArchiveFormat) newRecordReader(r io.Reader) recordReader {
+	if f == FormatCSV {
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		return &csvRecordReader{r: reader}
+	}
+	return &jsonlRecordReader{r: bufio.NewReader(r)}
+}
+
+type jsonlRecordReader struct {
+	r *bufio.Reader
+}
+
+func (j *jsonlRecordReader) readRecord() ([]byte, error) {
+	return j.r.ReadBytes('\n')
+}
+
+type csvRecordReader struct {
+	r      *csv.Reader
+	header []string
+}
+
+func (c *csvRecordReader) readRecord() ([]byte, error) {
+	if c.header == nil {
+		header, err := c.r.Read()
+		if err != nil {
+			return nil, err
+		}
+		c.header = header
+	}
+
+	row, err := c.r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	obj := make(map[string]any, len(c.header))
+	for i, col := range c.header {
+		var val any
+		if i < len(row) && row[i] != "" {
+			val = row[i]
+		}
+		setPath(obj, col, val)
+	}
+
+	record, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	return append(record, '\n'), nil
+}
+
+// sets a dot separated path in a JSON object, creating nested objects as needed
+func setPath(obj map[string]any, path string, val any) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		nested, ok := obj[key].(map[string]any)
+		if !ok {
+			nested = make(map[string]any)
+			obj[key] = nested
+		}
+		obj = nested
+	}
+	obj[keys[len(keys)-1]] = val
+}
+
+// counts the records in an uncompressed archive file of this format
+func (f ArchiveFormat) countRecords(r io.Reader) (int, error) {
+	if f == FormatCSV {
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		count := 0
+
+		for {
+			_, err := reader.Read()
+			if err == io.EOF {
+				// don't count the header row
+				return max(count-1, 0), nil
+			} else if err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+
+	// JSONL records are one per line
+	buf := make([]byte, 64*1024)
+	count := 0
+
+	for {
+		n, err := r.Read(buf)
+		count += bytes.Count(buf[:n], []byte{'\n'})
+
+		if err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, err
+		}
+	}
+}
+
+// copies the records of an uncompressed archive file of this format to the given writer, which if skipHeader is set
+// is appending to a file which already has a header row
+func (f ArchiveFormat) copyRecords(w io.Writer, r io.Reader, skipHeader bool) error {
+	if f == FormatCSV && skipHeader {
+		// our header row is only column names so can't contain newlines
+		reader := bufio.NewReader(r)
+		if _, err := reader.ReadString('\n'); err != nil {
+			return err
+		}
+		r = reader
+	}
+
+	_, err := io.Copy(w, r)
+	return err
+}
+
+// copies the records of an uncompressed archive file of the given format to the given writer in this format, which if
+// skipHeader is set is appending to a file which already has a header row. Only JSONL records can be converted to
+// another format, as CSV records are flattened and don't have types.
+func (f ArchiveFormat) convertRecords(w io.Writer, r io.Reader, from ArchiveFormat, archiveType ArchiveType, skipHeader bool) error {
+	if from == f {
+		return f.copyRecords(w, r, skipHeader)
+	}
+	if from != FormatJSONL {
+		return fmt.Errorf("can't convert %s records to %s", from, f)
+	}
+
+	writer, err := newRecordWriter(f, archiveType, w)
+	if err != nil {
+		return err
+	}
+	if c, ok := writer.(*csvWriter); ok {
+		c.headerWritten = skipHeader
+	}
+
+	reader := bufio.NewReader(r)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if record := bytes.TrimSpace(line); len(record) > 0 {
+			if err := writer.WriteRecord(string(record)); err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF {
+			return writer.Flush()
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// copies the records of an uncompressed archive file of this format to the given writer, leaving out the records of
+// the given contacts, and returns the number of records kept and removed
+func (f ArchiveFormat) eraseContacts(w io.Writer, r io.Reader, contactUUIDs map[string]bool) (int, int, error) {
+	if f == FormatCSV {
+		return eraseCSVContacts(w, r, contactUUIDs)
+	}
+	return eraseJSONLContacts(w, r, contactUUIDs)
+}
+
+func eraseJSONLContacts(w io.Writer, r io.Reader, contactUUIDs map[string]bool) (int, int, error) {
+	reader := bufio.NewReader(r)
+	writer := bufio.NewWriter(w)
+	kept, removed := 0, 0
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var record struct {
+				Contact struct {
+					UUID string `json:"uuid"`
+				} `json:"contact"`
+			}
+			if err := json.Unmarshal(line, &record); err != nil {
+				return kept, removed, fmt.Errorf("error decoding record: %w", err)
+			}
+
+			if contactUUIDs[record.Contact.UUID] {
+				removed++
+			} else {
+				writer.Write(line)
+				kept++
+			}
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return kept, removed, err
+		}
+	}
+
+	return kept, removed, writer.Flush()
+}
+
+func eraseCSVContacts(w io.Writer, r io.Reader, contactUUIDs map[string]bool) (int, int, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	writer := csv.NewWriter(w)
+	kept, removed := 0, 0
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+
+	column := slices.Index(header, "contact.uuid")
+	if column < 0 {
+		return 0, 0, fmt.Errorf("no contact.uuid column in CSV header")
+	}
+	if err := writer.Write(header); err != nil {
+		return 0, 0, err
+	}
+
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return kept, removed, err
+		}
+
+		if column < len(row) && contactUUIDs[row[column]] {
+			removed++
+		} else {
+			if err := writer.Write(row); err != nil {
+				return kept, removed, err
+			}
+			kept++
+		}
+	}
+
+	writer.Flush()
+	return kept, removed, writer.Error()
+}
+
+// rewrites the records of an uncompressed archive file of this format with the given fields cleared in the records of
+// the given contacts, returning the number of records and how many of them had fields which were cleared
+func (f ArchiveFormat) redactFields(w io.Writer, r io.Reader, contactUUIDs map[string]bool, fields []string) (int, int, error) {
+	if f == FormatCSV {
+		return redactCSVFields(w, r, contactUUIDs, fields)
+	}
+	return redactJSONLFields(w, r, contactUUIDs, fields)
+}
+
+func redactJSONLFields(w io.Writer, r io.Reader, contactUUIDs map[string]bool, fields []string) (int, int, error) {
+	reader := bufio.NewReader(r)
+	writer := bufio.NewWriter(w)
+	total, redacted := 0, 0
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			// decode numbers as they are so that ids don't lose precision when we re-encode
+			decoder := json.NewDecoder(bytes.NewReader(line))
+			decoder.UseNumber()
+
+			var record map[string]any
+			if err := decoder.Decode(&record); err != nil {
+				return total, redacted, fmt.Errorf("error decoding record: %w", err)
+			}
+
+			// only the records of our contacts are redacted
+			changed := false
+			if contactUUID, _ := lookupPath(record, "contact.uuid").(string); contactUUIDs[contactUUID] {
+				for _, field := range fields {
+					if lookupPath(record, field) != nil {
+						setPath(record, field, nil)
+						changed = true
+					}
+				}
+			}
+
+			// unchanged records are written as they were
+			if changed {
+				encoded, err := json.Marshal(record)
+				if err != nil {
+					return total, redacted, fmt.Errorf("error encoding record: %w", err)
+				}
+				writer.Write(encoded)
+				writer.WriteByte('\n')
+				redacted++
+			} else {
+				writer.Write(line)
+			}
+			total++
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return total, redacted, err
+		}
+	}
+
+	return total, redacted, writer.Flush()
+}
+
+func redactCSVFields(w io.Writer, r io.Reader, contactUUIDs map[string]bool, fields []string) (int, int, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	writer := csv.NewWriter(w)
+	total, redacted := 0, 0
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+
+	contactColumn := slices.Index(header, "contact.uuid")
+	if contactColumn < 0 {
+		return 0, 0, fmt.Errorf("no contact.uuid column in CSV header")
+	}
+
+	var columns []int
+	for i, col := range header {
+		if slices.Contains(fields, col) {
+			columns = append(columns, i)
+		}
+	}
+	if err := writer.Write(header); err != nil {
+		return 0, 0, err
+	}
+
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return total, redacted, err
+		}
+
+		changed := false
+		if contactColumn < len(row) && contactUUIDs[row[contactColumn]] {
+			for _, column := range columns {
+				if column < len(row) && row[column] != "" {
+					row[column] = ""
+					changed = true
+				}
+			}
+		}
+		if changed {
+			redacted++
+		}
+
+		if err := writer.Write(row); err != nil {
+			return total, redacted, err
+		}
+		total++
+	}
+
+	writer.Flush()
+	return total, redacted, writer.Error()
+}
@@ -0,0 +1,199 @@
+package archives
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatFromLocation(t *testing.T) {
+	assert.Equal(t, FormatJSONL, formatFromLocation("temba-archives:1/run_D20170101_6f1a8d.jsonl.gz"))
+	assert.Equal(t, FormatCSV, formatFromLocation("temba-archives:1/run_D20170101_6f1a8d.csv.gz"))
+	assert.Equal(t, FormatCSV, formatFromLocation("local:1/run_D20170101_6f1a8d.csv.gz"))
+	assert.Equal(t, FormatJSONL, formatFromLocation(""))
+}
+
+func TestCSVRecordWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writer, err := newRecordWriter(FormatCSV, SessionType, buf)
+	require.NoError(t, err)
+
+	assert.NoError(t, writer.WriteRecord(`{"id": 1, "uuid": "a2cb5e6c", "contact": {"uuid": "7a6606c7", "name": "Bob"}, "session_type": "messaging", "status": "completed", "output": {"runs": [1, 2]}, "created_on": "2017-08-12T21:11:59+00:00", "ended_on": null}`))
+	assert.NoError(t, writer.WriteRecord(`{"id": 2, "uuid": "b3dc6f7d", "contact": {"uuid": "7a6606c7", "name": "Line 1\nLine 2"}, "session_type": "voice", "status": "failed", "output": null}`))
+	assert.NoError(t, writer.Flush())
+
+	assert.Equal(t, `id,uuid,contact.uuid,contact.name,session_type,status,output,created_on,ended_on
+1,a2cb5e6c,7a6606c7,Bob,messaging,completed,"{""runs"":[1,2]}",2017-08-12T21:11:59+00:00,
+2,b3dc6f7d,7a6606c7,"Line 1
+Line 2",voice,failed,,,
+`, buf.String())
+
+	// newlines in values don't affect our record count
+	count, err := FormatCSV.countRecords(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// when appending to an existing file the header row is skipped
+	out := &bytes.Buffer{}
+	assert.NoError(t, FormatCSV.copyRecords(out, bytes.NewReader(buf.Bytes()), false))
+	assert.NoError(t, FormatCSV.copyRecords(out, bytes.NewReader(buf.Bytes()), true))
+	assert.Equal(t, 1, strings.Count(out.String(), "id,uuid"))
+
+	count, err = FormatCSV.countRecords(out)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+
+	_, err = newRecordWriter(ArchiveFormat("parquet"), SessionType, buf)
+	assert.EqualError(t, err, "unknown archive format: parquet")
+}
+
+func TestJSONLRecordWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writer, err := newRecordWriter(FormatJSONL, RunType, buf)
+	require.NoError(t, err)
+
+	assert.NoError(t, writer.WriteRecord(`{"id": 1}`))
+	assert.NoError(t, writer.WriteRecord(`{"id": 2}`))
+	assert.NoError(t, writer.Flush())
+	assert.Equal(t, "{\"id\": 1}\n{\"id\": 2}\n", buf.String())
+
+	count, err := FormatJSONL.countRecords(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestConvertRecords(t *testing.T) {
+	jsonl := `{"id": 1, "uuid": "a2cb5e6c", "contact": {"uuid": "7a6606c7", "name": "Bob"}, "session_type": "messaging", "status": "completed", "output": null, "created_on": "2017-08-12T21:11:59+00:00", "ended_on": null}
+{"id": 2, "uuid": "b3dc6f7d", "contact": {"uuid": "7a6606c7", "name": "Bob"}, "session_type": "voice", "status": "failed", "output": null, "created_on": "2017-08-13T21:11:59+00:00", "ended_on": null}`
+
+	// JSONL records are converted to CSV, with a header if we're not appending
+	out := &bytes.Buffer{}
+	assert.NoError(t, FormatCSV.convertRecords(out, strings.NewReader(jsonl), FormatJSONL, SessionType, false))
+	assert.NoError(t, FormatCSV.convertRecords(out, strings.NewReader(jsonl), FormatJSONL, SessionType, true))
+	assert.Equal(t, `id,uuid,contact.uuid,contact.name,session_type,status,output,created_on,ended_on
+1,a2cb5e6c,7a6606c7,Bob,messaging,completed,,2017-08-12T21:11:59+00:00,
+2,b3dc6f7d,7a6606c7,Bob,voice,failed,,2017-08-13T21:11:59+00:00,
+1,a2cb5e6c,7a6606c7,Bob,messaging,completed,,2017-08-12T21:11:59+00:00,
+2,b3dc6f7d,7a6606c7,Bob,voice,failed,,2017-08-13T21:11:59+00:00,
+`, out.String())
+
+	// records in the same format are copied as they are
+	copied := &bytes.Buffer{}
+	assert.NoError(t, FormatCSV.convertRecords(copied, bytes.NewReader(out.Bytes()), FormatCSV, SessionType, false))
+	assert.Equal(t, out.String(), copied.String())
+
+	// but CSV records can't be converted to JSONL
+	err := FormatJSONL.convertRecords(&bytes.Buffer{}, bytes.NewReader(out.Bytes()), FormatCSV, SessionType, false)
+	assert.EqualError(t, err, "can't convert csv records to jsonl")
+}
+
+func TestRecordReaders(t *testing.T) {
+	readAll := func(r recordReader) []string {
+		records := []string{}
+		for {
+			record, err := r.readRecord()
+			if len(record) > 0 {
+				records = append(records, string(record))
+			}
+			if err == io.EOF {
+				return records
+			}
+			require.NoError(t, err)
+		}
+	}
+
+	// JSONL records are read as they are, including a last one without a newline
+	records := readAll(FormatJSONL.newRecordReader(strings.NewReader("{\"id\": 1}\n{\"id\": 2}")))
+	assert.Equal(t, []string{"{\"id\": 1}\n", "{\"id\": 2}"}, records)
+
+	// CSV rows are read as objects of their columns
+	records = readAll(FormatCSV.newRecordReader(strings.NewReader(`id,uuid,contact.uuid,contact.name,output,ended_on
+1,a2cb5e6c,7a6606c7,Bob,"{""runs"":[1,2]}",
+2,b3dc6f7d,7a6606c7,"Line 1
+Line 2",,
+`)))
+	assert.Equal(t, []string{
+		`{"contact":{"name":"Bob","uuid":"7a6606c7"},"ended_on":null,"id":"1","output":"{\"runs\":[1,2]}","uuid":"a2cb5e6c"}` + "\n",
+		`{"contact":{"name":"Line 1\nLine 2","uuid":"7a6606c7"},"ended_on":null,"id":"2","output":null,"uuid":"b3dc6f7d"}` + "\n",
+	}, records)
+
+	// and an empty CSV file has no records
+	assert.Equal(t, []string{}, readAll(FormatCSV.newRecordReader(strings.NewReader(""))))
+}
+
+func TestEraseContacts(t *testing.T) {
+	contacts := map[string]bool{"7a6606c7": true}
+
+	out := &bytes.Buffer{}
+	kept, removed, err := FormatJSONL.eraseContacts(out, strings.NewReader(`{"id": 1, "contact": {"uuid": "7a6606c7", "name": "Bob"}}
+{"id": 2, "contact": {"uuid": "29b45297", "name": "Ann"}}
+{"id": 3, "contact": {"uuid": "7a6606c7", "name": "Bob"}}
+`), contacts)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, kept)
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, `{"id": 2, "contact": {"uuid": "29b45297", "name": "Ann"}}
+`, out.String())
+
+	out.Reset()
+	kept, removed, err = FormatCSV.eraseContacts(out, strings.NewReader(`id,uuid,contact.uuid,contact.name
+1,a2cb5e6c,7a6606c7,Bob
+2,b3dc6f7d,29b45297,"Line 1
+Line 2"
+`), contacts)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, kept)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, `id,uuid,contact.uuid,contact.name
+2,b3dc6f7d,29b45297,"Line 1
+Line 2"
+`, out.String())
+
+	// CSV files without a contact column can't be erased from
+	_, _, err = FormatCSV.eraseContacts(out, strings.NewReader("id,uuid\n1,a2cb5e6c\n"), contacts)
+	assert.EqualError(t, err, "no contact.uuid column in CSV header")
+}
+
+func TestRedactFields(t *testing.T) {
+	contacts := map[string]bool{"a2cb5e6c": true}
+
+	// only the records of the given contacts are redacted
+	out := &bytes.Buffer{}
+	total, redacted, err := FormatJSONL.redactFields(out, strings.NewReader(`{"id": 12345678901234567, "contact": {"uuid": "a2cb5e6c"}, "request": "GET /", "response": "200 OK"}
+{"id": 2, "contact": {"uuid": "a2cb5e6c"}, "request": null, "response": null}
+{"id": 3, "contact": {"uuid": "3e814add"}, "request": "GET /", "response": "200 OK"}
+{"id": 4, "request": "GET /", "response": "200 OK"}
+`), contacts, []string{"request", "response"})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, total)
+	assert.Equal(t, 1, redacted)
+	assert.Equal(t, `{"contact":{"uuid":"a2cb5e6c"},"id":12345678901234567,"request":null,"response":null}
+{"id": 2, "contact": {"uuid": "a2cb5e6c"}, "request": null, "response": null}
+{"id": 3, "contact": {"uuid": "3e814add"}, "request": "GET /", "response": "200 OK"}
+{"id": 4, "request": "GET /", "response": "200 OK"}
+`, out.String())
+
+	out.Reset()
+	total, redacted, err = FormatCSV.redactFields(out, strings.NewReader(`id,contact.uuid,request,response
+1,a2cb5e6c,"GET /
+Host: foo.bar",200 OK
+2,a2cb5e6c,,
+3,3e814add,GET /,200 OK
+`), contacts, []string{"request", "response"})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, total)
+	assert.Equal(t, 1, redacted)
+	assert.Equal(t, `id,contact.uuid,request,response
+1,a2cb5e6c,,
+2,a2cb5e6c,,
+3,3e814add,GET /,200 OK
+`, out.String())
+
+	// CSV files without a contact column can't be redacted
+	_, _, err = FormatCSV.redactFields(out, strings.NewReader("id,request\n1,GET /\n"), contacts, []string{"request"})
+	assert.EqualError(t, err, "no contact.uuid column in CSV header")
+}
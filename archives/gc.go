@@ -0,0 +1,85 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/rp-archiver/runtime"
+)
+
+const sqlSelectAllOrgIDs = `
+  SELECT id
+    FROM orgs_org
+ORDER BY id`
+
+const sqlSelectOrgArchiveLocations = `
+SELECT location
+  FROM archives_archive
+ WHERE org_id = $1 AND location IS NOT NULL`
+
+// CollectOrphanedFiles finds the files in storage for the given org, or all orgs if orgID is zero, which aren't
+// referenced by any archive and were last modified before the grace period. These are usually left behind when
+// writing an archive to the database fails after its file was uploaded. If deleteFiles is set, the orphaned files are
+// deleted. It returns the orphaned files found and the number deleted.
+func CollectOrphanedFiles(ctx context.Context, rt *runtime.Runtime, orgID int, gracePeriod time.Duration, deleteFiles bool) ([]*StoredFile, int, error) {
+	orgIDs := []int{orgID}
+	if orgID == 0 {
+		orgIDs = nil
+		if err := rt.DB.SelectContext(ctx, &orgIDs, sqlSelectAllOrgIDs); err != nil {
+			return nil, 0, fmt.Errorf("error selecting org ids: %w", err)
+		}
+	}
+
+	// files modified after this could belong to archives which are still being written
+	cutoff := dates.Now().Add(-gracePeriod)
+
+	storage := storageFor(rt)
+	orphaned := make([]*StoredFile, 0)
+	totalDeleted := 0
+
+	for _, id := range orgIDs {
+		log := slog.With("org_id", id)
+
+		var locations []string
+		if err := rt.DB.SelectContext(ctx, &locations, sqlSelectOrgArchiveLocations, id); err != nil {
+			return orphaned, totalDeleted, fmt.Errorf("error selecting archive locations for org: %d: %w", id, err)
+		}
+
+		// an archive references both its file and that file's index
+		referenced := make(map[string]bool, len(locations)*2)
+		for _, l := range locations {
+			referenced[l] = true
+			referenced[indexLocation(l)] = true
+		}
+
+		files, err := storage.List(ctx, fmt.Sprintf("%d/", id))
+		if err != nil {
+			return orphaned, totalDeleted, err
+		}
+
+		orgOrphaned := make([]string, 0)
+		for _, f := range files {
+			if !referenced[f.Location] && f.LastModified.Before(cutoff) {
+				log.Info("found orphaned file", "location", f.Location, "size", f.Size, "last_modified", f.LastModified)
+
+				orphaned = append(orphaned, f)
+				orgOrphaned = append(orgOrphaned, f.Location)
+			}
+		}
+
+		if deleteFiles && len(orgOrphaned) > 0 {
+			deleted, err := storage.Delete(ctx, orgOrphaned)
+			totalDeleted += deleted
+			if err != nil {
+				return orphaned, totalDeleted, fmt.Errorf("error deleting orphaned files for org: %d: %w", id, err)
+			}
+
+			log.Info("deleted orphaned files", "count", deleted)
+		}
+	}
+
+	return orphaned, totalDeleted, nil
+}
@@ -0,0 +1,93 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nyaruka/rp-archiver/runtime"
+	"github.com/vinovest/sqlx"
+)
+
+const sqlLookupHTTPLogs = `
+SELECT row_to_json(rec)
+FROM (
+	SELECT
+		hl.id,
+		hl.log_type,
+		row_to_json(flow_struct) AS flow,
+		row_to_json(channel_struct) AS channel,
+		hl.url,
+		hl.status_code,
+		hl.request,
+		hl.response,
+		hl.request_time,
+		hl.num_retries,
+		hl.is_error,
+		hl.created_on
+
+	FROM request_logs_httplog hl
+	LEFT JOIN LATERAL (SELECT uuid, name FROM flows_flow f WHERE f.id = hl.flow_id) AS flow_struct ON True
+	LEFT JOIN LATERAL (SELECT uuid, name FROM channels_channel ch WHERE ch.id = hl.channel_id) AS channel_struct ON True
+	WHERE hl.org_id = $1 AND hl.created_on >= $2 AND hl.created_on < $3
+	ORDER BY hl.created_on ASC, hl.id ASC
+) as rec;`
+
+// writeHTTPLogRecords writes the HTTP logs created in the archive's date range to the passed in writer
+func writeHTTPLogRecords(ctx context.Context, db *sqlx.DB, archive *Archive, writer RecordWriter) (int, error) {
+	rows, err := db.QueryxContext(ctx, sqlLookupHTTPLogs, archive.Org.ID, archive.StartDate, archive.endDate())
+	if err != nil {
+		return 0, fmt.Errorf("error querying HTTP log records for org: %d: %w", archive.Org.ID, err)
+	}
+	defer rows.Close()
+
+	recordCount := 0
+
+	for rows.Next() {
+		var record string
+
+		if err := rows.Scan(&record); err != nil {
+			return 0, fmt.Errorf("error scanning HTTP log record for org: %d: %w", archive.Org.ID, err)
+		}
+
+		if err := writer.WriteRecord(record); err != nil {
+			return 0, fmt.Errorf("error writing HTTP log record for org: %d: %w", archive.Org.ID, err)
+		}
+		recordCount++
+	}
+
+	return recordCount, nil
+}
+
+const sqlSelectOrgHTTPLogsToPurge = `
+  SELECT id
+    FROM request_logs_httplog
+   WHERE org_id = $1 AND created_on >= $2 AND created_on < $3 AND id > $4
+ORDER BY id ASC
+   LIMIT $5`
+
+const sqlDeleteHTTPLogs = `
+DELETE FROM request_logs_httplog WHERE id IN(?)`
+
+var httpLogSpec = &ArchiveTypeSpec{
+	Type:         HTTPLogType,
+	RecordName:   "HTTP logs",
+	MetricName:   "http_logs",
+	Enabled:      func(cfg *runtime.Config) bool { return cfg.ArchiveHTTPLogs },
+	WriteRecords: writeHTTPLogRecords,
+	CountSQL:     `SELECT count(*) FROM request_logs_httplog WHERE org_id = $1 AND created_on >= $2 AND created_on < $3`,
+	PurgeIDsSQL:  sqlSelectOrgHTTPLogsToPurge,
+	PurgeSQL:     []string{sqlDeleteHTTPLogs},
+	DateField:    "created_on",
+	CSVColumns: []string{
+		"id", "log_type", "flow.uuid", "flow.name", "channel.uuid", "channel.name", "url", "status_code", "request", "response",
+		"request_time", "num_retries", "is_error", "created_on",
+	},
+
+	// webhook calls aren't linked to contacts but their bodies usually include contact fields and results
+	Erase: EraseUnlinked,
+}
+
+// DeleteArchivedHTTPLogs deletes the HTTP logs of the given archive from the database, see deleteArchivedRecords
+func DeleteArchivedHTTPLogs(ctx context.Context, rt *runtime.Runtime, archive *Archive) error {
+	return deleteArchivedRecords(ctx, rt, archive, httpLogSpec)
+}
@@ -0,0 +1,328 @@
+package archives
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/rp-archiver/runtime"
+)
+
+// the suffix added to the location of an archive file to get the location of its index
+const indexSuffix = ".index.json"
+
+// the bits per item and number of hashes of our bloom filters, which gives a false positive rate of about 1%
+const (
+	bloomBitsPerItem = 9.6
+	bloomHashes      = 7
+)
+
+// ArchiveIndex is a summary of the records in an archive file, stored next to it, which lets readers skip archives
+// which can't contain the records they're looking for
+type ArchiveIndex struct {
+	RecordCount int          `json:"record_count"`
+	MinDate     *time.Time   `json:"min_date"`
+	MaxDate     *time.Time   `json:"max_date"`
+	Contacts    *bloomFilter `json:"contacts"`
+	Flows       *bloomFilter `json:"flows"`
+}
+
+// MayContainContact returns whether the archive may contain records of the contact with the given UUID
+func (i *ArchiveIndex) MayContainContact(uuid string) bool {
+	return i.Contacts.mayContain(uuid)
+}
+
+// MayContainFlow returns whether the archive may contain records of the flow with the given UUID
+func (i *ArchiveIndex) MayContainFlow(uuid string) bool {
+	return i.Flows.mayContain(uuid)
+}
+
+// MayContainDates returns whether the archive may contain records in the given date range
+func (i *ArchiveIndex) MayContainDates(from, to time.Time) bool {
+	if i.MinDate == nil || i.MaxDate == nil {
+		return i.RecordCount > 0
+	}
+	return i.MaxDate.Compare(from) >= 0 && i.MinDate.Before(to)
+}
+
+// a bloom filter of strings, which can tell us an item definitely isn't in a set
+type bloomFilter struct {
+	Bits   []byte `json:"bits"`
+	Hashes int    `json:"hashes"`
+}
+
+// creates a new bloom filter containing the given items
+func newBloomFilter(items map[string]bool) *bloomFilter {
+	numBits := max(int(math.Ceil(float64(len(items))*bloomBitsPerItem)), 64)
+	f := &bloomFilter{Bits: make([]byte, (numBits+7)/8), Hashes: bloomHashes}
+
+	for item := range items {
+		for _, bit := range f.bits(item) {
+			f.Bits[bit/8] |= 1 << (bit % 8)
+		}
+	}
+	return f
+}
+
+func (f *bloomFilter) mayContain(item string) bool {
+	if f == nil || len(f.Bits) == 0 {
+		return true
+	}
+
+	for _, bit := range f.bits(item) {
+		if f.Bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// returns the bits for an item, using double hashing to derive our hashes from a single 64 bit hash
+func (f *bloomFilter) bits(item string) []uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(item))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32
+
+	numBits := uint64(len(f.Bits) * 8)
+	bits := make([]uint64, f.Hashes)
+	for i := range bits {
+		bits[i] = (h1 + uint64(i)*h2) % numBits
+	}
+	return bits
+}
+
+// builds an index from the uncompressed contents of an archive file as they're written to it
+type archiveIndexer struct {
+	writer *io.PipeWriter
+	done   chan error
+
+	index    *ArchiveIndex
+	contacts map[string]bool
+	flows    map[string]bool
+}
+
+func newArchiveIndexer(format ArchiveFormat, archiveType ArchiveType) *archiveIndexer {
+	reader, writer := io.Pipe()
+
+	i := &archiveIndexer{
+		writer:   writer,
+		done:     make(chan error, 1),
+		index:    &ArchiveIndex{},
+		contacts: make(map[string]bool),
+		flows:    make(map[string]bool),
+	}
+
+	go func() {
+		var err error
+		if format == FormatCSV {
+			err = i.readCSV(reader, archiveType)
+		} else {
+			err = i.readJSONL(reader, archiveType)
+		}
+
+		// if we failed, writes to the indexer will fail too
+		reader.CloseWithError(err)
+		i.done <- err
+	}()
+
+	return i
+}
+
+func (i *archiveIndexer) Write(p []byte) (int, error) {
+	return i.writer.Write(p)
+}
+
+// finishes indexing once everything has been written, returning the index
+func (i *archiveIndexer) finish() (*ArchiveIndex, error) {
+	i.writer.Close()
+	if err := <-i.done; err != nil {
+		return nil, fmt.Errorf("error indexing archive: %w", err)
+	}
+
+	i.index.Contacts = newBloomFilter(i.contacts)
+	i.index.Flows = newBloomFilter(i.flows)
+	return i.index, nil
+}
+
+// stops indexing if it hasn't finished, e.g. because writing the archive failed
+func (i *archiveIndexer) abort() {
+	i.writer.CloseWithError(errors.New("indexing aborted"))
+}
+
+func (i *archiveIndexer) add(contactUUID, flowUUID string, date time.Time) {
+	i.index.RecordCount++
+
+	if contactUUID != "" {
+		i.contacts[contactUUID] = true
+	}
+	if flowUUID != "" {
+		i.flows[flowUUID] = true
+	}
+	if !date.IsZero() {
+		date = date.UTC()
+
+		if i.index.MinDate == nil || date.Before(*i.index.MinDate) {
+			i.index.MinDate = &date
+		}
+		if i.index.MaxDate == nil || date.After(*i.index.MaxDate) {
+			i.index.MaxDate = &date
+		}
+	}
+}
+
+func (i *archiveIndexer) readJSONL(r io.Reader, archiveType ArchiveType) error {
+	reader := bufio.NewReader(r)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			record := &queriedRecord{}
+			if err := json.Unmarshal(line, record); err != nil {
+				return fmt.Errorf("error decoding record: %w", err)
+			}
+
+			contactUUID, flowUUID := "", ""
+			if record.Contact != nil {
+				contactUUID = record.Contact.UUID
+			}
+			if record.Flow != nil {
+				flowUUID = record.Flow.UUID
+			}
+
+			i.add(contactUUID, flowUUID, record.date(dateField(archiveType), line))
+		}
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (i *archiveIndexer) readCSV(r io.Reader, archiveType ArchiveType) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	contactCol, flowCol, dateCol := slices.Index(header, "contact.uuid"), slices.Index(header, "flow.uuid"), slices.Index(header, dateField(archiveType))
+	value := func(row []string, col int) string {
+		if col >= 0 && col < len(row) {
+			return row[col]
+		}
+		return ""
+	}
+
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var date time.Time
+		if d := value(row, dateCol); d != "" {
+			if date, err = time.Parse(time.RFC3339Nano, d); err != nil {
+				return fmt.Errorf("error parsing record date: %w", err)
+			}
+		}
+
+		i.add(value(row, contactCol), value(row, flowCol), date)
+	}
+}
+
+// writes the index of an archive next to its file, which has the given key, encrypting it like the archive
+func putArchiveIndex(ctx context.Context, storage Storage, archive *Archive, key string) error {
+	if archive.index == nil {
+		return nil
+	}
+
+	encoded, err := json.Marshal(archive.index)
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	encWriter, err := encryptWriter(archive, buf)
+	if err != nil {
+		return err
+	}
+	encWriter.Write(encoded)
+	if err := encWriter.Close(); err != nil {
+		return err
+	}
+
+	contentType := "application/json"
+	if archive.isEncrypted() {
+		contentType = "application/octet-stream"
+	}
+
+	if _, err := storage.PutFile(ctx, key+indexSuffix, contentType, buf.Bytes()); err != nil {
+		return fmt.Errorf("error writing archive index: %w", err)
+	}
+	return nil
+}
+
+// GetArchiveIndex reads the index of the given archive, returning nil if it doesn't have one, e.g. because it was
+// created before archives were indexed
+func GetArchiveIndex(ctx context.Context, rt *runtime.Runtime, archive *Archive) (*ArchiveIndex, error) {
+	if !archive.isUploaded() {
+		return nil, nil
+	}
+
+	reader, err := storageFor(rt).Get(ctx, indexLocation(string(archive.Location)))
+	if errors.Is(err, ErrFileNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading archive index: %w", err)
+	}
+	defer reader.Close()
+
+	decReader, err := decryptReader(rt, archive, reader)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting archive index: %w", err)
+	}
+
+	index := &ArchiveIndex{}
+	if err := json.NewDecoder(decReader).Decode(index); err != nil {
+		return nil, fmt.Errorf("error decoding archive index: %w", err)
+	}
+	return index, nil
+}
+
+// returns the location of the index of the archive file at the given location
+func indexLocation(location string) string {
+	return location + indexSuffix
+}
+
+// returns whether the given location is that of an archive index
+func isIndexLocation(location string) bool {
+	return strings.HasSuffix(location, indexSuffix)
+}
+
+// returns the locations of the indexes of the archive files at the given locations
+func indexLocations(locations []string) []string {
+	indexes := make([]string, len(locations))
+	for i, l := range locations {
+		indexes[i] = indexLocation(l)
+	}
+	return indexes
+}
@@ -0,0 +1,88 @@
+package archives
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBloomFilter(t *testing.T) {
+	items := make(map[string]bool, 1000)
+	for i := range 1000 {
+		items[fmt.Sprintf("contact-%d", i)] = true
+	}
+
+	f := newBloomFilter(items)
+	assert.Equal(t, bloomHashes, f.Hashes)
+
+	// no false negatives
+	for item := range items {
+		assert.True(t, f.mayContain(item))
+	}
+
+	// and few false positives
+	falsePositives := 0
+	for i := range 1000 {
+		if f.mayContain(fmt.Sprintf("other-%d", i)) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 50)
+
+	// an empty filter contains nothing, and a missing one might contain anything
+	assert.False(t, newBloomFilter(map[string]bool{}).mayContain("contact-1"))
+	assert.True(t, (*bloomFilter)(nil).mayContain("contact-1"))
+}
+
+func TestArchiveIndexer(t *testing.T) {
+	aug12, aug14 := time.Date(2017, 8, 12, 21, 11, 59, 890662000, time.UTC), time.Date(2017, 8, 14, 10, 0, 0, 0, time.UTC)
+
+	indexer := newArchiveIndexer(FormatJSONL, MessageType)
+	_, err := io.WriteString(indexer, `{"id": 1, "contact": {"uuid": "3e814add", "name": "Ajodinabiff"}, "flow": null, "created_on": "2017-08-12T21:11:59.890662+00:00"}`+"\n")
+	require.NoError(t, err)
+	_, err = io.WriteString(indexer, `{"id": 2, "contact": {"uuid": "b46f6e18", "name": null}, "flow": {"uuid": "9de3663f", "name": "Favorites"}, "created_on": "2017-08-14T10:00:00+00:00"}`)
+	require.NoError(t, err)
+
+	index, err := indexer.finish()
+	require.NoError(t, err)
+	assert.Equal(t, 2, index.RecordCount)
+	assert.Equal(t, aug12, *index.MinDate)
+	assert.Equal(t, aug14, *index.MaxDate)
+	assert.True(t, index.MayContainContact("3e814add"))
+	assert.True(t, index.MayContainContact("b46f6e18"))
+	assert.False(t, index.MayContainContact("9195c8b7"))
+	assert.True(t, index.MayContainFlow("9de3663f"))
+	assert.False(t, index.MayContainFlow("5af3d1f8"))
+
+	assert.True(t, index.MayContainDates(time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)))
+	assert.True(t, index.MayContainDates(aug14, time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)))
+	assert.False(t, index.MayContainDates(time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), aug12))
+	assert.False(t, index.MayContainDates(aug14.Add(time.Second), time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)))
+
+	// CSV archives are indexed by their columns
+	indexer = newArchiveIndexer(FormatCSV, RunType)
+	_, err = io.WriteString(indexer, "id,contact.uuid,flow.uuid,modified_on\n1,3e814add,9de3663f,2017-08-12T21:11:59.890662Z\n2,b46f6e18,,2017-08-14T10:00:00Z\n")
+	require.NoError(t, err)
+
+	index, err = indexer.finish()
+	require.NoError(t, err)
+	assert.Equal(t, 2, index.RecordCount)
+	assert.Equal(t, aug12, *index.MinDate)
+	assert.Equal(t, aug14, *index.MaxDate)
+	assert.True(t, index.MayContainContact("b46f6e18"))
+	assert.False(t, index.MayContainContact("9195c8b7"))
+	assert.True(t, index.MayContainFlow("9de3663f"))
+
+	// content we can't index fails writes and finishing
+	indexer = newArchiveIndexer(FormatJSONL, MessageType)
+	_, err = io.WriteString(indexer, strings.Repeat("not json\n", 10000))
+	assert.Error(t, err)
+
+	_, err = indexer.finish()
+	assert.ErrorContains(t, err, "error indexing archive")
+}
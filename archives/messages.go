@@ -1,7 +1,6 @@
 package archives
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"log/slog"
@@ -12,11 +11,6 @@ import (
 	"github.com/vinovest/sqlx"
 )
 
-const (
-	visibilityDeletedByUser   = "D"
-	visibilityDeletedBySender = "X"
-)
-
 const sqlLookupMsgs = `
 SELECT rec.visibility, row_to_json(rec) FROM (
 	SELECT
@@ -67,7 +61,7 @@ SELECT rec.visibility, row_to_json(rec) FROM (
 ORDER BY created_on ASC, id ASC) rec;`
 
 // writeMessageRecords writes the messages in the archive's date range to the passed in writer
-func writeMessageRecords(ctx context.Context, db *sqlx.DB, archive *Archive, writer *bufio.Writer) (int, error) {
+func writeMessageRecords(ctx context.Context, db *sqlx.DB, archive *Archive, writer RecordWriter) (int, error) {
 	var rows *sqlx.Rows
 	recordCount := 0
 
@@ -89,8 +83,9 @@ func writeMessageRecords(ctx context.Context, db *sqlx.DB, archive *Archive, wri
 		if visibility == "deleted" {
 			continue
 		}
-		writer.WriteString(record)
-		writer.WriteString("\n")
+		if err := writer.WriteRecord(record); err != nil {
+			return 0, fmt.Errorf("error writing message record for org: %d: %w", archive.Org.ID, err)
+		}
 		recordCount++
 	}
 
@@ -98,12 +93,12 @@ func writeMessageRecords(ctx context.Context, db *sqlx.DB, archive *Archive, wri
 	return recordCount, nil
 }
 
-const sqlSelectOrgMessagesInRange = `
-   SELECT mm.id, mm.visibility
-     FROM msgs_msg mm
-LEFT JOIN contacts_contact cc ON cc.id = mm.contact_id
-    WHERE mm.org_id = $1 AND mm.created_on >= $2 AND mm.created_on < $3
- ORDER BY mm.created_on ASC, mm.id ASC`
+const sqlSelectOrgMessagesToPurge = `
+  SELECT id
+    FROM msgs_msg
+   WHERE org_id = $1 AND created_on >= $2 AND created_on < $3 AND id > $4
+ORDER BY id ASC
+   LIMIT $5`
 
 const sqlDeleteMessageLabels = `
 DELETE FROM msgs_msg_labels WHERE msg_id IN(?)`
@@ -111,114 +106,28 @@ DELETE FROM msgs_msg_labels WHERE msg_id IN(?)`
 const sqlDeleteMessages = `
 DELETE FROM msgs_msg WHERE id IN(?)`
 
-// DeleteArchivedMessages takes the passed in archive, verifies the S3 file is still present (and correct), then selects
-// all the messages in the archive date range, and if equal or fewer than the number archived, deletes them 100 at a time
-//
-// Upon completion it updates the needs_deletion flag on the archive
-func DeleteArchivedMessages(ctx context.Context, rt *runtime.Runtime, archive *Archive) error {
-	outer, cancel := context.WithTimeout(ctx, time.Hour*3)
-	defer cancel()
-
-	start := dates.Now()
-	log := slog.With(
-		"id", archive.ID,
-		"org_id", archive.OrgID,
-		"start_date", archive.StartDate,
-		"end_date", archive.endDate(),
-		"archive_type", archive.ArchiveType,
-		"total_count", archive.RecordCount,
-	)
-	log.Info("deleting messages")
-
-	// only verify S3 file if archive was uploaded (non-empty archives)
-	if archive.isUploaded() {
-		// first things first, make sure our file is correct on S3
-		bucket, key := archive.location()
-		s3Size, s3Hash, err := GetS3FileInfo(outer, rt.S3, bucket, key)
-		if err != nil {
-			return err
-		}
-
-		if s3Size != archive.Size {
-			return fmt.Errorf("archive size: %d and s3 size: %d do not match", archive.Size, s3Size)
-		}
-
-		// if S3 hash is MD5 then check against archive hash
-		if rt.Config.CheckS3Hashes && archive.Size <= maxSingleUploadBytes && s3Hash != string(archive.Hash) {
-			return fmt.Errorf("archive md5: %s and s3 etag: %s do not match", archive.Hash, s3Hash)
-		}
-	}
-
-	// ok, archive file looks good, let's build up our list of message ids, this may be big but we are int64s so shouldn't be too big
-	rows, err := rt.DB.QueryxContext(outer, sqlSelectOrgMessagesInRange, archive.OrgID, archive.StartDate, archive.endDate())
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-
-	visibleCount := 0
-	msgIDs := make([]int64, 0, archive.RecordCount)
-
-	for rows.Next() {
-		var msgID int64
-		var visibility string
-		if err := rows.Scan(&msgID, &visibility); err != nil {
-			return err
-		}
-
-		msgIDs = append(msgIDs, msgID)
-
-		// keep track of the number of visible messages, ie, not deleted
-		if visibility != visibilityDeletedByUser && visibility != visibilityDeletedBySender {
-			visibleCount++
-		}
-	}
-	rows.Close()
-
-	log.Debug("found messages", "msg_count", len(msgIDs))
-
-	// verify we don't see more messages than there are in our archive (fewer is ok)
-	if visibleCount > archive.RecordCount {
-		return fmt.Errorf("more messages in the database: %d than in archive: %d", visibleCount, archive.RecordCount)
-	}
-
-	// ok, delete our messages in batches, we do this in transactions as it spans a few different queries
-	for _, idBatch := range chunkIDs(msgIDs, deleteTransactionSize) {
-		// no single batch should take more than a few minutes
-		ctx, cancel := context.WithTimeout(ctx, time.Minute*15)
-		defer cancel()
-
-		start := dates.Now()
-
-		// start our transaction
-		tx, err := rt.DB.BeginTxx(ctx, nil)
-		if err != nil {
-			return err
-		}
-
-		// first delete any labelings
-		if err := executeInQuery(ctx, tx, sqlDeleteMessageLabels, idBatch); err != nil {
-			return fmt.Errorf("error removing message labels: %w", err)
-		}
-
-		// then delete the messages themselves
-		if err := executeInQuery(ctx, tx, sqlDeleteMessages, idBatch); err != nil {
-			return fmt.Errorf("error deleting messages: %w", err)
-		}
-
-		// commit our transaction
-		if err := tx.Commit(); err != nil {
-			return fmt.Errorf("error committing message delete transaction: %w", err)
-		}
-
-		log.Debug("deleted batch of messages", "elapsed", dates.Since(start), "count", len(idBatch))
-
-		cancel()
-	}
-
-	slog.Info("completed deleting messages", "elapsed", dates.Since(start))
+// labelings are deleted first, then the messages themselves
+var messageSpec = &ArchiveTypeSpec{
+	Type:          MessageType,
+	RecordName:    "messages",
+	MetricName:    "msgs",
+	Enabled:       func(cfg *runtime.Config) bool { return cfg.ArchiveMessages },
+	WriteRecords:  writeMessageRecords,
+	CountSQL:      `SELECT count(*) FROM msgs_msg WHERE org_id = $1 AND created_on >= $2 AND created_on < $3 AND visibility NOT IN ('D', 'X')`,
+	PurgeCountSQL: `SELECT count(*) FROM msgs_msg WHERE org_id = $1 AND created_on >= $2 AND created_on < $3`,
+	PurgeIDsSQL:   sqlSelectOrgMessagesToPurge,
+	PurgeSQL:      []string{sqlDeleteMessageLabels, sqlDeleteMessages},
+	Cleanup:       DeleteBroadcasts,
+	DateField:     "created_on",
+	CSVColumns: []string{
+		"id", "uuid", "broadcast", "contact.uuid", "contact.name", "urn", "channel.uuid", "channel.name", "flow.uuid", "flow.name",
+		"ticket_uuid", "direction", "type", "status", "visibility", "text", "attachments", "labels", "created_on", "sent_on", "modified_on",
+	},
+}
 
-	return nil
+// DeleteArchivedMessages deletes the messages of the given archive from the database, see deleteArchivedRecords
+func DeleteArchivedMessages(ctx context.Context, rt *runtime.Runtime, archive *Archive) error {
+	return deleteArchivedRecords(ctx, rt, archive, messageSpec)
 }
 
 const sqlSelectOldOrgBroadcasts = `
@@ -227,10 +136,10 @@ SELECT id
  WHERE b.org_id = $1 AND b.created_on < $2 AND b.schedule_id IS NULL AND b.is_active AND NOT EXISTS (SELECT 1 FROM msgs_msg WHERE broadcast_id = b.id)
  LIMIT 1000000;`
 
-// DeleteBroadcasts deletes all broadcasts older than 90 days for the passed in org which have no associated messages
+// DeleteBroadcasts deletes all broadcasts older than the retention period for the passed in org which have no associated messages
 func DeleteBroadcasts(ctx context.Context, rt *runtime.Runtime, now time.Time, org Org) error {
 	start := dates.Now()
-	threshhold := now.AddDate(0, 0, -org.RetentionPeriod)
+	threshhold := now.AddDate(0, 0, -org.retentionPeriod(MessageType))
 
 	rows, err := rt.DB.QueryxContext(ctx, sqlSelectOldOrgBroadcasts, org.ID, threshhold)
 	if err != nil {
@@ -238,6 +147,8 @@ func DeleteBroadcasts(ctx context.Context, rt *runtime.Runtime, now time.Time, o
 	}
 	defer rows.Close()
 
+	throttle := newPurgeThrottle(rt)
+
 	count := 0
 	for rows.Next() {
 		if count == 0 {
@@ -255,6 +166,11 @@ func DeleteBroadcasts(ctx context.Context, rt *runtime.Runtime, now time.Time, o
 			return fmt.Errorf("unable to get broadcast id: %w", err)
 		}
 
+		// give the database a break if it's under load
+		if err := throttle.wait(ctx); err != nil {
+			return err
+		}
+
 		// we delete broadcasts in a transaction per broadcast
 		tx, err := rt.DB.BeginTx(ctx, nil)
 		if err != nil {
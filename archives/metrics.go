@@ -0,0 +1,80 @@
+package archives
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// prometheus metrics which unlike our cloudwatch metrics are updated as archiving happens
+var (
+	metricRecordsArchived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "archiver",
+		Name:      "records_archived_total",
+		Help:      "The number of records written to archives built from the database.",
+	}, []string{"type"})
+
+	metricArchivesCreated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "archiver",
+		Name:      "archives_created_total",
+		Help:      "The number of archives created.",
+	}, []string{"type", "period"})
+
+	metricArchivesFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "archiver",
+		Name:      "archives_failed_total",
+		Help:      "The number of archives which failed to be created.",
+	}, []string{"type", "period"})
+
+	metricBuildTime = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "archiver",
+		Name:      "archive_build_seconds",
+		Help:      "The time taken to build archive files.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 4, 10),
+	}, []string{"type", "period"})
+
+	metricUploadTime = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "archiver",
+		Name:      "archive_upload_seconds",
+		Help:      "The time taken to upload archive files to storage.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 4, 10),
+	}, []string{"type", "period"})
+
+	metricBytesWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "archiver",
+		Name:      "bytes_written_total",
+		Help:      "The number of bytes of archive files written to storage.",
+	}, []string{"type"})
+
+	metricRecordsPurged = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "archiver",
+		Name:      "records_purged_total",
+		Help:      "The number of archived records purged from the database.",
+	}, []string{"type"})
+
+	metricLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "archiver",
+		Name:      "last_success_timestamp_seconds",
+		Help:      "The time the last archiving of all active orgs completed successfully.",
+	})
+)
+
+// records the creation of an archive, or its failure
+func observeArchive(archive *Archive, err error) {
+	labels := prometheus.Labels{"type": string(archive.ArchiveType), "period": string(archive.Period)}
+
+	if err != nil {
+		metricArchivesFailed.With(labels).Inc()
+		return
+	}
+
+	metricArchivesCreated.With(labels).Inc()
+	metricBuildTime.With(labels).Observe((time.Duration(archive.BuildTime) * time.Millisecond).Seconds())
+}
+
+// records the upload of an archive file to storage
+func observeUpload(archive *Archive, elapsed time.Duration) {
+	metricUploadTime.With(prometheus.Labels{"type": string(archive.ArchiveType), "period": string(archive.Period)}).Observe(elapsed.Seconds())
+	metricBytesWritten.WithLabelValues(string(archive.ArchiveType)).Add(float64(archive.Size))
+}
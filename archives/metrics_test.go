@@ -0,0 +1,35 @@
+package archives
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	created := metricArchivesCreated.WithLabelValues("message", "D")
+	failed := metricArchivesFailed.WithLabelValues("message", "D")
+	bytes := metricBytesWritten.WithLabelValues("message")
+	createdBefore, failedBefore, bytesBefore := testutil.ToFloat64(created), testutil.ToFloat64(failed), testutil.ToFloat64(bytes)
+
+	archive := &Archive{ArchiveType: MessageType, Period: DayPeriod, BuildTime: 1500, Size: 1024}
+
+	observeArchive(archive, nil)
+	observeArchive(archive, errors.New("boom"))
+	observeUpload(archive, time.Second)
+
+	assert.Equal(t, createdBefore+1, testutil.ToFloat64(created))
+	assert.Equal(t, failedBefore+1, testutil.ToFloat64(failed))
+	assert.Equal(t, bytesBefore+1024, testutil.ToFloat64(bytes))
+}
+
+func TestArchiveTotalsFailures(t *testing.T) {
+	totals := &archiveTotals{recordsArchived: 10, archivesCreated: 2, rollupsCreated: 1}
+	assert.Equal(t, 0, totals.failures())
+
+	totals.archivesFailed, totals.rollupsFailed, totals.orgsFailed = 1, 2, 1
+	assert.Equal(t, 4, totals.failures())
+}
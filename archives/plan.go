@@ -0,0 +1,305 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/rp-archiver/runtime"
+	"github.com/vinovest/sqlx"
+)
+
+// PlannedArchive is an archive which archiving would create
+type PlannedArchive struct {
+	ArchiveType ArchiveType   `json:"archive_type"`
+	Period      ArchivePeriod `json:"period"`
+	StartDate   time.Time     `json:"start_date"`
+	RecordCount int           `json:"record_count"`
+
+	// whether this would be rolled up from daily (or hourly or monthly) archives rather than built from the database
+	Rollup bool `json:"rollup"`
+}
+
+// PlannedPurge is the deletion of an archive's records from the database which archiving would do
+type PlannedPurge struct {
+	ArchiveID   int           `json:"archive_id,omitempty"` // zero for archives which would be created first
+	ArchiveType ArchiveType   `json:"archive_type"`
+	Period      ArchivePeriod `json:"period"`
+	StartDate   time.Time     `json:"start_date"`
+	RowCount    int           `json:"row_count"`
+}
+
+// OrgPlan is what archiving would do for a single org
+type OrgPlan struct {
+	OrgID    int               `json:"org_id"`
+	OrgName  string            `json:"org_name"`
+	Archives []*PlannedArchive `json:"archives"`
+	Purges   []*PlannedPurge   `json:"purges"`
+}
+
+// Plan is what archiving would do for all active orgs
+type Plan struct {
+	Now  time.Time  `json:"now"`
+	Orgs []*OrgPlan `json:"orgs"`
+}
+
+// PlanActiveOrgs works out what archiving all active orgs would do, without creating, uploading or deleting anything
+func PlanActiveOrgs(ctx context.Context, rt *runtime.Runtime, now time.Time) (*Plan, error) {
+	orgs, err := GetActiveOrgs(ctx, rt)
+	if err != nil {
+		return nil, fmt.Errorf("error getting active orgs: %w", err)
+	}
+
+	plan := &Plan{Now: now, Orgs: make([]*OrgPlan, 0, len(orgs))}
+
+	for _, org := range orgs {
+		orgPlan := &OrgPlan{OrgID: org.ID, OrgName: org.Name, Archives: []*PlannedArchive{}, Purges: []*PlannedPurge{}}
+
+		for _, archiveType := range enabledArchiveTypes(rt.Config) {
+			if err := planOrgArchives(ctx, rt, now, org, archiveType, orgPlan); err != nil {
+				return nil, fmt.Errorf("error planning %s archives for org: %d: %w", archiveType, org.ID, err)
+			}
+		}
+
+		if len(orgPlan.Archives) > 0 || len(orgPlan.Purges) > 0 {
+			plan.Orgs = append(plan.Orgs, orgPlan)
+		}
+	}
+
+	return plan, nil
+}
+
+// adds what ArchiveOrg would do for the given org and type to the org's plan
+func planOrgArchives(ctx context.Context, rt *runtime.Runtime, now time.Time, org Org, archiveType ArchiveType, orgPlan *OrgPlan) error {
+	db := rt.DB
+
+	archiveCount, err := GetCurrentArchiveCount(ctx, db, org, archiveType)
+	if err != nil {
+		return err
+	}
+	missingMonthlies, err := GetMissingMonthlyArchives(ctx, db, now, org, archiveType)
+	if err != nil {
+		return err
+	}
+	missingDailies, err := GetMissingDailyArchives(ctx, db, now, org, archiveType)
+	if err != nil {
+		return err
+	}
+	toPurge, err := GetArchivesToPurge(ctx, db, org, archiveType)
+	if err != nil {
+		return err
+	}
+
+	var missingHourlies []*Archive
+	if org.HourlyArchives {
+		if missingHourlies, err = GetMissingHourlyArchives(ctx, db, now, org, archiveType); err != nil {
+			return err
+		}
+	}
+
+	// no existing archives means a backfill, where full months are built from the database before any dailies, except
+	// for orgs archived hourly which have their months rolled up from hourlies like any other
+	backfill := archiveCount == 0 && !org.HourlyArchives
+	builtMonths := make(map[string]bool)
+
+	// record counts of new monthlies by year so we know how big yearly rollups would be
+	yearCounts := make(map[string]int)
+
+	if backfill {
+		for _, m := range missingMonthlies {
+			count, err := countRecordsInRange(ctx, db, m, false)
+			if err != nil {
+				return err
+			}
+
+			orgPlan.Archives = append(orgPlan.Archives, &PlannedArchive{ArchiveType: archiveType, Period: MonthPeriod, StartDate: m.StartDate, RecordCount: count})
+			builtMonths[m.StartDate.Format("2006-01")] = true
+			yearCounts[m.StartDate.Format("2006")] += count
+
+			if count > 0 {
+				if err := planPurge(ctx, db, m, orgPlan); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// record counts of hourlies by day so we know how big daily rollups would be
+	dayCounts := make(map[string]int)
+
+	for _, h := range missingHourlies {
+		if builtMonths[h.StartDate.Format("2006-01")] {
+			continue
+		}
+
+		count, err := countRecordsInRange(ctx, db, h, false)
+		if err != nil {
+			return err
+		}
+
+		orgPlan.Archives = append(orgPlan.Archives, &PlannedArchive{ArchiveType: archiveType, Period: HourPeriod, StartDate: h.StartDate, RecordCount: count})
+		dayCounts[h.StartDate.Format(time.DateOnly)] += count
+
+		if count > 0 {
+			if err := planPurge(ctx, db, h, orgPlan); err != nil {
+				return err
+			}
+		}
+	}
+
+	// record counts of dailies by month so we know how big rollups would be
+	monthCounts := make(map[string]int)
+
+	for _, d := range missingDailies {
+		month := d.StartDate.Format("2006-01")
+		if builtMonths[month] {
+			continue
+		}
+
+		// orgs archived hourly have their dailies rolled up from existing and new hourlies
+		if org.HourlyArchives {
+			hourlies, err := GetHourlyArchivesForDateRange(ctx, db, org, archiveType, d.StartDate, d.endDate().Add(-time.Second))
+			if err != nil {
+				return err
+			}
+
+			count := dayCounts[d.StartDate.Format(time.DateOnly)] + countRecords(hourlies)
+			orgPlan.Archives = append(orgPlan.Archives, &PlannedArchive{ArchiveType: archiveType, Period: DayPeriod, StartDate: d.StartDate, RecordCount: count, Rollup: true})
+			monthCounts[month] += count
+			continue
+		}
+
+		count, err := countRecordsInRange(ctx, db, d, false)
+		if err != nil {
+			return err
+		}
+
+		orgPlan.Archives = append(orgPlan.Archives, &PlannedArchive{ArchiveType: archiveType, Period: DayPeriod, StartDate: d.StartDate, RecordCount: count})
+		monthCounts[month] += count
+
+		if count > 0 {
+			if err := planPurge(ctx, db, d, orgPlan); err != nil {
+				return err
+			}
+		}
+	}
+
+	// remaining missing monthlies are rolled up from existing and new dailies
+	if !backfill {
+		for _, m := range missingMonthlies {
+			dailies, err := GetDailyArchivesForDateRange(ctx, db, org, archiveType, m.StartDate, m.endDate().Add(-time.Second))
+			if err != nil {
+				return err
+			}
+
+			count := monthCounts[m.StartDate.Format("2006-01")] + countRecords(dailies)
+			orgPlan.Archives = append(orgPlan.Archives, &PlannedArchive{ArchiveType: archiveType, Period: MonthPeriod, StartDate: m.StartDate, RecordCount: count, Rollup: true})
+			yearCounts[m.StartDate.Format("2006")] += count
+		}
+	}
+
+	// missing yearlies are rolled up from existing and new monthlies
+	if rt.Config.YearlyRollups {
+		missingYearlies, err := GetMissingYearlyArchives(ctx, db, now, org, archiveType)
+		if err != nil {
+			return err
+		}
+
+		for _, y := range missingYearlies {
+			monthlies, err := GetMonthlyArchivesForDateRange(ctx, db, org, archiveType, y.StartDate, y.endDate().Add(-time.Second))
+			if err != nil {
+				return err
+			}
+
+			count := yearCounts[y.StartDate.Format("2006")] + countRecords(monthlies)
+			orgPlan.Archives = append(orgPlan.Archives, &PlannedArchive{ArchiveType: archiveType, Period: YearPeriod, StartDate: y.StartDate, RecordCount: count, Rollup: true})
+		}
+	}
+
+	for _, a := range toPurge {
+		a.Org = org
+		if err := planPurge(ctx, db, a, orgPlan); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// adds the purging of the given archive to the org's plan
+func planPurge(ctx context.Context, db *sqlx.DB, archive *Archive, orgPlan *OrgPlan) error {
+	count, err := countRecordsInRange(ctx, db, archive, true)
+	if err != nil {
+		return err
+	}
+
+	orgPlan.Purges = append(orgPlan.Purges, &PlannedPurge{ArchiveID: archive.ID, ArchiveType: archive.ArchiveType, Period: archive.Period, StartDate: archive.StartDate, RowCount: count})
+	return nil
+}
+
+// counts the records in the archive's date range which would be archived, or if purgeable, the rows which purging
+// would delete, which for messages includes deleted messages
+func countRecordsInRange(ctx context.Context, db *sqlx.DB, archive *Archive, purgeable bool) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
+	defer cancel()
+
+	spec := GetArchiveTypeSpec(archive.ArchiveType)
+	if spec == nil {
+		return 0, fmt.Errorf("unknown archive type: %s", archive.ArchiveType)
+	}
+
+	var count int
+	if err := db.GetContext(ctx, &count, spec.countSQL(purgeable), archive.OrgID, archive.StartDate, archive.endDate()); err != nil {
+		return 0, fmt.Errorf("error counting %s records for org: %d: %w", archive.ArchiveType, archive.OrgID, err)
+	}
+
+	return count, nil
+}
+
+// WriteText writes a human readable version of the plan
+func (p *Plan) WriteText(w io.Writer) error {
+	b := &strings.Builder{}
+	totalRecords, totalRows := 0, 0
+
+	for _, o := range p.Orgs {
+		fmt.Fprintf(b, "org %d (%s)\n", o.OrgID, o.OrgName)
+
+		for _, a := range o.Archives {
+			source := "from database"
+			if a.Rollup && a.Period == DayPeriod {
+				source = "from hourlies"
+			} else if a.Rollup && a.Period == YearPeriod {
+				source = "from monthlies"
+			} else if a.Rollup {
+				source = "from dailies"
+			} else {
+				totalRecords += a.RecordCount
+			}
+			fmt.Fprintf(b, "  create %-7s %s %s: %d records %s\n", a.ArchiveType, a.Period, formatPlanDate(a.Period, a.StartDate), a.RecordCount, source)
+		}
+		for _, pg := range o.Purges {
+			fmt.Fprintf(b, "  purge  %-7s %s %s: %d rows\n", pg.ArchiveType, pg.Period, formatPlanDate(pg.Period, pg.StartDate), pg.RowCount)
+			totalRows += pg.RowCount
+		}
+	}
+
+	fmt.Fprintf(b, "%d orgs, %d records to archive, %d rows to purge\n", len(p.Orgs), totalRecords, totalRows)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func formatPlanDate(period ArchivePeriod, d time.Time) string {
+	switch period {
+	case MonthPeriod:
+		return d.Format("2006-01")
+	case YearPeriod:
+		return d.Format("2006")
+	case HourPeriod:
+		return d.Format("2006-01-02T15")
+	default:
+		return d.Format(time.DateOnly)
+	}
+}
@@ -0,0 +1,100 @@
+package archives
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+)
+
+// ErrAlreadyArchiving is returned when trying to archive an org and type which is already being archived
+var ErrAlreadyArchiving = errors.New("org is already being archived for this type")
+
+// Work is the archiving of an org and type which is in progress
+type Work struct {
+	OrgID       int         `json:"org_id"`
+	OrgName     string      `json:"org_name"`
+	ArchiveType ArchiveType `json:"archive_type"`
+	Stage       string      `json:"stage"`
+	StartedOn   time.Time   `json:"started_on"`
+}
+
+// tracks the work in progress in this process so that the same org and type is never archived concurrently
+type workTracker struct {
+	mutex sync.Mutex
+	work  map[string]*Work
+}
+
+var inProgress = &workTracker{work: make(map[string]*Work)}
+
+// InProgress returns a snapshot of the work currently in progress, oldest first
+func InProgress() []*Work {
+	inProgress.mutex.Lock()
+	defer inProgress.mutex.Unlock()
+
+	work := make([]*Work, 0, len(inProgress.work))
+	for _, w := range inProgress.work {
+		c := *w
+		work = append(work, &c)
+	}
+
+	slices.SortFunc(work, func(a, b *Work) int { return a.StartedOn.Compare(b.StartedOn) })
+	return work
+}
+
+// records the start of archiving the given org and type, returning a function to update its stage and a function to
+// call when it's done
+func startWork(org Org, archiveType ArchiveType) (func(string), func(), error) {
+	key := fmt.Sprintf("%d:%s", org.ID, archiveType)
+
+	inProgress.mutex.Lock()
+	defer inProgress.mutex.Unlock()
+
+	if _, exists := inProgress.work[key]; exists {
+		return nil, nil, ErrAlreadyArchiving
+	}
+
+	work := &Work{OrgID: org.ID, OrgName: org.Name, ArchiveType: archiveType, StartedOn: dates.Now()}
+	inProgress.work[key] = work
+
+	setStage := func(stage string) {
+		inProgress.mutex.Lock()
+		work.Stage = stage
+		inProgress.mutex.Unlock()
+	}
+	done := func() {
+		inProgress.mutex.Lock()
+		delete(inProgress.work, key)
+		inProgress.mutex.Unlock()
+	}
+
+	return setStage, done, nil
+}
+
+// OrgClaim is a claim on archiving an org and type in this process, which stops anything else archiving them until it's
+// released
+type OrgClaim struct {
+	org         Org
+	archiveType ArchiveType
+	setStage    func(string)
+	release     func()
+}
+
+// ClaimOrg claims the archiving of the given org and type, returning ErrAlreadyArchiving if they're already being
+// archived. The claim must be passed to ArchiveClaimedOrg or released.
+func ClaimOrg(org Org, archiveType ArchiveType) (*OrgClaim, error) {
+	setStage, done, err := startWork(org, archiveType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OrgClaim{org: org, archiveType: archiveType, setStage: setStage, release: sync.OnceFunc(done)}, nil
+}
+
+// Release releases the claim, which can be called more than once
+func (c *OrgClaim) Release() {
+	c.release()
+}
@@ -0,0 +1,73 @@
+package archives
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkTracking(t *testing.T) {
+	dates.SetNowFunc(dates.NewSequentialNow(time.Date(2018, 1, 8, 12, 30, 0, 0, time.UTC), time.Second))
+	defer dates.SetNowFunc(time.Now)
+
+	org1, org2 := Org{ID: 1, Name: "Org 1"}, Org{ID: 2, Name: "Org 2"}
+
+	assert.Len(t, InProgress(), 0)
+
+	setStage1, done1, err := startWork(org1, MessageType)
+	require.NoError(t, err)
+	_, done2, err := startWork(org2, MessageType)
+	require.NoError(t, err)
+	_, done3, err := startWork(org1, RunType)
+	require.NoError(t, err)
+
+	setStage1("purging")
+
+	// can't archive the same org and type twice at once
+	_, _, err = startWork(org1, MessageType)
+	assert.Equal(t, ErrAlreadyArchiving, err)
+
+	work := InProgress()
+	assert.Len(t, work, 3)
+	assert.Equal(t, 1, work[0].OrgID)
+	assert.Equal(t, MessageType, work[0].ArchiveType)
+	assert.Equal(t, "purging", work[0].Stage)
+
+	done1()
+	done2()
+	done3()
+
+	assert.Len(t, InProgress(), 0)
+
+	// and once done it can be archived again
+	_, done1, err = startWork(org1, MessageType)
+	assert.NoError(t, err)
+	done1()
+}
+
+func TestClaimOrg(t *testing.T) {
+	org := Org{ID: 1, Name: "Org 1"}
+
+	claim, err := ClaimOrg(org, MessageType)
+	require.NoError(t, err)
+	assert.Len(t, InProgress(), 1)
+
+	// a claimed org can't be claimed or archived again until released
+	_, err = ClaimOrg(org, MessageType)
+	assert.Equal(t, ErrAlreadyArchiving, err)
+
+	_, _, _, _, _, err = ArchiveOrg(t.Context(), nil, time.Now(), org, MessageType)
+	assert.Equal(t, ErrAlreadyArchiving, err)
+
+	// releasing more than once is harmless
+	claim.Release()
+	claim.Release()
+	assert.Len(t, InProgress(), 0)
+
+	claim, err = ClaimOrg(org, MessageType)
+	assert.NoError(t, err)
+	claim.Release()
+}
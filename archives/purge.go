@@ -0,0 +1,198 @@
+package archives
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/rp-archiver/runtime"
+	"github.com/vinovest/sqlx"
+)
+
+// number of record ids we fetch at a time when purging, which are then deleted in transactions sized by a purgeThrottle
+var purgePageSize = 10000
+
+const sqlSelectPurgeProgress = `
+SELECT last_id FROM archives_purgeprogress WHERE archive_id = $1`
+
+const sqlUpsertPurgeProgress = `
+INSERT INTO archives_purgeprogress(archive_id, last_id, deleted_count, updated_on)
+     VALUES($1, $2, $3, $4)
+ON CONFLICT (archive_id) DO UPDATE
+        SET last_id = EXCLUDED.last_id, deleted_count = archives_purgeprogress.deleted_count + EXCLUDED.deleted_count, updated_on = EXCLUDED.updated_on`
+
+const sqlDeletePurgeProgress = `
+DELETE FROM archives_purgeprogress WHERE archive_id = $1`
+
+// verifies the stored file of an archive is still present (and correct), then checks there are no more records in the
+// archive's date range than were archived, and deletes them in pages, checkpointing its progress so that an interrupted
+// purge resumes where it left off. Marking the archive as no longer needing deletion is left to the caller.
+func deleteArchivedRecords(ctx context.Context, rt *runtime.Runtime, archive *Archive, spec *ArchiveTypeSpec) error {
+	outer, cancel := context.WithTimeout(ctx, time.Hour*3)
+	defer cancel()
+
+	start := dates.Now()
+	log := slog.With(
+		"id", archive.ID,
+		"org_id", archive.OrgID,
+		"start_date", archive.StartDate,
+		"end_date", archive.endDate(),
+		"archive_type", archive.ArchiveType,
+		"total_count", archive.RecordCount,
+	)
+	log.Info("deleting " + spec.RecordName)
+
+	// only verify stored file if archive was uploaded (non-empty archives)
+	if archive.isUploaded() {
+		// first things first, make sure our file is correct in storage
+		storedSize, storedHash, err := storageFor(rt).Info(outer, string(archive.Location))
+		if err != nil {
+			return err
+		}
+
+		if storedSize != archive.Size {
+			return fmt.Errorf("archive size: %d and stored size: %d do not match", archive.Size, storedSize)
+		}
+
+		// if stored hash is MD5 then check against archive hash
+		if rt.Config.CheckS3Hashes && isMD5Hash(storedHash) && storedHash != string(archive.Hash) {
+			return fmt.Errorf("archive md5: %s and stored hash: %s do not match", archive.Hash, storedHash)
+		}
+	}
+
+	// ok, archive file looks good, let's delete our records
+	deleted, err := purgeRecords(outer, rt, archive, spec, log)
+	if err != nil {
+		return err
+	}
+
+	log.Info("completed deleting "+spec.RecordName, "elapsed", dates.Since(start), "count", deleted)
+
+	return nil
+}
+
+// deletes the records in the archive's date range in pages ordered by id, checkpointing the last deleted id in the same
+// transaction as each batch so that an interrupted purge resumes where it stopped (if the database has the purge progress
+// table), and slowing down if the database is under load. It returns the number of records deleted by this call.
+func purgeRecords(ctx context.Context, rt *runtime.Runtime, archive *Archive, spec *ArchiveTypeSpec, log *slog.Logger) (int, error) {
+	// verify we don't see more records than there are in our archive (fewer is ok)
+	count, err := countRecordsInRange(ctx, rt.DB, archive, false)
+	if err != nil {
+		return 0, err
+	}
+	if count > archive.RecordCount {
+		return 0, fmt.Errorf("more %s in the database: %d than in archive: %d", spec.RecordName, count, archive.RecordCount)
+	}
+
+	checkpoint := rt.Schema.PurgeProgress
+	var lastID int64
+
+	if checkpoint {
+		lastID, err = getPurgeProgress(ctx, rt.DB, archive.ID)
+		if err != nil {
+			return 0, err
+		}
+		if lastID > 0 {
+			log.Info("resuming interrupted purge", "last_id", lastID)
+		}
+	}
+
+	throttle := newPurgeThrottle(rt)
+	deleted := 0
+
+	for {
+		ids, err := selectPurgePage(ctx, rt.DB, archive, spec, lastID)
+		if err != nil {
+			return deleted, err
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		log.Debug("deleting page of "+spec.RecordName, "count", len(ids), "after_id", lastID)
+
+		// we do this in transactions as it may span a few different queries, sized by our throttle
+		for len(ids) > 0 {
+			if err := throttle.wait(ctx); err != nil {
+				return deleted, err
+			}
+
+			idBatch := ids[:min(throttle.batchSize, len(ids))]
+			ids = ids[len(idBatch):]
+
+			if err := deletePurgeBatch(ctx, rt.DB, archive, spec, idBatch, checkpoint); err != nil {
+				return deleted, err
+			}
+
+			lastID = idBatch[len(idBatch)-1]
+			deleted += len(idBatch)
+		}
+	}
+
+	// purge is complete so we no longer need our checkpoint
+	if checkpoint {
+		if _, err := rt.DB.ExecContext(ctx, sqlDeletePurgeProgress, archive.ID); err != nil {
+			return deleted, fmt.Errorf("error deleting purge progress: %w", err)
+		}
+	}
+
+	return deleted, nil
+}
+
+// returns the last record id deleted by a previous purge of the archive which didn't complete, or zero
+func getPurgeProgress(ctx context.Context, db *sqlx.DB, archiveID int) (int64, error) {
+	var lastID int64
+	err := db.GetContext(ctx, &lastID, sqlSelectPurgeProgress, archiveID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("error fetching purge progress: %w", err)
+	}
+	return lastID, nil
+}
+
+// selects the next page of record ids to delete after the given id
+func selectPurgePage(ctx context.Context, db *sqlx.DB, archive *Archive, spec *ArchiveTypeSpec, afterID int64) ([]int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
+	defer cancel()
+
+	ids := make([]int64, 0, purgePageSize)
+	if err := db.SelectContext(ctx, &ids, spec.PurgeIDsSQL, archive.OrgID, archive.StartDate, archive.endDate(), afterID, purgePageSize); err != nil {
+		return nil, fmt.Errorf("error selecting %s to purge: %w", spec.RecordName, err)
+	}
+	return ids, nil
+}
+
+// deletes a batch of records and, if checkpointing, records our progress in a single transaction
+func deletePurgeBatch(ctx context.Context, db *sqlx.DB, archive *Archive, spec *ArchiveTypeSpec, ids []int64, checkpoint bool) error {
+	// no single batch should take more than a few minutes
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*15)
+	defer cancel()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// rolls back if we return before committing, and is a no-op once we have
+	defer tx.Rollback()
+
+	for _, query := range spec.PurgeSQL {
+		if err := executeInQuery(ctx, tx, query, ids); err != nil {
+			return fmt.Errorf("error deleting %s: %w", spec.RecordName, err)
+		}
+	}
+
+	if checkpoint {
+		if _, err := tx.ExecContext(ctx, sqlUpsertPurgeProgress, archive.ID, ids[len(ids)-1], len(ids), dates.Now()); err != nil {
+			return fmt.Errorf("error updating purge progress: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing %s delete transaction: %w", spec.RecordName, err)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package archives
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/rp-archiver/runtime"
+)
+
+// RecordQuery selects archived records of a single org and archive type. Empty fields don't filter records.
+type RecordQuery struct {
+	ArchiveType ArchiveType
+	From        time.Time // start of the date range (inclusive)
+	To          time.Time // end of the date range (exclusive)
+
+	ContactUUID string
+	FlowUUID    string
+	ChannelUUID string // messages only
+	Direction   string // messages only, one of in or out
+	Text        string // messages only, case insensitive match on message text
+}
+
+// the fields of archive records that we can filter on
+type queriedRecord struct {
+	Contact    *archivedRef `json:"contact"`
+	Flow       *archivedRef `json:"flow"`
+	Channel    *archivedRef `json:"channel"`
+	Direction  string       `json:"direction"`
+	Text       string       `json:"text"`
+	CreatedOn  time.Time    `json:"created_on"`
+	ModifiedOn time.Time    `json:"modified_on"`
+	EndedOn    *time.Time   `json:"ended_on"`
+	ClosedOn   *time.Time   `json:"closed_on"`
+}
+
+// returns the value of the given date field of a record, decoding it from the record's JSON if it isn't one we know
+func (r *queriedRecord) date(field string, line []byte) time.Time {
+	switch field {
+	case "created_on":
+		return r.CreatedOn
+	case "modified_on":
+		return r.ModifiedOn
+	case "ended_on":
+		if r.EndedOn != nil {
+			return *r.EndedOn
+		}
+	case "closed_on":
+		if r.ClosedOn != nil {
+			return *r.ClosedOn
+		}
+	default:
+		var fields map[string]json.RawMessage
+		var date time.Time
+		if json.Unmarshal(line, &fields) == nil && fields[field] != nil {
+			json.Unmarshal(fields[field], &date)
+		}
+		return date
+	}
+	return time.Time{}
+}
+
+// returns the record field that archives of the given type are dated by
+func dateField(archiveType ArchiveType) string {
+	if spec := GetArchiveTypeSpec(archiveType); spec != nil {
+		return spec.DateField
+	}
+	return ""
+}
+
+// validates the query, returning an error if it uses filters which don't apply to its archive type
+func (q *RecordQuery) validate() error {
+	if !q.ArchiveType.IsValid() {
+		return fmt.Errorf("unknown archive type: %s", q.ArchiveType)
+	}
+	if !q.To.After(q.From) {
+		return fmt.Errorf("query end date must be after its start date")
+	}
+	if q.ArchiveType != MessageType && (q.ChannelUUID != "" || q.Direction != "" || q.Text != "") {
+		return fmt.Errorf("channel, direction and text filters only supported for archive type: %s", MessageType)
+	}
+	if q.Direction != "" && q.Direction != "in" && q.Direction != "out" {
+		return fmt.Errorf("invalid direction: %s", q.Direction)
+	}
+	return nil
+}
+
+// returns whether the archive with the given index may contain records which match this query
+func (q *RecordQuery) mayMatch(index *ArchiveIndex) bool {
+	if !index.MayContainDates(q.From, q.To) {
+		return false
+	}
+	if q.ContactUUID != "" && !index.MayContainContact(q.ContactUUID) {
+		return false
+	}
+	if q.FlowUUID != "" && !index.MayContainFlow(q.FlowUUID) {
+		return false
+	}
+	return true
+}
+
+// returns whether the given record, decoded from the given line, matches this query
+func (q *RecordQuery) matches(r *queriedRecord, line []byte) bool {
+	date := r.date(dateField(q.ArchiveType), line)
+	if date.Before(q.From) || !date.Before(q.To) {
+		return false
+	}
+
+	if q.ContactUUID != "" && (r.Contact == nil || r.Contact.UUID != q.ContactUUID) {
+		return false
+	}
+	if q.FlowUUID != "" && (r.Flow == nil || r.Flow.UUID != q.FlowUUID) {
+		return false
+	}
+	if q.ChannelUUID != "" && (r.Channel == nil || r.Channel.UUID != q.ChannelUUID) {
+		return false
+	}
+	if q.Direction != "" && r.Direction != q.Direction {
+		return false
+	}
+	if q.Text != "" && !strings.Contains(strings.ToLower(r.Text), strings.ToLower(q.Text)) {
+		return false
+	}
+	return true
+}
+
+// QueryArchivedRecords streams the archives of the given org which overlap the query's date range from storage, and
+// writes the records which match the query to the given writer as JSONL, with the records of CSV archives written as
+// objects of their columns. It returns the number of records written.
+func QueryArchivedRecords(ctx context.Context, rt *runtime.Runtime, org Org, query *RecordQuery, w io.Writer) (int, error) {
+	if err := query.validate(); err != nil {
+		return 0, err
+	}
+
+	archives, err := GetArchivesToRestore(ctx, rt.DB, org, query.ArchiveType, query.From, query.To)
+	if err != nil {
+		return 0, err
+	}
+
+	totalMatched := 0
+
+	for _, archive := range archives {
+		// skip archives which our index tells us can't have any matching records
+		index, err := GetArchiveIndex(ctx, rt, archive)
+		if err != nil {
+			return totalMatched, err
+		}
+		if index != nil && !query.mayMatch(index) {
+			slog.Debug("skipping archive using its index", "org_id", org.ID, "archive_type", query.ArchiveType, "start_date", archive.StartDate, "period", archive.Period)
+			continue
+		}
+
+		start := dates.Now()
+
+		matched, unmatched, err := readArchiveRecords(ctx, rt, archive, func(batch [][]byte) (int, int, error) {
+			return queryRecords(query, batch, w)
+		})
+		totalMatched += matched
+
+		if err != nil {
+			return totalMatched, fmt.Errorf("error querying archive %s: %w", archive.UUID, err)
+		}
+
+		slog.Debug("queried archive records", "org_id", org.ID, "archive_type", query.ArchiveType, "start_date", archive.StartDate, "period", archive.Period, "matched", matched, "unmatched", unmatched, "elapsed", dates.Since(start))
+	}
+
+	return totalMatched, nil
+}
+
+// writes the records of a batch which match the query, returning the number matched and not matched
+func queryRecords(query *RecordQuery, batch [][]byte, w io.Writer) (int, int, error) {
+	matched := 0
+
+	for _, line := range batch {
+		record := &queriedRecord{}
+		if err := json.Unmarshal(line, record); err != nil {
+			return matched, 0, fmt.Errorf("error decoding archived record: %w", err)
+		}
+
+		if query.matches(record, line) {
+			if _, err := w.Write(line); err != nil {
+				return matched, 0, err
+			}
+
+			// the last line of an archive might not have a newline
+			if !bytes.HasSuffix(line, []byte{'\n'}) {
+				if _, err := w.Write([]byte{'\n'}); err != nil {
+					return matched, 0, err
+				}
+			}
+			matched++
+		}
+	}
+
+	return matched, len(batch) - matched, nil
+}
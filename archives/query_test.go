@@ -0,0 +1,52 @@
+package archives
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryRecords(t *testing.T) {
+	aug, sep := time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC), time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	batch := [][]byte{
+		[]byte(`{"id": 1, "contact": {"uuid": "3e814add", "name": "Ajodinabiff"}, "channel": {"uuid": "60f2ed5b", "name": "Channel 2"}, "flow": null, "direction": "in", "text": "Hello World", "created_on": "2017-08-12T21:11:59.890662+00:00"}` + "\n"),
+		[]byte(`{"id": 2, "contact": {"uuid": "3e814add", "name": "Ajodinabiff"}, "channel": null, "flow": {"uuid": "9de3663f", "name": "Favorites"}, "direction": "out", "text": "What is your favorite color?", "created_on": "2017-08-13T21:11:59.890662+00:00"}` + "\n"),
+		[]byte(`{"id": 3, "contact": {"uuid": "b46f6e18", "name": null}, "channel": {"uuid": "60f2ed5b", "name": "Channel 2"}, "flow": null, "direction": "in", "text": "hello again", "created_on": "2017-09-01T00:00:00+00:00"}`),
+	}
+
+	tcs := []struct {
+		query    *RecordQuery
+		expected []int
+	}{
+		{&RecordQuery{ArchiveType: MessageType, From: aug, To: sep}, []int{1, 2}},
+		{&RecordQuery{ArchiveType: MessageType, From: aug, To: sep.AddDate(0, 1, 0)}, []int{1, 2, 3}},
+		{&RecordQuery{ArchiveType: MessageType, From: aug, To: sep.AddDate(0, 1, 0), ContactUUID: "b46f6e18"}, []int{3}},
+		{&RecordQuery{ArchiveType: MessageType, From: aug, To: sep, FlowUUID: "9de3663f"}, []int{2}},
+		{&RecordQuery{ArchiveType: MessageType, From: aug, To: sep.AddDate(0, 1, 0), ChannelUUID: "60f2ed5b"}, []int{1, 3}},
+		{&RecordQuery{ArchiveType: MessageType, From: aug, To: sep, Direction: "out"}, []int{2}},
+		{&RecordQuery{ArchiveType: MessageType, From: aug, To: sep.AddDate(0, 1, 0), Text: "HELLO"}, []int{1, 3}},
+		{&RecordQuery{ArchiveType: MessageType, From: aug, To: sep, Text: "hello", Direction: "out"}, []int{}},
+	}
+
+	for i, tc := range tcs {
+		require.NoError(t, tc.query.validate())
+
+		out := &bytes.Buffer{}
+		matched, unmatched, err := queryRecords(tc.query, batch, out)
+		assert.NoError(t, err)
+		assert.Equal(t, len(tc.expected), matched, "matched mismatch in test case %d", i)
+		assert.Equal(t, len(batch)-len(tc.expected), unmatched, "unmatched mismatch in test case %d", i)
+
+		// every written record ends with a newline
+		assert.Equal(t, matched, bytes.Count(out.Bytes(), []byte{'\n'}), "line count mismatch in test case %d", i)
+	}
+
+	assert.EqualError(t, (&RecordQuery{ArchiveType: "foo", From: aug, To: sep}).validate(), "unknown archive type: foo")
+	assert.EqualError(t, (&RecordQuery{ArchiveType: MessageType, From: sep, To: aug}).validate(), "query end date must be after its start date")
+	assert.EqualError(t, (&RecordQuery{ArchiveType: RunType, From: aug, To: sep, Text: "hello"}).validate(), "channel, direction and text filters only supported for archive type: message")
+	assert.EqualError(t, (&RecordQuery{ArchiveType: MessageType, From: aug, To: sep, Direction: "sideways"}).validate(), "invalid direction: sideways")
+}
@@ -0,0 +1,54 @@
+package archives
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/nyaruka/rp-archiver/runtime"
+	"github.com/vinovest/sqlx"
+)
+
+// the replay lag of a replica, which is zero if it has replayed everything it has received, or if it's a primary
+const sqlSelectReplicaLag = `
+SELECT COALESCE(
+	CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0 ELSE EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()) END,
+	0
+)`
+
+// the query used to fetch the lag of the readonly database, which tests can replace to simulate a lagging replica
+var replicaLagQuery = sqlSelectReplicaLag
+
+// returns the database that archive records should be read from, which is the readonly database if there is one and
+// it isn't lagging too far behind, otherwise the primary database
+func readerDB(ctx context.Context, rt *runtime.Runtime) *sqlx.DB {
+	if rt.ReadonlyDB == nil {
+		return rt.DB
+	}
+
+	if rt.Config.ReadonlyMaxLag > 0 {
+		lag, err := replicaLag(ctx, rt.ReadonlyDB)
+		if err != nil {
+			slog.Error("error checking readonly database lag, reading from primary", "error", err)
+			return rt.DB
+		}
+		if lag > time.Duration(rt.Config.ReadonlyMaxLag)*time.Second {
+			slog.Warn("readonly database lagging, reading from primary", "lag", lag)
+			return rt.DB
+		}
+	}
+
+	return rt.ReadonlyDB
+}
+
+// fetches how far behind its primary the given database is
+func replicaLag(ctx context.Context, db *sqlx.DB) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
+	defer cancel()
+
+	var lagSeconds float64
+	if err := db.GetContext(ctx, &lagSeconds, replicaLagQuery); err != nil {
+		return 0, err
+	}
+	return time.Duration(lagSeconds * float64(time.Second)), nil
+}
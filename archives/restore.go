@@ -0,0 +1,487 @@
+package archives
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/rp-archiver/runtime"
+	"github.com/vinovest/sqlx"
+)
+
+// number of records we decode and insert in a single transaction when restoring
+const restoreBatchSize = 1000
+
+const sqlLookupArchivesToRestore = `
+  SELECT uuid, id, org_id, start_date::timestamp with time zone AS start_date, period, archive_type, hash, location, size, record_count, needs_deletion, rollup_id, ` + sqlSelectEncryption + `, ` + sqlSelectUTCOffset + `
+    FROM archives_archive
+   WHERE org_id = $1 AND archive_type = $2 AND rollup_id IS NULL AND location IS NOT NULL AND start_date < $4 AND
+         (CASE WHEN period = 'H' THEN start_date + '1 hour'::interval WHEN period = 'D' THEN start_date + '1 day'::interval WHEN period = 'Y' THEN start_date + '1 year'::interval ELSE start_date + '1 month'::interval END) > $3
+ORDER BY start_date ASC, period DESC`
+
+// GetArchivesToRestore returns the archives which contain records in the given date range, preferring rollups over the
+// dailies they were built from
+func GetArchivesToRestore(ctx context.Context, db *sqlx.DB, org Org, archiveType ArchiveType, from, to time.Time) ([]*Archive, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	archives := make([]*Archive, 0, 1)
+	err := db.SelectContext(ctx, &archives, sqlLookupArchivesToRestore, org.ID, archiveType, from, to)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("error selecting archives to restore for org: %d and type: %s: %w", org.ID, archiveType, err)
+	}
+
+	for _, a := range archives {
+		a.Org = org
+	}
+
+	return archives, nil
+}
+
+// RestoreArchivedRecords re-imports the records in the given date range from the org's archives back into the database,
+// skipping any records which still exist. It returns the number of records restored and skipped.
+func RestoreArchivedRecords(ctx context.Context, rt *runtime.Runtime, org Org, archiveType ArchiveType, from, to time.Time) (int, int, error) {
+	var restore func(context.Context, *runtime.Runtime, Org, [][]byte, time.Time, time.Time) (int, int, error)
+
+	switch archiveType {
+	case MessageType:
+		restore = restoreMessages
+	case RunType:
+		restore = restoreRuns
+	default:
+		return 0, 0, fmt.Errorf("restoring not supported for archive type: %s", archiveType)
+	}
+
+	archives, err := GetArchivesToRestore(ctx, rt.DB, org, archiveType, from, to)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	totalRestored, totalSkipped := 0, 0
+
+	for _, archive := range archives {
+		log := slog.With("org_id", org.ID, "archive_type", archiveType, "start_date", archive.StartDate, "period", archive.Period, "location", archive.Location)
+		start := dates.Now()
+
+		restored, skipped, err := restoreArchive(ctx, rt, archive, func(batch [][]byte) (int, int, error) {
+			return restore(ctx, rt, org, batch, from, to)
+		})
+		totalRestored += restored
+		totalSkipped += skipped
+
+		if err != nil {
+			return totalRestored, totalSkipped, fmt.Errorf("error restoring archive %s: %w", archive.UUID, err)
+		}
+
+		log.Info("restored archive records", "restored", restored, "skipped", skipped, "elapsed", dates.Since(start))
+	}
+
+	return totalRestored, totalSkipped, nil
+}
+
+// reads the records from the passed in archive and passes them in batches to the given restore function
+func restoreArchive(ctx context.Context, rt *runtime.Runtime, archive *Archive, restore func([][]byte) (int, int, error)) (int, int, error) {
+	if archive.format() != FormatJSONL {
+		return 0, 0, fmt.Errorf("restoring not supported for archive format: %s", archive.format())
+	}
+
+	return readArchiveRecords(ctx, rt, archive, restore)
+}
+
+// reads the records from the passed in archive as lines of JSON and passes them in batches to the given function, which
+// returns counts of the records it processed and skipped, which are totalled
+func readArchiveRecords(ctx context.Context, rt *runtime.Runtime, archive *Archive, process func([][]byte) (int, int, error)) (int, int, error) {
+	reader, err := storageFor(rt).Get(ctx, string(archive.Location))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer reader.Close()
+
+	decReader, err := decryptReader(rt, archive, reader)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error decrypting archive: %w", err)
+	}
+
+	compReader, err := archive.codec().newReader(decReader)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error creating %s reader: %w", archive.codec(), err)
+	}
+	defer compReader.Close()
+
+	records := archive.format().newRecordReader(compReader)
+	batch := make([][]byte, 0, restoreBatchSize)
+	totalProcessed, totalSkipped := 0, 0
+
+	for {
+		line, err := records.readRecord()
+		if len(line) > 0 {
+			batch = append(batch, line)
+		}
+
+		if len(batch) == restoreBatchSize || (errors.Is(err, io.EOF) && len(batch) > 0) {
+			processed, skipped, err := process(batch)
+			totalProcessed += processed
+			totalSkipped += skipped
+			if err != nil {
+				return totalProcessed, totalSkipped, err
+			}
+			batch = batch[:0]
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return totalProcessed, totalSkipped, fmt.Errorf("error reading archive records: %w", err)
+		}
+	}
+
+	return totalProcessed, totalSkipped, nil
+}
+
+// reference to another object as written in archive records
+type archivedRef struct {
+	UUID string `json:"uuid"`
+	Name string `json:"name"`
+}
+
+type archivedMsg struct {
+	ID          int64        `json:"id"`
+	UUID        string       `json:"uuid"`
+	Broadcast   *int64       `json:"broadcast"`
+	Contact     archivedRef  `json:"contact"`
+	URN         *string      `json:"urn"`
+	Channel     *archivedRef `json:"channel"`
+	Flow        *archivedRef `json:"flow"`
+	TicketUUID  *string      `json:"ticket_uuid"`
+	Direction   string       `json:"direction"`
+	Type        string       `json:"type"`
+	Status      string       `json:"status"`
+	Visibility  string       `json:"visibility"`
+	Text        string       `json:"text"`
+	Attachments []struct {
+		ContentType string `json:"content_type"`
+		URL         string `json:"url"`
+	} `json:"attachments"`
+	Labels     []archivedRef `json:"labels"`
+	CreatedOn  time.Time     `json:"created_on"`
+	SentOn     *time.Time    `json:"sent_on"`
+	ModifiedOn time.Time     `json:"modified_on"`
+}
+
+var msgDirections = map[string]string{"in": "I", "out": "O"}
+var msgTypes = map[string]string{"text": "T", "optin": "O", "voice": "V"}
+var msgVisibilities = map[string]string{"visible": "V", "archived": "A"}
+var msgStatuses = map[string]string{
+	"initializing": "I",
+	"queued":       "Q",
+	"wired":        "W",
+	"delivered":    "D",
+	"handled":      "H",
+	"errored":      "E",
+	"failed":       "F",
+	"sent":         "S",
+	"read":         "R",
+}
+
+const sqlInsertRestoredMsg = `
+INSERT INTO msgs_msg(id, uuid, org_id, channel_id, contact_id, contact_urn_id, broadcast_id, flow_id, ticket_uuid, text, attachments, created_on, modified_on, sent_on, msg_type, direction, status, visibility, msg_count, error_count)
+     VALUES($1, $2, $3, $4, $5, $6, (SELECT id FROM msgs_broadcast WHERE id = $7), $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, 1, 0)
+ON CONFLICT DO NOTHING`
+
+const sqlInsertRestoredMsgLabel = `
+INSERT INTO msgs_msg_labels(msg_id, label_id) VALUES($1, $2)`
+
+// restores a batch of message records
+func restoreMessages(ctx context.Context, rt *runtime.Runtime, org Org, batch [][]byte, from, to time.Time) (int, int, error) {
+	msgs := make([]*archivedMsg, 0, len(batch))
+	contactUUIDs, channelUUIDs, flowUUIDs, labelUUIDs, urns := make([]string, 0, len(batch)), []string{}, []string{}, []string{}, []string{}
+
+	for _, record := range batch {
+		m := &archivedMsg{}
+		if err := json.Unmarshal(record, m); err != nil {
+			return 0, 0, fmt.Errorf("error unmarshaling message record: %w", err)
+		}
+		if m.CreatedOn.Before(from) || !m.CreatedOn.Before(to) {
+			continue
+		}
+
+		msgs = append(msgs, m)
+		contactUUIDs = append(contactUUIDs, m.Contact.UUID)
+		if m.Channel != nil {
+			channelUUIDs = append(channelUUIDs, m.Channel.UUID)
+		}
+		if m.Flow != nil {
+			flowUUIDs = append(flowUUIDs, m.Flow.UUID)
+		}
+		if m.URN != nil {
+			urns = append(urns, *m.URN)
+		}
+		for _, l := range m.Labels {
+			labelUUIDs = append(labelUUIDs, l.UUID)
+		}
+	}
+
+	contactIDs, err := lookupIDs(ctx, rt.DB, `SELECT uuid::text, id FROM contacts_contact WHERE org_id = $1 AND uuid::text = ANY($2)`, org.ID, contactUUIDs)
+	if err != nil {
+		return 0, 0, err
+	}
+	channelIDs, err := lookupIDs(ctx, rt.DB, `SELECT uuid::text, id FROM channels_channel WHERE org_id = $1 AND uuid::text = ANY($2)`, org.ID, channelUUIDs)
+	if err != nil {
+		return 0, 0, err
+	}
+	flowIDs, err := lookupIDs(ctx, rt.DB, `SELECT uuid::text, id FROM flows_flow WHERE org_id = $1 AND uuid::text = ANY($2)`, org.ID, flowUUIDs)
+	if err != nil {
+		return 0, 0, err
+	}
+	urnIDs, err := lookupIDs(ctx, rt.DB, `SELECT identity, id FROM contacts_contacturn WHERE org_id = $1 AND identity = ANY($2)`, org.ID, urns)
+	if err != nil {
+		return 0, 0, err
+	}
+	labelIDs, err := lookupIDs(ctx, rt.DB, `SELECT uuid::text, id FROM msgs_label WHERE org_id = $1 AND uuid::text = ANY($2)`, org.ID, labelUUIDs)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tx, err := rt.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	restored, skipped := 0, 0
+
+	for _, m := range msgs {
+		// messages for contacts which no longer exist can't be restored
+		contactID, found := contactIDs[m.Contact.UUID]
+		if !found {
+			skipped++
+			continue
+		}
+
+		attachments := make([]string, len(m.Attachments))
+		for i, a := range m.Attachments {
+			attachments[i] = a.ContentType + ":" + a.URL
+		}
+
+		res, err := tx.ExecContext(ctx, sqlInsertRestoredMsg,
+			m.ID, m.UUID, org.ID, refID(channelIDs, m.Channel), contactID, nullableID(urnIDs, m.URN), m.Broadcast,
+			refID(flowIDs, m.Flow), m.TicketUUID, m.Text, pq.Array(attachments), m.CreatedOn, m.ModifiedOn, m.SentOn,
+			msgTypes[m.Type], msgDirections[m.Direction], msgStatuses[m.Status], msgVisibilities[m.Visibility],
+		)
+		if err != nil {
+			tx.Rollback()
+			return restored, skipped, fmt.Errorf("error inserting message %s: %w", m.UUID, err)
+		}
+
+		// message still exists, nothing to do
+		if affected, _ := res.RowsAffected(); affected == 0 {
+			skipped++
+			continue
+		}
+
+		for _, l := range m.Labels {
+			if labelID, found := labelIDs[l.UUID]; found {
+				if _, err := tx.ExecContext(ctx, sqlInsertRestoredMsgLabel, m.ID, labelID); err != nil {
+					tx.Rollback()
+					return restored, skipped, fmt.Errorf("error inserting label for message %s: %w", m.UUID, err)
+				}
+			}
+		}
+
+		restored++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("error committing message restore transaction: %w", err)
+	}
+
+	return restored, skipped, nil
+}
+
+type archivedRun struct {
+	ID        int64       `json:"id"`
+	UUID      string      `json:"uuid"`
+	Flow      archivedRef `json:"flow"`
+	Contact   archivedRef `json:"contact"`
+	Responded bool        `json:"responded"`
+	Path      []struct {
+		Node string    `json:"node"`
+		Time time.Time `json:"time"`
+	} `json:"path"`
+	Values map[string]struct {
+		Name     json.RawMessage `json:"name"`
+		Value    json.RawMessage `json:"value"`
+		Input    json.RawMessage `json:"input"`
+		Time     json.RawMessage `json:"time"`
+		Category json.RawMessage `json:"category"`
+		Node     json.RawMessage `json:"node"`
+	} `json:"values"`
+	CreatedOn  time.Time  `json:"created_on"`
+	ModifiedOn time.Time  `json:"modified_on"`
+	ExitedOn   *time.Time `json:"exited_on"`
+	ExitType   *string    `json:"exit_type"`
+}
+
+var runExitTypes = map[string]string{
+	"completed":   RunStatusCompleted,
+	"interrupted": RunStatusInterrupted,
+	"expired":     RunStatusExpired,
+	"failed":      RunStatusFailed,
+}
+
+const sqlInsertRestoredRun = `
+INSERT INTO flows_flowrun(id, uuid, org_id, responded, contact_id, flow_id, results, path_nodes, path_times, created_on, modified_on, exited_on, status)
+     VALUES($1, $2, $3, $4, $5, $6, $7, $8::uuid[], $9::timestamptz[], $10, $11, $12, $13)
+ON CONFLICT DO NOTHING`
+
+// restores a batch of run records
+func restoreRuns(ctx context.Context, rt *runtime.Runtime, org Org, batch [][]byte, from, to time.Time) (int, int, error) {
+	runs := make([]*archivedRun, 0, len(batch))
+	contactUUIDs, flowUUIDs := make([]string, 0, len(batch)), make([]string, 0, len(batch))
+
+	for _, record := range batch {
+		r := &archivedRun{}
+		if err := json.Unmarshal(record, r); err != nil {
+			return 0, 0, fmt.Errorf("error unmarshaling run record: %w", err)
+		}
+		if r.ModifiedOn.Before(from) || !r.ModifiedOn.Before(to) {
+			continue
+		}
+
+		runs = append(runs, r)
+		contactUUIDs = append(contactUUIDs, r.Contact.UUID)
+		flowUUIDs = append(flowUUIDs, r.Flow.UUID)
+	}
+
+	contactIDs, err := lookupIDs(ctx, rt.DB, `SELECT uuid::text, id FROM contacts_contact WHERE org_id = $1 AND uuid::text = ANY($2)`, org.ID, contactUUIDs)
+	if err != nil {
+		return 0, 0, err
+	}
+	flowIDs, err := lookupIDs(ctx, rt.DB, `SELECT uuid::text, id FROM flows_flow WHERE org_id = $1 AND uuid::text = ANY($2)`, org.ID, flowUUIDs)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tx, err := rt.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	restored, skipped := 0, 0
+
+	for _, r := range runs {
+		// runs for contacts or flows which no longer exist can't be restored
+		contactID, contactFound := contactIDs[r.Contact.UUID]
+		flowID, flowFound := flowIDs[r.Flow.UUID]
+		if !contactFound || !flowFound {
+			skipped++
+			continue
+		}
+
+		// rebuild results in the format they are stored in the database
+		results := make(map[string]map[string]json.RawMessage, len(r.Values))
+		for key, v := range r.Values {
+			results[key] = map[string]json.RawMessage{
+				"name":       v.Name,
+				"value":      v.Value,
+				"input":      v.Input,
+				"created_on": v.Time,
+				"category":   v.Category,
+				"node_uuid":  v.Node,
+			}
+		}
+		resultsJSON, err := json.Marshal(results)
+		if err != nil {
+			tx.Rollback()
+			return restored, skipped, fmt.Errorf("error marshaling results for run %s: %w", r.UUID, err)
+		}
+
+		var pathNodes, pathTimes any
+		if len(r.Path) > 0 {
+			nodes, times := make([]string, len(r.Path)), make([]string, len(r.Path))
+			for i, p := range r.Path {
+				nodes[i], times[i] = p.Node, p.Time.Format(time.RFC3339Nano)
+			}
+			pathNodes, pathTimes = pq.Array(nodes), pq.Array(times)
+		}
+
+		// archives don't distinguish active from waiting runs so we restore those as waiting
+		status := RunStatusWaiting
+		if r.ExitType != nil {
+			status = runExitTypes[*r.ExitType]
+		}
+
+		res, err := tx.ExecContext(ctx, sqlInsertRestoredRun,
+			r.ID, r.UUID, org.ID, r.Responded, contactID, flowID, string(resultsJSON), pathNodes, pathTimes,
+			r.CreatedOn, r.ModifiedOn, r.ExitedOn, status,
+		)
+		if err != nil {
+			tx.Rollback()
+			return restored, skipped, fmt.Errorf("error inserting run %s: %w", r.UUID, err)
+		}
+
+		// run still exists, nothing to do
+		if affected, _ := res.RowsAffected(); affected == 0 {
+			skipped++
+			continue
+		}
+
+		restored++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("error committing run restore transaction: %w", err)
+	}
+
+	return restored, skipped, nil
+}
+
+// looks up the ids of the given keys with a query which takes an org id and an array of keys, and returns key and id rows
+func lookupIDs(ctx context.Context, db *sqlx.DB, query string, orgID int, keys []string) (map[string]int64, error) {
+	ids := make(map[string]int64, len(keys))
+	if len(keys) == 0 {
+		return ids, nil
+	}
+
+	rows, err := db.QueryContext(ctx, query, orgID, pq.Array(keys))
+	if err != nil {
+		return nil, fmt.Errorf("error looking up ids: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var id int64
+		if err := rows.Scan(&key, &id); err != nil {
+			return nil, fmt.Errorf("error scanning id lookup: %w", err)
+		}
+		ids[key] = id
+	}
+
+	return ids, rows.Err()
+}
+
+// returns the id of the given reference if it was found, or nil
+func refID(ids map[string]int64, ref *archivedRef) any {
+	if ref == nil {
+		return nil
+	}
+	return nullableID(ids, &ref.UUID)
+}
+
+// returns the id of the given key if it was found, or nil
+func nullableID(ids map[string]int64, key *string) any {
+	if key == nil {
+		return nil
+	}
+	if id, found := ids[*key]; found {
+		return id
+	}
+	return nil
+}
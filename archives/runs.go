@@ -1,7 +1,6 @@
 package archives
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"log/slog"
@@ -63,7 +62,7 @@ FROM (
 ) as rec;`
 
 // writeRunRecords writes the runs in the archive's date range to the passed in writer
-func writeRunRecords(ctx context.Context, db *sqlx.DB, archive *Archive, writer *bufio.Writer) (int, error) {
+func writeRunRecords(ctx context.Context, db *sqlx.DB, archive *Archive, writer RecordWriter) (int, error) {
 	var rows *sqlx.Rows
 	rows, err := db.QueryxContext(ctx, sqlLookupRuns, archive.Org.ID, archive.StartDate, archive.endDate())
 	if err != nil {
@@ -81,118 +80,45 @@ func writeRunRecords(ctx context.Context, db *sqlx.DB, archive *Archive, writer
 			return 0, fmt.Errorf("error scanning run record for org: %d: %w", archive.Org.ID, err)
 		}
 
-		writer.WriteString(record)
-		writer.WriteString("\n")
+		if err := writer.WriteRecord(record); err != nil {
+			return 0, fmt.Errorf("error writing run record for org: %d: %w", archive.Org.ID, err)
+		}
 		recordCount++
 	}
 
 	return recordCount, nil
 }
 
-const sqlSelectOrgRunsInRange = `
-   SELECT fr.id
-     FROM flows_flowrun fr
-LEFT JOIN contacts_contact cc ON cc.id = fr.contact_id
-    WHERE fr.org_id = $1 AND fr.modified_on >= $2 AND fr.modified_on < $3
- ORDER BY fr.modified_on ASC, fr.id ASC`
+const sqlSelectOrgRunsToPurge = `
+  SELECT id
+    FROM flows_flowrun
+   WHERE org_id = $1 AND modified_on >= $2 AND modified_on < $3 AND id > $4
+ORDER BY id ASC
+   LIMIT $5`
 
 const sqlDeleteRuns = `
 DELETE FROM flows_flowrun WHERE id IN(?)`
 
-// DeleteArchivedRuns takes the passed in archive, verifies the S3 file is still present (and correct), then selects
-// all the runs in the archive date range, and if equal or fewer than the number archived, deletes them 100 at a time
-//
-// Upon completion it updates the needs_deletion flag on the archive
-func DeleteArchivedRuns(ctx context.Context, rt *runtime.Runtime, archive *Archive) error {
-	outer, cancel := context.WithTimeout(ctx, time.Hour*3)
-	defer cancel()
-
-	start := dates.Now()
-	log := slog.With(
-		"id", archive.ID,
-		"org_id", archive.OrgID,
-		"start_date", archive.StartDate,
-		"end_date", archive.endDate(),
-		"archive_type", archive.ArchiveType,
-		"total_count", archive.RecordCount,
-	)
-	log.Info("deleting runs")
-
-	// only verify S3 file if archive was uploaded (non-empty archives)
-	if archive.isUploaded() {
-		// first things first, make sure our file is correct on S3
-		bucket, key := archive.location()
-		s3Size, s3Hash, err := GetS3FileInfo(outer, rt.S3, bucket, key)
-		if err != nil {
-			return err
-		}
-
-		if s3Size != archive.Size {
-			return fmt.Errorf("archive size: %d and s3 size: %d do not match", archive.Size, s3Size)
-		}
-
-		// if S3 hash is MD5 then check against archive hash
-		if rt.Config.CheckS3Hashes && archive.Size <= maxSingleUploadBytes && s3Hash != string(archive.Hash) {
-			return fmt.Errorf("archive md5: %s and s3 etag: %s do not match", archive.Hash, s3Hash)
-		}
-	}
-
-	// ok, archive file looks good, let's build up our list of run ids, this may be big but we are int64s so shouldn't be too big
-	rows, err := rt.DB.QueryxContext(outer, sqlSelectOrgRunsInRange, archive.OrgID, archive.StartDate, archive.endDate())
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-
-	var runID int64
-	runIDs := make([]int64, 0, archive.RecordCount)
-	for rows.Next() {
-		if err := rows.Scan(&runID); err != nil {
-			return err
-		}
-		runIDs = append(runIDs, runID)
-	}
-	rows.Close()
-
-	log.Debug("found runs", "run_count", len(runIDs))
-
-	// verify we don't see more runs than there are in our archive (fewer is ok)
-	if len(runIDs) > archive.RecordCount {
-		return fmt.Errorf("more runs in the database: %d than in archive: %d", len(runIDs), archive.RecordCount)
-	}
-
-	// ok, delete our runs in batches, we do this in transactions as it spans a few different queries
-	for _, idBatch := range chunkIDs(runIDs, deleteTransactionSize) {
-		// no single batch should take more than a few minutes
-		ctx, cancel := context.WithTimeout(ctx, time.Minute*15)
-		defer cancel()
-
-		start := dates.Now()
-
-		// start our transaction
-		tx, err := rt.DB.BeginTxx(ctx, nil)
-		if err != nil {
-			return err
-		}
-
-		// delete our runs
-		if err := executeInQuery(ctx, tx, sqlDeleteRuns, idBatch); err != nil {
-			return fmt.Errorf("error deleting runs: %w", err)
-		}
-
-		// commit our transaction
-		if err := tx.Commit(); err != nil {
-			return fmt.Errorf("error committing run delete transaction: %w", err)
-		}
-
-		log.Debug("deleted batch of runs", "elapsed", dates.Since(start), "count", len(idBatch))
-
-		cancel()
-	}
-
-	slog.Info("completed deleting runs", "elapsed", dates.Since(start))
+var runSpec = &ArchiveTypeSpec{
+	Type:         RunType,
+	RecordName:   "runs",
+	MetricName:   "runs",
+	Enabled:      func(cfg *runtime.Config) bool { return cfg.ArchiveRuns },
+	WriteRecords: writeRunRecords,
+	CountSQL:     `SELECT count(*) FROM flows_flowrun WHERE org_id = $1 AND modified_on >= $2 AND modified_on < $3`,
+	PurgeIDsSQL:  sqlSelectOrgRunsToPurge,
+	PurgeSQL:     []string{sqlDeleteRuns},
+	Cleanup:      DeleteFlowStarts,
+	DateField:    "modified_on",
+	CSVColumns: []string{
+		"id", "uuid", "flow.uuid", "flow.name", "contact.uuid", "contact.name", "responded", "path", "values", "created_on",
+		"modified_on", "exited_on", "exit_type",
+	},
+}
 
-	return nil
+// DeleteArchivedRuns deletes the runs of the given archive from the database, see deleteArchivedRecords
+func DeleteArchivedRuns(ctx context.Context, rt *runtime.Runtime, archive *Archive) error {
+	return deleteArchivedRecords(ctx, rt, archive, runSpec)
 }
 
 const selectOldOrgFlowStarts = `
@@ -201,10 +127,10 @@ const selectOldOrgFlowStarts = `
   WHERE s.org_id = $1 AND s.created_on < $2 AND NOT EXISTS (SELECT 1 FROM flows_flowrun WHERE start_id = s.id)
   LIMIT 1000000;`
 
-// DeleteFlowStarts deletes all starts older than 90 days for the passed in org which have no associated runs
+// DeleteFlowStarts deletes all starts older than the retention period for the passed in org which have no associated runs
 func DeleteFlowStarts(ctx context.Context, rt *runtime.Runtime, now time.Time, org Org) error {
 	start := dates.Now()
-	threshhold := now.AddDate(0, 0, -org.RetentionPeriod)
+	threshhold := now.AddDate(0, 0, -org.retentionPeriod(RunType))
 
 	rows, err := rt.DB.QueryxContext(ctx, selectOldOrgFlowStarts, org.ID, threshhold)
 	if err != nil {
@@ -212,6 +138,8 @@ func DeleteFlowStarts(ctx context.Context, rt *runtime.Runtime, now time.Time, o
 	}
 	defer rows.Close()
 
+	throttle := newPurgeThrottle(rt)
+
 	count := 0
 	for rows.Next() {
 		if count == 0 {
@@ -228,6 +156,11 @@ func DeleteFlowStarts(ctx context.Context, rt *runtime.Runtime, now time.Time, o
 			return fmt.Errorf("unable to get start id: %w", err)
 		}
 
+		// give the database a break if it's under load
+		if err := throttle.wait(ctx); err != nil {
+			return err
+		}
+
 		// we delete starts in a transaction per start
 		tx, err := rt.DB.BeginTx(ctx, nil)
 		if err != nil {
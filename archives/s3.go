@@ -1,9 +1,11 @@
 package archives
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -28,6 +30,10 @@ const maxSingleUploadBytes = 5e9 // 5GB
 // size of chunk to use when doing multi-part uploads
 const chunkSizeBytes = 1e9 // 1GB
 
+// size of chunk and number of chunks uploaded concurrently when streaming, each of which is buffered in memory
+const streamChunkSizeBytes = 64 * 1024 * 1024 // 64MB
+const streamConcurrency = 2
+
 // NewS3Client creates a new s3 service from the passed in config, testing it as necessary
 func NewS3Client(cfg *runtime.Config, test bool) (*s3x.Service, error) {
 	svc, err := s3x.NewService(cfg.AWSAccessKeyID, cfg.AWSSecretAccessKey, cfg.AWSRegion, cfg.S3Endpoint, cfg.S3PathStyle)
@@ -58,6 +64,7 @@ func UploadToS3(ctx context.Context, s3Client *s3x.Service, bucket string, path
 	// s3 wants a base64 encoded hash instead of our hex encoded
 	hashBytes, _ := hex.DecodeString(string(archive.Hash))
 	md5 := base64.StdEncoding.EncodeToString(hashBytes)
+	contentType, contentEncoding := s3ContentHeaders(archive)
 
 	// if this fits into a single part, upload that way
 	if archive.Size <= maxSingleUploadBytes {
@@ -65,8 +72,8 @@ func UploadToS3(ctx context.Context, s3Client *s3x.Service, bucket string, path
 			Bucket:          aws.String(bucket),
 			Body:            f,
 			Key:             aws.String(path),
-			ContentType:     aws.String("application/json"),
-			ContentEncoding: aws.String("gzip"),
+			ContentType:     contentType,
+			ContentEncoding: contentEncoding,
 			ACL:             types.ObjectCannedACLPrivate,
 			ContentMD5:      aws.String(md5),
 			Metadata:        map[string]string{"md5chksum": md5},
@@ -87,8 +94,8 @@ func UploadToS3(ctx context.Context, s3Client *s3x.Service, bucket string, path
 			Bucket:          aws.String(bucket),
 			Key:             aws.String(path),
 			Body:            f,
-			ContentType:     aws.String("application/json"),
-			ContentEncoding: aws.String("gzip"),
+			ContentType:     contentType,
+			ContentEncoding: contentEncoding,
 			ACL:             types.ObjectCannedACLPrivate,
 		}
 
@@ -101,6 +108,57 @@ func UploadToS3(ctx context.Context, s3Client *s3x.Service, bucket string, path
 	return nil
 }
 
+// returns the content type and encoding of the archive's file, which for encrypted files are opaque bytes
+func s3ContentHeaders(archive *Archive) (*string, *string) {
+	if archive.isEncrypted() {
+		return aws.String("application/octet-stream"), nil
+	}
+	return aws.String(archive.format().contentType()), aws.String(archive.codec().contentEncoding())
+}
+
+// StreamToS3 writes the contents of the passed in reader as the archive's file using a multipart upload
+func StreamToS3(ctx context.Context, s3Client *s3x.Service, bucket string, path string, archive *Archive, body io.Reader) error {
+	contentType, contentEncoding := s3ContentHeaders(archive)
+	uploader := manager.NewUploader(
+		s3Client.Client,
+		func(u *manager.Uploader) {
+			u.PartSize = streamChunkSizeBytes
+			u.Concurrency = streamConcurrency
+		},
+	)
+	params := &s3.PutObjectInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(path),
+		Body:            body,
+		ContentType:     contentType,
+		ContentEncoding: contentEncoding,
+		ACL:             types.ObjectCannedACLPrivate,
+	}
+
+	if _, err := uploader.Upload(ctx, params); err != nil {
+		return err
+	}
+
+	archive.Location = null.String(fmt.Sprintf("%s:%s", bucket, path))
+	return nil
+}
+
+// PutS3File writes a small file which isn't an archive file, returning its location
+func PutS3File(ctx context.Context, s3Client *s3x.Service, bucket, key, contentType string, data []byte) (string, error) {
+	_, err := s3Client.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType),
+		ACL:         types.ObjectCannedACLPrivate,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s:%s", bucket, key), nil
+}
+
 func withAcceptEncoding(e string) func(o *s3.Options) {
 	return func(o *s3.Options) {
 		o.APIOptions = append(o.APIOptions, []func(*middleware.Stack) error{
@@ -113,7 +171,7 @@ func withAcceptEncoding(e string) func(o *s3.Options) {
 func GetS3FileInfo(ctx context.Context, s3Client *s3x.Service, bucket, key string) (int64, string, error) {
 	head, err := s3Client.Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
 	if err != nil {
-		return 0, "", fmt.Errorf("error looking up S3 object bucket=%s key=%s: %w", bucket, key, err)
+		return 0, "", fmt.Errorf("error looking up S3 object bucket=%s key=%s: %w", bucket, key, s3NotFound(err))
 	}
 
 	if head.ContentLength == nil || head.ETag == nil {
@@ -134,12 +192,23 @@ func GetS3File(ctx context.Context, s3Client *s3x.Service, bucket, key string) (
 		withAcceptEncoding("gzip"),
 	)
 	if err != nil {
-		return nil, fmt.Errorf("error fetching S3 object bucket=%s key=%s: %w", bucket, key, err)
+		return nil, fmt.Errorf("error fetching S3 object bucket=%s key=%s: %w", bucket, key, s3NotFound(err))
 	}
 
 	return output.Body, nil
 }
 
+// wraps the passed in S3 error as ErrFileNotFound if it's because the object doesn't exist, HEAD requests returning
+// NotFound rather than NoSuchKey as they have no body
+func s3NotFound(err error) error {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return fmt.Errorf("%w: %w", ErrFileNotFound, err)
+	}
+	return err
+}
+
 // DeleteS3Files deletes multiple files from S3, automatically batching into requests of 1000 keys
 func DeleteS3Files(ctx context.Context, s3Client *s3x.Service, bucket string, keys []string) (int, error) {
 	if len(keys) == 0 {
@@ -182,3 +251,26 @@ func DeleteS3Files(ctx context.Context, s3Client *s3x.Service, bucket string, ke
 
 	return totalDeleted, lastErr
 }
+
+// ListS3Files lists all the files in the given bucket whose keys start with the given prefix
+func ListS3Files(ctx context.Context, s3Client *s3x.Service, bucket, prefix string) ([]*StoredFile, error) {
+	files := make([]*StoredFile, 0)
+
+	pager := s3.NewListObjectsV2Paginator(s3Client.Client, &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(prefix)})
+	for pager.HasMorePages() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error listing S3 objects bucket=%s prefix=%s: %w", bucket, prefix, err)
+		}
+
+		for _, obj := range page.Contents {
+			files = append(files, &StoredFile{
+				Location:     fmt.Sprintf("%s:%s", bucket, aws.ToString(obj.Key)),
+				Size:         aws.ToInt64(obj.Size),
+				LastModified: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+
+	return files, nil
+}
@@ -0,0 +1,61 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/nyaruka/rp-archiver/runtime"
+	"github.com/vinovest/sqlx"
+)
+
+const sqlSelectTableExists = `
+SELECT EXISTS(SELECT 1 FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1)`
+
+const sqlSelectColumnType = `
+SELECT COALESCE(MAX(data_type), '') FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2`
+
+// CheckSchema checks which of the optional database changes described in the migrations directory have been made,
+// logging a warning for each which hasn't as the features which depend on it will be disabled
+func CheckSchema(ctx context.Context, db *sqlx.DB) (runtime.Schema, error) {
+	schema := runtime.Schema{}
+
+	if err := db.GetContext(ctx, &schema.PurgeProgress, sqlSelectTableExists, "archives_purgeprogress"); err != nil {
+		return schema, fmt.Errorf("error checking for purge progress table: %w", err)
+	}
+	if !schema.PurgeProgress {
+		slog.Warn("archives_purgeprogress table doesn't exist, interrupted purges will restart from the beginning")
+	}
+
+	var startDateType string
+	if err := db.GetContext(ctx, &startDateType, sqlSelectColumnType, "archives_archive", "start_date"); err != nil {
+		return schema, fmt.Errorf("error checking type of archive start dates: %w", err)
+	}
+	schema.TimestampStartDates = startDateType == "timestamp with time zone"
+	if !schema.TimestampStartDates {
+		slog.Warn("archives_archive.start_date isn't a timestamp with time zone, hourly archives are disabled", "type", startDateType)
+	}
+
+	var utcOffsetType string
+	if err := db.GetContext(ctx, &utcOffsetType, sqlSelectColumnType, "archives_archive", "utc_offset"); err != nil {
+		return schema, fmt.Errorf("error checking for archive UTC offsets: %w", err)
+	}
+	schema.UTCOffsets = utcOffsetType != ""
+	if !schema.UTCOffsets {
+		slog.Warn("archives_archive.utc_offset doesn't exist, local archives are disabled")
+	}
+
+	schema.EncryptionKeys = true
+	for _, column := range []string{"encryption_algorithm", "encryption_key"} {
+		var columnType string
+		if err := db.GetContext(ctx, &columnType, sqlSelectColumnType, "archives_archive", column); err != nil {
+			return schema, fmt.Errorf("error checking for archive encryption columns: %w", err)
+		}
+		schema.EncryptionKeys = schema.EncryptionKeys && columnType != ""
+	}
+	if !schema.EncryptionKeys {
+		slog.Warn("archives_archive.encryption_algorithm and encryption_key don't exist, encryption is disabled")
+	}
+
+	return schema, nil
+}
@@ -0,0 +1,97 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nyaruka/rp-archiver/runtime"
+	"github.com/vinovest/sqlx"
+)
+
+const sqlLookupSessions = `
+SELECT rec.uuid, row_to_json(rec)
+FROM (
+	SELECT
+		fs.id,
+		fs.uuid,
+		row_to_json(contact_struct) AS contact,
+		CASE
+			WHEN session_type = 'M' THEN 'messaging'
+			WHEN session_type = 'V' THEN 'voice'
+			WHEN session_type = 'B' THEN 'background'
+			ELSE NULL
+		END AS session_type,
+		CASE
+			WHEN status = 'C' THEN 'completed'
+			WHEN status = 'I' THEN 'interrupted'
+			WHEN status = 'X' THEN 'expired'
+			WHEN status = 'F' THEN 'failed'
+			ELSE NULL
+		END AS status,
+		fs.output::jsonb AS output,
+		fs.created_on,
+		fs.ended_on
+
+	FROM flows_flowsession fs
+	JOIN LATERAL (SELECT uuid, name FROM contacts_contact cc WHERE cc.id = fs.contact_id) AS contact_struct ON True
+	WHERE fs.org_id = $1 AND fs.ended_on >= $2 AND fs.ended_on < $3
+	ORDER BY fs.ended_on ASC, id ASC
+) as rec;`
+
+// writeSessionRecords writes the sessions which ended in the archive's date range to the passed in writer
+func writeSessionRecords(ctx context.Context, db *sqlx.DB, archive *Archive, writer RecordWriter) (int, error) {
+	var rows *sqlx.Rows
+	rows, err := db.QueryxContext(ctx, sqlLookupSessions, archive.Org.ID, archive.StartDate, archive.endDate())
+	if err != nil {
+		return 0, fmt.Errorf("error querying session records for org: %d: %w", archive.Org.ID, err)
+	}
+	defer rows.Close()
+
+	recordCount := 0
+
+	for rows.Next() {
+		var sessionUUID string
+		var record string
+
+		if err := rows.Scan(&sessionUUID, &record); err != nil {
+			return 0, fmt.Errorf("error scanning session record for org: %d: %w", archive.Org.ID, err)
+		}
+
+		if err := writer.WriteRecord(record); err != nil {
+			return 0, fmt.Errorf("error writing session record for org: %d: %w", archive.Org.ID, err)
+		}
+		recordCount++
+	}
+
+	return recordCount, nil
+}
+
+const sqlSelectOrgSessionsToPurge = `
+  SELECT id
+    FROM flows_flowsession
+   WHERE org_id = $1 AND ended_on >= $2 AND ended_on < $3 AND id > $4
+ORDER BY id ASC
+   LIMIT $5`
+
+const sqlDeleteSessions = `
+DELETE FROM flows_flowsession WHERE id IN(?)`
+
+var sessionSpec = &ArchiveTypeSpec{
+	Type:         SessionType,
+	RecordName:   "sessions",
+	MetricName:   "sessions",
+	Enabled:      func(cfg *runtime.Config) bool { return cfg.ArchiveSessions },
+	WriteRecords: writeSessionRecords,
+	CountSQL:     `SELECT count(*) FROM flows_flowsession WHERE org_id = $1 AND ended_on >= $2 AND ended_on < $3`,
+	PurgeIDsSQL:  sqlSelectOrgSessionsToPurge,
+	PurgeSQL:     []string{sqlDeleteSessions},
+	DateField:    "ended_on",
+	CSVColumns: []string{
+		"id", "uuid", "contact.uuid", "contact.name", "session_type", "status", "output", "created_on", "ended_on",
+	},
+}
+
+// DeleteArchivedSessions deletes the sessions of the given archive from the database, see deleteArchivedRecords
+func DeleteArchivedSessions(ctx context.Context, rt *runtime.Runtime, archive *Archive) error {
+	return deleteArchivedRecords(ctx, rt, archive, sessionSpec)
+}
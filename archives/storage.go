@@ -0,0 +1,342 @@
+package archives
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/gocommon/aws/s3x"
+	"github.com/nyaruka/null/v3"
+	"github.com/nyaruka/rp-archiver/runtime"
+)
+
+const (
+	StorageTypeS3    = "s3"
+	StorageTypeLocal = "local"
+)
+
+// Storage is where archive files are written to and read back from. Archives record where their file was written
+// as a location string whose format is specific to the storage, e.g. bucket:key for S3.
+type Storage interface {
+	// Put writes the archive's file using the given key and sets the archive's location
+	Put(ctx context.Context, key string, archive *Archive) error
+
+	// PutStream writes the contents of the given reader, whose size isn't known in advance, as the archive's file
+	// using the given key and sets the archive's location
+	PutStream(ctx context.Context, key string, archive *Archive, body io.Reader) error
+
+	// PutFile writes a small file which isn't an archive file, e.g. an archive index, using the given key and returns
+	// its location
+	PutFile(ctx context.Context, key, contentType string, data []byte) (string, error)
+
+	// Info returns the size and hash of the file at the given location, or an error wrapping ErrFileNotFound if there's
+	// no file there
+	Info(ctx context.Context, location string) (int64, string, error)
+
+	// Get returns a reader for the file at the given location, or an error wrapping ErrFileNotFound if there's no file
+	// there
+	Get(ctx context.Context, location string) (io.ReadCloser, error)
+
+	// Delete deletes the files at the given locations, returning the number deleted
+	Delete(ctx context.Context, locations []string) (int, error)
+
+	// List returns all the files whose keys start with the given prefix
+	List(ctx context.Context, prefix string) ([]*StoredFile, error)
+}
+
+// ErrFileNotFound is wrapped by the errors returned by storage when there's no file at a location
+var ErrFileNotFound = errors.New("file not found")
+
+// StoredFile is a file found in storage
+type StoredFile struct {
+	Location     string
+	Size         int64
+	LastModified time.Time
+}
+
+// storageFor returns the storage configured for the passed in runtime
+func storageFor(rt *runtime.Runtime) Storage {
+	if rt.Config.StorageType == StorageTypeLocal {
+		return NewLocalStorage(rt.Config.StorageDir)
+	}
+	return NewS3Storage(rt.S3, rt.Config.S3Bucket)
+}
+
+// S3Storage stores archive files in an S3 bucket with locations of the form bucket:key
+type S3Storage struct {
+	client *s3x.Service
+	bucket string
+}
+
+// NewS3Storage creates a new S3 storage which writes to the given bucket
+func NewS3Storage(client *s3x.Service, bucket string) *S3Storage {
+	return &S3Storage{client: client, bucket: bucket}
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, archive *Archive) error {
+	return UploadToS3(ctx, s.client, s.bucket, key, archive)
+}
+
+func (s *S3Storage) PutStream(ctx context.Context, key string, archive *Archive, body io.Reader) error {
+	return StreamToS3(ctx, s.client, s.bucket, key, archive, body)
+}
+
+func (s *S3Storage) PutFile(ctx context.Context, key, contentType string, data []byte) (string, error) {
+	return PutS3File(ctx, s.client, s.bucket, key, contentType, data)
+}
+
+func (s *S3Storage) Info(ctx context.Context, location string) (int64, string, error) {
+	bucket, key, err := parseS3Location(location)
+	if err != nil {
+		return 0, "", err
+	}
+	return GetS3FileInfo(ctx, s.client, bucket, key)
+}
+
+func (s *S3Storage) Get(ctx context.Context, location string) (io.ReadCloser, error) {
+	bucket, key, err := parseS3Location(location)
+	if err != nil {
+		return nil, err
+	}
+	return GetS3File(ctx, s.client, bucket, key)
+}
+
+func (s *S3Storage) Delete(ctx context.Context, locations []string) (int, error) {
+	keysByBucket := make(map[string][]string)
+	for _, location := range locations {
+		bucket, key, err := parseS3Location(location)
+		if err != nil {
+			return 0, err
+		}
+		keysByBucket[bucket] = append(keysByBucket[bucket], key)
+	}
+
+	totalDeleted := 0
+	var lastErr error
+
+	for bucket, keys := range keysByBucket {
+		deleted, err := DeleteS3Files(ctx, s.client, bucket, keys)
+		totalDeleted += deleted
+		if err != nil {
+			lastErr = err
+		}
+	}
+
+	return totalDeleted, lastErr
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]*StoredFile, error) {
+	return ListS3Files(ctx, s.client, s.bucket, prefix)
+}
+
+// returns whether a stored hash, e.g. an S3 ETag, is the MD5 of the file, which isn't the case for multipart uploads
+func isMD5Hash(hash string) bool {
+	return !strings.Contains(hash, "-")
+}
+
+// parses a location of the form bucket:key
+func parseS3Location(location string) (string, string, error) {
+	bucket, key, found := strings.Cut(location, ":")
+	if !found || bucket == "" || key == "" {
+		return "", "", fmt.Errorf("invalid S3 location: %s", location)
+	}
+	return bucket, key, nil
+}
+
+// LocalStorage stores archive files in a directory on the local filesystem, e.g. a mounted volume, with locations
+// of the form local:key
+type LocalStorage struct {
+	dir string
+}
+
+// NewLocalStorage creates a new local storage which writes to the given directory
+func NewLocalStorage(dir string) *LocalStorage {
+	return &LocalStorage{dir: dir}
+}
+
+func (s *LocalStorage) Put(ctx context.Context, key string, archive *Archive) error {
+	src, err := os.Open(archive.ArchiveFile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return s.PutStream(ctx, key, archive, src)
+}
+
+func (s *LocalStorage) PutStream(ctx context.Context, key string, archive *Archive, src io.Reader) error {
+	if err := s.write(key, src); err != nil {
+		return err
+	}
+
+	archive.Location = null.String(StorageTypeLocal + ":" + key)
+	return nil
+}
+
+func (s *LocalStorage) PutFile(ctx context.Context, key, contentType string, data []byte) (string, error) {
+	if err := s.write(key, bytes.NewReader(data)); err != nil {
+		return "", err
+	}
+	return StorageTypeLocal + ":" + key, nil
+}
+
+// writes the contents of the given reader to the file with the given key
+func (s *LocalStorage) write(key string, src io.Reader) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating directory for %s: %w", path, err)
+	}
+
+	// write to a temporary file first and then rename so a partially written file never exists at the final path
+	dst, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating file for %s: %w", path, err)
+	}
+	defer os.Remove(dst.Name())
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return fmt.Errorf("error writing file %s: %w", path, err)
+	}
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("error writing file %s: %w", path, err)
+	}
+	if err := os.Rename(dst.Name(), path); err != nil {
+		return fmt.Errorf("error renaming file to %s: %w", path, err)
+	}
+	return nil
+}
+
+func (s *LocalStorage) Info(ctx context.Context, location string) (int64, string, error) {
+	path, err := s.locationPath(location)
+	if err != nil {
+		return 0, "", err
+	}
+
+	f, err := s.open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	// calculate an MD5 hash so that it can be checked like an S3 ETag
+	hash := md5.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return 0, "", fmt.Errorf("error reading local file %s: %w", path, err)
+	}
+
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (s *LocalStorage) Get(ctx context.Context, location string) (io.ReadCloser, error) {
+	path, err := s.locationPath(location)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.open(path)
+}
+
+// opens the file at the given path, wrapping the error as ErrFileNotFound if it doesn't exist
+func (s *LocalStorage) open(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error opening local file %s: %w: %w", path, ErrFileNotFound, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("error opening local file %s: %w", path, err)
+	}
+	return f, nil
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, locations []string) (int, error) {
+	totalDeleted := 0
+	var lastErr error
+
+	for _, location := range locations {
+		path, err := s.locationPath(location)
+		if err != nil {
+			return totalDeleted, err
+		}
+
+		// like S3, deleting a file that doesn't exist isn't an error
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("error deleting local file", "path", path, "error", err)
+			lastErr = fmt.Errorf("error deleting local file %s: %w", path, err)
+			continue
+		}
+		totalDeleted++
+	}
+
+	return totalDeleted, lastErr
+}
+
+func (s *LocalStorage) List(ctx context.Context, prefix string) ([]*StoredFile, error) {
+	files := make([]*StoredFile, 0)
+
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// a storage directory which hasn't been written to yet has no files
+			if path == s.dir && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		files = append(files, &StoredFile{Location: StorageTypeLocal + ":" + key, Size: info.Size(), LastModified: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing local files in %s: %w", s.dir, err)
+	}
+
+	return files, nil
+}
+
+// converts a location of the form local:key to a path in our directory
+func (s *LocalStorage) locationPath(location string) (string, error) {
+	prefix, key, found := strings.Cut(location, ":")
+	if !found || prefix != StorageTypeLocal {
+		return "", fmt.Errorf("invalid local location: %s", location)
+	}
+	return s.path(key)
+}
+
+// converts a key to a path in our directory, ensuring it can't point outside of it
+func (s *LocalStorage) path(key string) (string, error) {
+	if !filepath.IsLocal(key) {
+		return "", fmt.Errorf("invalid local key: %s", key)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
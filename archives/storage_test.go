@@ -0,0 +1,73 @@
+package archives
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalStorage(t *testing.T) {
+	ctx := t.Context()
+	dir := t.TempDir()
+	storage := NewLocalStorage(dir)
+
+	archiveFile := filepath.Join(t.TempDir(), "archive.jsonl.gz")
+	require.NoError(t, os.WriteFile(archiveFile, []byte("hello world"), 0600))
+
+	archive := &Archive{ArchiveFile: archiveFile, Size: 11, Hash: "5eb63bbbe01eeed093cb22bb8f5acdc3"}
+
+	err := storage.Put(ctx, "2/message_D20170812_5eb63bbbe01eeed093cb22bb8f5acdc3.jsonl.gz", archive)
+	assert.NoError(t, err)
+	assert.Equal(t, "local:2/message_D20170812_5eb63bbbe01eeed093cb22bb8f5acdc3.jsonl.gz", string(archive.Location))
+	assert.FileExists(t, filepath.Join(dir, "2", "message_D20170812_5eb63bbbe01eeed093cb22bb8f5acdc3.jsonl.gz"))
+
+	size, hash, err := storage.Info(ctx, string(archive.Location))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(11), size)
+	assert.Equal(t, "5eb63bbbe01eeed093cb22bb8f5acdc3", hash)
+
+	reader, err := storage.Get(ctx, string(archive.Location))
+	require.NoError(t, err)
+	contents, err := io.ReadAll(reader)
+	reader.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(contents))
+
+	// keys can't point outside of the storage directory
+	err = storage.Put(ctx, "../escaped.jsonl.gz", archive)
+	assert.EqualError(t, err, "invalid local key: ../escaped.jsonl.gz")
+
+	// locations must be local ones
+	_, _, err = storage.Info(ctx, "temba-archives:2/message_D20170812_5eb63bbbe01eeed093cb22bb8f5acdc3.jsonl.gz")
+	assert.EqualError(t, err, "invalid local location: temba-archives:2/message_D20170812_5eb63bbbe01eeed093cb22bb8f5acdc3.jsonl.gz")
+
+	// deleting includes files which no longer exist
+	deleted, err := storage.Delete(ctx, []string{string(archive.Location), "local:2/missing.jsonl.gz"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	assert.NoFileExists(t, filepath.Join(dir, "2", "message_D20170812_5eb63bbbe01eeed093cb22bb8f5acdc3.jsonl.gz"))
+
+	_, err = storage.Get(ctx, string(archive.Location))
+	assert.ErrorIs(t, err, ErrFileNotFound)
+
+	_, _, err = storage.Info(ctx, string(archive.Location))
+	assert.ErrorIs(t, err, ErrFileNotFound)
+
+	// and the location not being valid isn't the same as its file not being found
+	_, _, err = storage.Info(ctx, "temba-archives:2/message_D20170812_5eb63bbbe01eeed093cb22bb8f5acdc3.jsonl.gz")
+	assert.NotErrorIs(t, err, ErrFileNotFound)
+}
+
+func TestParseS3Location(t *testing.T) {
+	bucket, key, err := parseS3Location("temba-archives:2/message_D20170812_hash.jsonl.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, "temba-archives", bucket)
+	assert.Equal(t, "2/message_D20170812_hash.jsonl.gz", key)
+
+	_, _, err = parseS3Location("temba-archives")
+	assert.EqualError(t, err, "invalid S3 location: temba-archives")
+}
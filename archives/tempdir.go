@@ -0,0 +1,98 @@
+package archives
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"sync"
+
+	"github.com/nyaruka/rp-archiver/runtime"
+)
+
+// tempSpace tracks the bytes of temp space reserved by the archive files this process is building, so that other files
+// in the temp directory don't count against our limit and workers can't all take the same free space at once
+type tempSpace struct {
+	mu       sync.Mutex
+	reserved int64
+	released chan struct{} // closed and replaced whenever space is released
+}
+
+func newTempSpace() *tempSpace {
+	return &tempSpace{released: make(chan struct{})}
+}
+
+// the temp space of this process, shared by all org workers
+var archiverTempSpace = newTempSpace()
+
+// reserve blocks until the given number of bytes can be reserved without going over the limit. If nothing is reserved
+// then waiting won't free up any space, so a reservation is always made regardless of its size.
+func (s *tempSpace) reserve(ctx context.Context, size, limit int64) (*tempReservation, error) {
+	for {
+		s.mu.Lock()
+		if s.reserved == 0 || s.reserved+size <= limit {
+			s.reserved += size
+			s.mu.Unlock()
+			return &tempReservation{space: s, size: size}, nil
+		}
+		reserved, released := s.reserved, s.released
+		s.mu.Unlock()
+
+		slog.Debug("waiting for temp space", "reserved", reserved, "size", size, "limit", limit)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+// returns the number of bytes currently reserved
+func (s *tempSpace) used() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reserved
+}
+
+// changes the number of reserved bytes, waking anyone waiting if that frees up space
+func (s *tempSpace) adjust(delta int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reserved += delta
+
+	if delta < 0 {
+		close(s.released)
+		s.released = make(chan struct{})
+	}
+}
+
+// tempReservation is the temp space reserved for a single archive file
+type tempReservation struct {
+	space *tempSpace
+	size  int64
+}
+
+// resize changes the size of the reservation to the actual size of its file once that's known, so that other workers
+// wait for it if it turned out bigger than estimated
+func (r *tempReservation) resize(size int64) {
+	r.space.adjust(size - r.size)
+	r.size = size
+}
+
+// release releases the reservation once its file is no longer on disk
+func (r *tempReservation) release() {
+	r.space.adjust(-r.size)
+	r.size = 0
+}
+
+// acquireTempSpace blocks until the given number of bytes of temp space can be reserved without going over the
+// configured limit, and returns the reservation which must be released once the caller's file is no longer on disk
+func acquireTempSpace(ctx context.Context, rt *runtime.Runtime, size int64) (*tempReservation, error) {
+	limit := int64(math.MaxInt64)
+	if rt.Config.TempDirLimit > 0 {
+		limit = int64(rt.Config.TempDirLimit) * 1024 * 1024
+	}
+
+	return archiverTempSpace.reserve(ctx, size, limit)
+}
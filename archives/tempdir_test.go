@@ -0,0 +1,68 @@
+package archives
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTempSpace(t *testing.T) {
+	space := newTempSpace()
+
+	// a reservation is always made if nothing else is reserved, even if it's over the limit
+	r1, err := space.reserve(t.Context(), 150, 100)
+	require.NoError(t, err)
+	assert.Equal(t, int64(150), space.used())
+	r1.release()
+	assert.Equal(t, int64(0), space.used())
+
+	r1, err = space.reserve(t.Context(), 60, 100)
+	require.NoError(t, err)
+	r2, err := space.reserve(t.Context(), 40, 100)
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), space.used())
+
+	// a third has to wait until there's room for it
+	reserved := make(chan *tempReservation)
+	go func() {
+		r3, err := space.reserve(context.Background(), 50, 100)
+		assert.NoError(t, err)
+		reserved <- r3
+	}()
+
+	select {
+	case <-reserved:
+		assert.Fail(t, "reservation shouldn't have been made")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// shrinking a reservation to the actual size of its file isn't enough
+	r2.resize(30)
+	assert.Equal(t, int64(90), space.used())
+
+	select {
+	case <-reserved:
+		assert.Fail(t, "reservation shouldn't have been made")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// but releasing one is
+	r1.release()
+
+	r3 := <-reserved
+	assert.Equal(t, int64(80), space.used())
+
+	// waiting can be cancelled
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = space.reserve(ctx, 50, 100)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	r2.release()
+	r3.release()
+	assert.Equal(t, int64(0), space.used())
+}
@@ -0,0 +1,128 @@
+package archives
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/rp-archiver/runtime"
+	"github.com/vinovest/sqlx"
+)
+
+// how often a throttle checks the load on the database
+var throttleCheckInterval = time.Second * 5
+
+// the smallest sleep between transactions when the database is under load
+const throttleMinSleep = time.Millisecond * 100
+
+const sqlSelectReplicationLag = `
+SELECT count(*) AS replicas, EXTRACT(EPOCH FROM MAX(replay_lag)) AS lag FROM pg_stat_replication`
+
+const sqlSelectActiveConnections = `
+SELECT count(*) FROM pg_stat_activity WHERE state = 'active' AND backend_type = 'client backend'`
+
+// replication lag can't be known if there are no replicas, or we aren't allowed to see them, which is only worth
+// warning about once per process
+var unknownLagWarning sync.Once
+
+// slows down purging when the database is under load by shrinking the number of records deleted in each transaction
+// and sleeping between transactions, and speeds it back up when load drops
+type purgeThrottle struct {
+	db           *sqlx.DB
+	maxLag       time.Duration
+	maxActive    int
+	maxBatchSize int
+	maxSleep     time.Duration
+
+	batchSize int
+	sleep     time.Duration
+	lastCheck time.Time
+}
+
+func newPurgeThrottle(rt *runtime.Runtime) *purgeThrottle {
+	maxBatchSize := max(rt.Config.PurgeMaxBatchSize, 1)
+
+	return &purgeThrottle{
+		db:           rt.DB,
+		maxLag:       time.Duration(rt.Config.PurgeMaxLag) * time.Second,
+		maxActive:    rt.Config.PurgeMaxActive,
+		maxBatchSize: maxBatchSize,
+		maxSleep:     time.Duration(rt.Config.PurgeMaxSleep) * time.Millisecond,
+		batchSize:    min(deleteTransactionSize, maxBatchSize),
+	}
+}
+
+// waits before the next transaction, checking the load on the database if it's time to do so
+func (t *purgeThrottle) wait(ctx context.Context) error {
+	if (t.maxLag > 0 || t.maxActive > 0) && dates.Since(t.lastCheck) >= throttleCheckInterval {
+		lag, active, err := t.checkLoad(ctx)
+		if err != nil {
+			return err
+		}
+
+		t.adjust(lag, active)
+		t.lastCheck = dates.Now()
+	}
+
+	if t.sleep > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(t.sleep):
+		}
+	}
+	return nil
+}
+
+// fetches the current replication lag and number of active connections
+func (t *purgeThrottle) checkLoad(ctx context.Context) (time.Duration, int, error) {
+	var lagSeconds float64
+	var active int
+
+	if t.maxLag > 0 {
+		var replication struct {
+			Replicas int             `db:"replicas"`
+			Lag      sql.NullFloat64 `db:"lag"`
+		}
+		if err := t.db.GetContext(ctx, &replication, sqlSelectReplicationLag); err != nil {
+			return 0, 0, fmt.Errorf("error fetching replication lag: %w", err)
+		}
+
+		if replication.Lag.Valid {
+			lagSeconds = replication.Lag.Float64
+		} else {
+			unknownLagWarning.Do(func() {
+				slog.Warn("unable to determine replication lag, purges won't slow down for it", "replicas", replication.Replicas)
+			})
+		}
+	}
+	if t.maxActive > 0 {
+		if err := t.db.GetContext(ctx, &active, sqlSelectActiveConnections); err != nil {
+			return 0, 0, fmt.Errorf("error fetching active connections: %w", err)
+		}
+	}
+
+	return time.Duration(lagSeconds * float64(time.Second)), active, nil
+}
+
+// backs off quickly when the database is overloaded and recovers gradually when it isn't
+func (t *purgeThrottle) adjust(lag time.Duration, active int) {
+	overloaded := (t.maxLag > 0 && lag > t.maxLag) || (t.maxActive > 0 && active > t.maxActive)
+
+	if overloaded {
+		t.batchSize = max(t.batchSize/2, 1)
+		t.sleep = min(max(t.sleep*2, throttleMinSleep), t.maxSleep)
+
+		slog.Warn("throttling purge, database under load", "lag", lag, "active", active, "batch_size", t.batchSize, "sleep", t.sleep)
+	} else {
+		t.batchSize = min(t.batchSize+deleteTransactionSize, t.maxBatchSize)
+		t.sleep /= 2
+		if t.sleep < throttleMinSleep {
+			t.sleep = 0
+		}
+	}
+}
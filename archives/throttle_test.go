@@ -0,0 +1,65 @@
+package archives
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/rp-archiver/runtime"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPurgeThrottle(t *testing.T) {
+	defer func(size int) { deleteTransactionSize = size }(deleteTransactionSize)
+	deleteTransactionSize = 100
+
+	cfg := runtime.NewDefaultConfig()
+	cfg.PurgeMaxLag = 30
+	cfg.PurgeMaxActive = 20
+	cfg.PurgeMaxBatchSize = 250
+	cfg.PurgeMaxSleep = 1000
+
+	throttle := newPurgeThrottle(&runtime.Runtime{Config: cfg})
+	assert.Equal(t, 100, throttle.batchSize)
+	assert.Equal(t, time.Duration(0), throttle.sleep)
+
+	// healthy database grows our batch size up to the ceiling
+	throttle.adjust(time.Second, 5)
+	assert.Equal(t, 200, throttle.batchSize)
+	assert.Equal(t, time.Duration(0), throttle.sleep)
+
+	throttle.adjust(time.Second, 5)
+	assert.Equal(t, 250, throttle.batchSize)
+
+	// too much lag halves our batch size and starts sleeping
+	throttle.adjust(time.Minute, 5)
+	assert.Equal(t, 125, throttle.batchSize)
+	assert.Equal(t, time.Millisecond*100, throttle.sleep)
+
+	// as do too many active connections, with sleeps doubling up to the ceiling
+	throttle.adjust(time.Second, 50)
+	assert.Equal(t, 62, throttle.batchSize)
+	assert.Equal(t, time.Millisecond*200, throttle.sleep)
+
+	for range 10 {
+		throttle.adjust(time.Minute, 50)
+	}
+	assert.Equal(t, 1, throttle.batchSize)
+	assert.Equal(t, time.Second, throttle.sleep)
+
+	// and recovery is gradual
+	throttle.adjust(time.Second, 5)
+	assert.Equal(t, 101, throttle.batchSize)
+	assert.Equal(t, time.Millisecond*500, throttle.sleep)
+
+	for range 3 {
+		throttle.adjust(time.Second, 5)
+	}
+	assert.Equal(t, 250, throttle.batchSize)
+	assert.Equal(t, time.Duration(0), throttle.sleep)
+
+	// a zero ceiling means a limit is ignored
+	cfg.PurgeMaxActive = 0
+	throttle = newPurgeThrottle(&runtime.Runtime{Config: cfg})
+	throttle.adjust(time.Second, 500)
+	assert.Equal(t, 200, throttle.batchSize)
+}
@@ -0,0 +1,91 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nyaruka/rp-archiver/runtime"
+	"github.com/vinovest/sqlx"
+)
+
+// only closed tickets are archived, by the date they were closed
+const sqlLookupTickets = `
+SELECT row_to_json(rec)
+FROM (
+	SELECT
+		t.id,
+		t.uuid,
+		row_to_json(contact_struct) AS contact,
+		row_to_json(topic_struct) AS topic,
+		row_to_json(assignee_struct) AS assignee,
+		'closed' AS status,
+		t.opened_on,
+		t.closed_on
+
+	FROM tickets_ticket t
+	JOIN LATERAL (SELECT uuid, name FROM contacts_contact cc WHERE cc.id = t.contact_id) AS contact_struct ON True
+	LEFT JOIN LATERAL (SELECT uuid, name FROM tickets_topic tt WHERE tt.id = t.topic_id) AS topic_struct ON True
+	LEFT JOIN LATERAL (SELECT username AS email FROM auth_user u WHERE u.id = t.assignee_id) AS assignee_struct ON True
+	WHERE t.org_id = $1 AND t.status = 'C' AND t.closed_on >= $2 AND t.closed_on < $3
+	ORDER BY t.closed_on ASC, t.id ASC
+) as rec;`
+
+// writeTicketRecords writes the tickets closed in the archive's date range to the passed in writer
+func writeTicketRecords(ctx context.Context, db *sqlx.DB, archive *Archive, writer RecordWriter) (int, error) {
+	rows, err := db.QueryxContext(ctx, sqlLookupTickets, archive.Org.ID, archive.StartDate, archive.endDate())
+	if err != nil {
+		return 0, fmt.Errorf("error querying ticket records for org: %d: %w", archive.Org.ID, err)
+	}
+	defer rows.Close()
+
+	recordCount := 0
+
+	for rows.Next() {
+		var record string
+
+		if err := rows.Scan(&record); err != nil {
+			return 0, fmt.Errorf("error scanning ticket record for org: %d: %w", archive.Org.ID, err)
+		}
+
+		if err := writer.WriteRecord(record); err != nil {
+			return 0, fmt.Errorf("error writing ticket record for org: %d: %w", archive.Org.ID, err)
+		}
+		recordCount++
+	}
+
+	return recordCount, nil
+}
+
+const sqlSelectOrgTicketsToPurge = `
+  SELECT id
+    FROM tickets_ticket
+   WHERE org_id = $1 AND status = 'C' AND closed_on >= $2 AND closed_on < $3 AND id > $4
+ORDER BY id ASC
+   LIMIT $5`
+
+const sqlDeleteTicketEvents = `
+DELETE FROM tickets_ticketevent WHERE ticket_id IN(?)`
+
+const sqlDeleteTickets = `
+DELETE FROM tickets_ticket WHERE id IN(?)`
+
+// ticket events are deleted first, then the tickets themselves
+var ticketSpec = &ArchiveTypeSpec{
+	Type:         TicketType,
+	RecordName:   "tickets",
+	MetricName:   "tickets",
+	Enabled:      func(cfg *runtime.Config) bool { return cfg.ArchiveTickets },
+	WriteRecords: writeTicketRecords,
+	CountSQL:     `SELECT count(*) FROM tickets_ticket WHERE org_id = $1 AND status = 'C' AND closed_on >= $2 AND closed_on < $3`,
+	PurgeIDsSQL:  sqlSelectOrgTicketsToPurge,
+	PurgeSQL:     []string{sqlDeleteTicketEvents, sqlDeleteTickets},
+	DateField:    "closed_on",
+	CSVColumns: []string{
+		"id", "uuid", "contact.uuid", "contact.name", "topic.uuid", "topic.name", "assignee.email", "status", "opened_on", "closed_on",
+	},
+}
+
+// DeleteArchivedTickets deletes the closed tickets of the given archive from the database, see deleteArchivedRecords
+func DeleteArchivedTickets(ctx context.Context, rt *runtime.Runtime, archive *Archive) error {
+	return deleteArchivedRecords(ctx, rt, archive, ticketSpec)
+}
@@ -0,0 +1,160 @@
+package archives
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/nyaruka/rp-archiver/runtime"
+	"github.com/vinovest/sqlx"
+)
+
+// ArchiveTypeSpec describes how the records of an archive type are archived and purged. Types are added by registering
+// a spec with RegisterArchiveType before archiving starts, e.g. in an init function.
+type ArchiveTypeSpec struct {
+	// the type of the archives, e.g. message
+	Type ArchiveType
+
+	// the plural name of the records used in logging, e.g. messages, defaults to the type followed by records
+	RecordName string
+
+	// the name used for the type in metrics, e.g. msgs, defaults to the type
+	MetricName string
+
+	// returns whether archiving of the type is enabled in the given config
+	Enabled func(*runtime.Config) bool
+
+	// writes the records in an archive's date range to the given writer, returning how many were written
+	WriteRecords func(context.Context, *sqlx.DB, *Archive, RecordWriter) (int, error)
+
+	// counts the records which would be written to an archive, with params org id, start and end
+	CountSQL string
+
+	// counts the rows which purging an archive would delete, with the same params, if different to CountSQL
+	PurgeCountSQL string
+
+	// selects a page of the ids of records to purge in an archive's date range, with params org id, start, end, after
+	// id and limit
+	PurgeIDsSQL string
+
+	// deletes a batch of records by id, executed in order in a single transaction for each batch
+	PurgeSQL []string
+
+	// purges the records of an archive, if not set they're deleted in pages using PurgeIDsSQL and PurgeSQL
+	Purge func(context.Context, *runtime.Runtime, *Archive) error
+
+	// deletes anything of the org which purging may have left unused, e.g. broadcasts without messages, if set
+	Cleanup func(context.Context, *runtime.Runtime, time.Time, Org) error
+
+	// the record field which archives are dated by, e.g. created_on
+	DateField string
+
+	// the columns of CSV archives as paths into the JSON records
+	CSVColumns []string
+
+	// how contacts are erased from archives of the type, defaults to EraseByContact
+	Erase EraseStrategy
+
+	// the fields cleared from the records of contacts when erasing with EraseRedact, as paths into the JSON records
+	RedactFields []string
+}
+
+// EraseStrategy is how contacts are erased from the archives of a type
+type EraseStrategy string
+
+const (
+	// EraseByContact removes the records whose contact.uuid is one of the contacts being erased
+	EraseByContact = EraseStrategy("contact")
+
+	// EraseRedact clears the redact fields of the records whose contact.uuid is one of the contacts being erased, for
+	// types whose records should be kept without the details of their contacts
+	EraseRedact = EraseStrategy("redact")
+
+	// EraseUnlinked leaves archives as they are but reports them as skipped, for types whose records can't be matched
+	// to contacts but may contain their details, e.g. webhook request and response bodies
+	EraseUnlinked = EraseStrategy("unlinked")
+
+	// EraseSkip leaves archives as they are, for types whose records contain nothing of contacts
+	EraseSkip = EraseStrategy("skip")
+)
+
+// purges the records of an archive from the database
+func (s *ArchiveTypeSpec) purge(ctx context.Context, rt *runtime.Runtime, archive *Archive) error {
+	if s.Purge != nil {
+		return s.Purge(ctx, rt, archive)
+	}
+	return deleteArchivedRecords(ctx, rt, archive, s)
+}
+
+// returns the query which counts the records of an archive, or the rows which purging it would delete
+func (s *ArchiveTypeSpec) countSQL(purgeable bool) string {
+	if purgeable && s.PurgeCountSQL != "" {
+		return s.PurgeCountSQL
+	}
+	return s.CountSQL
+}
+
+// the registered archive types, and the order they were registered in which is the order they're archived in
+var (
+	archiveTypeSpecs = make(map[ArchiveType]*ArchiveTypeSpec)
+	archiveTypeOrder []ArchiveType
+)
+
+func init() {
+	for _, spec := range []*ArchiveTypeSpec{messageSpec, runSpec, sessionSpec, channelLogSpec, httpLogSpec, ticketSpec} {
+		RegisterArchiveType(spec)
+	}
+}
+
+// RegisterArchiveType registers an archive type, panicking if it's already registered or can't be archived and purged
+func RegisterArchiveType(spec *ArchiveTypeSpec) {
+	if _, exists := archiveTypeSpecs[spec.Type]; exists {
+		panic(fmt.Sprintf("archive type %s already registered", spec.Type))
+	}
+	if spec.Type == "" || spec.WriteRecords == nil || spec.CountSQL == "" || spec.DateField == "" {
+		panic(fmt.Sprintf("archive type %s must have a type, record writer, count query and date field", spec.Type))
+	}
+	if spec.Purge == nil && (spec.PurgeIDsSQL == "" || len(spec.PurgeSQL) == 0) {
+		panic(fmt.Sprintf("archive type %s must have a purge function or purge queries", spec.Type))
+	}
+
+	if spec.Erase == EraseRedact && len(spec.RedactFields) == 0 {
+		panic(fmt.Sprintf("archive type %s must have fields to redact when erasing contacts", spec.Type))
+	}
+
+	if spec.Erase == "" {
+		spec.Erase = EraseByContact
+	}
+	if spec.RecordName == "" {
+		spec.RecordName = string(spec.Type) + " records"
+	}
+	if spec.MetricName == "" {
+		spec.MetricName = string(spec.Type)
+	}
+
+	archiveTypeSpecs[spec.Type] = spec
+	archiveTypeOrder = append(archiveTypeOrder, spec.Type)
+}
+
+// GetArchiveTypeSpec returns the spec of the given archive type, or nil if it isn't registered
+func GetArchiveTypeSpec(t ArchiveType) *ArchiveTypeSpec {
+	return archiveTypeSpecs[t]
+}
+
+// RegisteredArchiveTypes returns all registered archive types in the order they're archived
+func RegisteredArchiveTypes() []ArchiveType {
+	return slices.Clone(archiveTypeOrder)
+}
+
+// IsEnabled returns whether this is a registered archive type which is enabled in the given config
+func (t ArchiveType) IsEnabled(cfg *runtime.Config) bool {
+	spec, ok := archiveTypeSpecs[t]
+	return ok && spec.Enabled != nil && spec.Enabled(cfg)
+}
+
+// IsValid returns whether this is a registered archive type
+func (t ArchiveType) IsValid() bool {
+	_, ok := archiveTypeSpecs[t]
+	return ok
+}
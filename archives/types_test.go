@@ -0,0 +1,70 @@
+package archives
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/nyaruka/rp-archiver/runtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/vinovest/sqlx"
+)
+
+func TestArchiveTypes(t *testing.T) {
+	assert.True(t, MessageType.IsValid())
+	assert.True(t, TicketType.IsValid())
+	assert.False(t, ArchiveType("contact").IsValid())
+
+	assert.Equal(t, []ArchiveType{MessageType, RunType, SessionType, ChannelLogType, HTTPLogType, TicketType}, RegisteredArchiveTypes())
+	assert.Equal(t, "msgs", GetArchiveTypeSpec(MessageType).MetricName)
+	assert.Nil(t, GetArchiveTypeSpec(ArchiveType("contact")))
+
+	// every built in type can be written as CSV
+	for _, archiveType := range RegisteredArchiveTypes() {
+		assert.NotEmpty(t, GetArchiveTypeSpec(archiveType).CSVColumns, "type %s has no CSV columns", archiveType)
+	}
+
+	cfg := runtime.NewDefaultConfig()
+	assert.Equal(t, []ArchiveType{MessageType, RunType}, enabledArchiveTypes(cfg))
+	assert.True(t, RunType.IsEnabled(cfg))
+	assert.False(t, TicketType.IsEnabled(cfg))
+	assert.False(t, ArchiveType("contact").IsEnabled(cfg))
+
+	cfg.ArchiveRuns = false
+	cfg.ArchiveTickets = true
+	assert.Equal(t, []ArchiveType{MessageType, TicketType}, enabledArchiveTypes(cfg))
+
+	// types can't be registered twice or without what's needed to archive and purge them
+	assert.Panics(t, func() { RegisterArchiveType(messageSpec) })
+	assert.Panics(t, func() { RegisterArchiveType(&ArchiveTypeSpec{Type: "contact"}) })
+	assert.Panics(t, func() {
+		RegisterArchiveType(&ArchiveTypeSpec{Type: "contact", WriteRecords: writeMessageRecords, CountSQL: "SELECT 1", DateField: "created_on"})
+	})
+	assert.Panics(t, func() {
+		purge := func(context.Context, *runtime.Runtime, *Archive) error { return nil }
+		RegisterArchiveType(&ArchiveTypeSpec{Type: "contact", WriteRecords: writeMessageRecords, CountSQL: "SELECT 1", DateField: "created_on", Purge: purge, Erase: EraseRedact})
+	})
+
+	// but other types can be registered
+	RegisterArchiveType(&ArchiveTypeSpec{
+		Type:    "contact",
+		Enabled: func(cfg *runtime.Config) bool { return true },
+		WriteRecords: func(context.Context, *sqlx.DB, *Archive, RecordWriter) (int, error) {
+			return 0, nil
+		},
+		CountSQL:  "SELECT count(*) FROM contacts_contact WHERE org_id = $1 AND modified_on >= $2 AND modified_on < $3",
+		Purge:     func(context.Context, *runtime.Runtime, *Archive) error { return nil },
+		DateField: "modified_on",
+	})
+	defer func() {
+		delete(archiveTypeSpecs, "contact")
+		archiveTypeOrder = slices.DeleteFunc(archiveTypeOrder, func(t ArchiveType) bool { return t == "contact" })
+	}()
+
+	assert.True(t, ArchiveType("contact").IsValid())
+	assert.Equal(t, "contact records", GetArchiveTypeSpec("contact").RecordName)
+	assert.Equal(t, "contact", GetArchiveTypeSpec("contact").MetricName)
+	assert.Equal(t, EraseByContact, GetArchiveTypeSpec("contact").Erase)
+	assert.Equal(t, EraseUnlinked, GetArchiveTypeSpec(HTTPLogType).Erase)
+	assert.Equal(t, []ArchiveType{MessageType, TicketType, "contact"}, enabledArchiveTypes(cfg))
+}
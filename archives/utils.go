@@ -8,7 +8,7 @@ import (
 	"github.com/vinovest/sqlx"
 )
 
-// helper method to safely execute an IN query in the passed in transaction
+// helper method to safely execute an IN query in the passed in transaction, which the caller should roll back on error
 func executeInQuery(ctx context.Context, tx *sqlx.Tx, query string, ids []int64) error {
 	q, vs, err := sqlx.In(query, ids)
 	if err != nil {
@@ -16,9 +16,7 @@ func executeInQuery(ctx context.Context, tx *sqlx.Tx, query string, ids []int64)
 	}
 	q = tx.Rebind(q)
 
-	if _, err := tx.ExecContext(ctx, q, vs...); err != nil {
-		tx.Rollback()
-	}
+	_, err = tx.ExecContext(ctx, q, vs...)
 	return err
 }
 
@@ -45,17 +43,3 @@ func removeDuplicates(as []*Archive) []*Archive {
 	}
 	return unique
 }
-
-// chunks a slice of in64 IDs
-func chunkIDs(ids []int64, size int) [][]int64 {
-	chunks := make([][]int64, 0, len(ids)/size+1)
-
-	for i := 0; i < len(ids); i += size {
-		end := i + size
-		if end > len(ids) {
-			end = len(ids)
-		}
-		chunks = append(chunks, ids[i:end])
-	}
-	return chunks
-}
@@ -0,0 +1,208 @@
+package archives
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/rp-archiver/runtime"
+)
+
+// VerifyProblem is the type of problem found with an archive file
+type VerifyProblem string
+
+const (
+	VerifyMissing    = VerifyProblem("missing")
+	VerifyTruncated  = VerifyProblem("truncated")
+	VerifyMismatched = VerifyProblem("mismatched")
+	VerifyOrphaned   = VerifyProblem("orphaned")
+)
+
+// VerifyIssue is a problem found with a single archive or stored file
+type VerifyIssue struct {
+	Problem     VerifyProblem `json:"problem"`
+	ArchiveID   int           `json:"archive_id,omitempty"`
+	OrgID       int           `json:"org_id,omitempty"`
+	ArchiveType ArchiveType   `json:"archive_type,omitempty"`
+	Period      ArchivePeriod `json:"period,omitempty"`
+	StartDate   *time.Time    `json:"start_date,omitempty"`
+	Location    string        `json:"location"`
+	Detail      string        `json:"detail"`
+}
+
+// VerifyReport is the result of verifying archives against storage
+type VerifyReport struct {
+	OrgID           int            `json:"org_id,omitempty"`
+	Deep            bool           `json:"deep"`
+	StartedOn       time.Time      `json:"started_on"`
+	CompletedOn     time.Time      `json:"completed_on"`
+	ArchivesChecked int            `json:"archives_checked"`
+	FilesChecked    int            `json:"files_checked"`
+	Issues          []*VerifyIssue `json:"issues"`
+}
+
+const sqlLookupArchivesToVerify = `
+  SELECT uuid, id, org_id, start_date::timestamp with time zone AS start_date, period, archive_type, hash, location, size, record_count, needs_deletion, rollup_id, ` + sqlSelectEncryption + `, ` + sqlSelectUTCOffset + `
+    FROM archives_archive
+   WHERE $1 = 0 OR org_id = $1
+ORDER BY org_id ASC, archive_type ASC, start_date ASC, period DESC`
+
+// VerifyArchives checks the archives of the given org, or of all orgs if orgID is zero, against the files in storage.
+// Every archive file is checked for existence and size, and if deep is set, is also downloaded and decompressed to
+// check its hash and record count. Stored files which aren't referenced by any archive are reported as orphaned.
+func VerifyArchives(ctx context.Context, rt *runtime.Runtime, orgID int, deep bool) (*VerifyReport, error) {
+	storage := storageFor(rt)
+	report := &VerifyReport{OrgID: orgID, Deep: deep, StartedOn: dates.Now(), Issues: make([]*VerifyIssue, 0)}
+
+	var archives []*Archive
+	if err := rt.DB.SelectContext(ctx, &archives, sqlLookupArchivesToVerify, orgID); err != nil {
+		return nil, fmt.Errorf("error selecting archives to verify: %w", err)
+	}
+
+	locations := make(map[string]bool, len(archives))
+
+	for _, archive := range archives {
+		log := slog.With("id", archive.ID, "org_id", archive.OrgID, "archive_type", archive.ArchiveType, "start_date", archive.StartDate, "period", archive.Period, "location", archive.Location)
+
+		issue, err := verifyArchive(ctx, rt, storage, archive, deep)
+		if err != nil {
+			return nil, err
+		}
+		if issue != nil {
+			log.Warn("archive failed verification", "problem", issue.Problem, "detail", issue.Detail)
+			report.Issues = append(report.Issues, issue)
+		}
+
+		if archive.isUploaded() {
+			locations[string(archive.Location)] = true
+			locations[indexLocation(string(archive.Location))] = true
+		}
+		report.ArchivesChecked++
+	}
+
+	// now look for files in storage that no archive references
+	prefix := ""
+	if orgID != 0 {
+		prefix = fmt.Sprintf("%d/", orgID)
+	}
+
+	files, err := storage.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if !locations[file.Location] {
+			report.Issues = append(report.Issues, &VerifyIssue{
+				Problem:  VerifyOrphaned,
+				Location: file.Location,
+				Detail:   fmt.Sprintf("file of size %d last modified %s is not referenced by any archive", file.Size, file.LastModified.Format(time.RFC3339)),
+			})
+		}
+
+		// indexes are only checked for being orphaned
+		if !isIndexLocation(file.Location) {
+			report.FilesChecked++
+		}
+	}
+
+	report.CompletedOn = dates.Now()
+
+	slog.Info("verified archives", "org_id", orgID, "deep", deep, "archives", report.ArchivesChecked, "files", report.FilesChecked, "issues", len(report.Issues), "elapsed", report.CompletedOn.Sub(report.StartedOn))
+
+	return report, nil
+}
+
+// verifies a single archive against storage, returning an issue if a problem was found
+func verifyArchive(ctx context.Context, rt *runtime.Runtime, storage Storage, archive *Archive, deep bool) (*VerifyIssue, error) {
+	newIssue := func(problem VerifyProblem, detail string, args ...any) *VerifyIssue {
+		return &VerifyIssue{
+			Problem:     problem,
+			ArchiveID:   archive.ID,
+			OrgID:       archive.OrgID,
+			ArchiveType: archive.ArchiveType,
+			Period:      archive.Period,
+			StartDate:   &archive.StartDate,
+			Location:    string(archive.Location),
+			Detail:      fmt.Sprintf(detail, args...),
+		}
+	}
+
+	// archives without records aren't uploaded so there's nothing to check
+	if !archive.isUploaded() {
+		if archive.RecordCount > 0 {
+			return newIssue(VerifyMissing, "archive has %d records but no location", archive.RecordCount), nil
+		}
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Hour)
+	defer cancel()
+
+	// only a file which isn't there is missing, other errors like timeouts or permissions don't tell us anything
+	size, hash, err := storage.Info(ctx, string(archive.Location))
+	if errors.Is(err, ErrFileNotFound) {
+		return newIssue(VerifyMissing, "%s", err), nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error checking archive %s: %w", archive.Location, err)
+	}
+
+	if size < archive.Size {
+		return newIssue(VerifyTruncated, "stored size %d is less than archive size %d", size, archive.Size), nil
+	} else if size != archive.Size {
+		return newIssue(VerifyMismatched, "stored size %d does not match archive size %d", size, archive.Size), nil
+	}
+
+	// if stored hash is MD5 then check against archive hash
+	if rt.Config.CheckS3Hashes && isMD5Hash(hash) && hash != string(archive.Hash) {
+		return newIssue(VerifyMismatched, "stored hash %s does not match archive hash %s", hash, archive.Hash), nil
+	}
+
+	// the contents of shredded archives can't be read so there's nothing more we can check
+	if !deep || archive.isShredded() {
+		return nil, nil
+	}
+
+	reader, err := storage.Get(ctx, string(archive.Location))
+	if errors.Is(err, ErrFileNotFound) {
+		return newIssue(VerifyMissing, "%s", err), nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading archive %s: %w", archive.Location, err)
+	}
+	defer reader.Close()
+
+	// calculate our hash as we decompress and count records
+	readerHash := md5.New()
+	decReader, err := decryptReader(rt, archive, io.TeeReader(reader, readerHash))
+	if err != nil {
+		return newIssue(VerifyMismatched, "error decrypting file: %s", err), nil
+	}
+	compReader, err := archive.codec().newReader(decReader)
+	if err != nil {
+		return newIssue(VerifyTruncated, "error reading %s header: %s", archive.codec(), err), nil
+	}
+	defer compReader.Close()
+
+	recordCount, err := archive.format().countRecords(compReader)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("error reading archive %s: %w", archive.Location, err)
+		}
+		return newIssue(VerifyTruncated, "error decompressing file: %s", err), nil
+	}
+
+	if readHash := hex.EncodeToString(readerHash.Sum(nil)); readHash != string(archive.Hash) {
+		return newIssue(VerifyMismatched, "calculated hash %s does not match archive hash %s", readHash, archive.Hash), nil
+	}
+	if recordCount != archive.RecordCount {
+		return newIssue(VerifyMismatched, "file has %d records but archive has %d", recordCount, archive.RecordCount), nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/rp-archiver/archives"
+	"github.com/nyaruka/rp-archiver/runtime"
+)
+
+// dryRun writes a plan of what archiving all active orgs would do, without creating or deleting anything
+func dryRun(rt *runtime.Runtime) error {
+	plan, err := archives.PlanActiveOrgs(context.Background(), rt, dates.Now())
+	if err != nil {
+		return err
+	}
+
+	if rt.Config.DryRunFormat == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(plan); err != nil {
+			return fmt.Errorf("error writing plan: %w", err)
+		}
+		return nil
+	}
+
+	if err := plan.WriteText(os.Stdout); err != nil {
+		return fmt.Errorf("error writing plan: %w", err)
+	}
+	return nil
+}
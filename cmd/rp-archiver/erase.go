@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/rp-archiver/archives"
+	"github.com/nyaruka/rp-archiver/runtime"
+)
+
+// eraseContact rewrites an org's archives without the records of the given contacts
+func eraseContact(rt *runtime.Runtime, args []string) error {
+	flags := flag.NewFlagSet("erase-contact", flag.ExitOnError)
+	orgID := flags.Int("org", 0, "id of the org whose archives should be rewritten")
+	contacts := flags.String("contacts", "", "comma separated UUIDs of the contacts to erase")
+	flags.Parse(args)
+
+	if *orgID == 0 {
+		return errors.New("--org is required")
+	}
+
+	contactUUIDs := make([]string, 0)
+	for u := range strings.SplitSeq(*contacts, ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		if !uuids.Is(u) {
+			return fmt.Errorf("invalid contact UUID: %s", u)
+		}
+		contactUUIDs = append(contactUUIDs, u)
+	}
+	if len(contactUUIDs) == 0 {
+		return errors.New("--contacts is required")
+	}
+
+	report, err := archives.EraseContacts(context.Background(), rt, *orgID, contactUUIDs)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("erase complete", "org_id", *orgID, "contacts", len(contactUUIDs), "archives_rewritten", report.ArchivesRewritten, "records_erased", report.RecordsErased, "records_redacted", report.RecordsRedacted, "archives_skipped", report.ArchivesSkipped)
+	return nil
+}
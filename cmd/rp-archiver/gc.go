@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"time"
+
+	"github.com/nyaruka/rp-archiver/archives"
+	"github.com/nyaruka/rp-archiver/runtime"
+)
+
+// gc finds files in storage which aren't referenced by any archive and optionally deletes them
+func gc(rt *runtime.Runtime, args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	orgID := flags.Int("org", 0, "id of the org to collect orphaned files for, or 0 for all orgs")
+	grace := flags.Duration("grace", time.Hour*48, "only files last modified longer ago than this are considered orphaned")
+	deleteFiles := flags.Bool("delete", false, "whether to delete orphaned files rather than just report them")
+	flags.Parse(args)
+
+	orphaned, deleted, err := archives.CollectOrphanedFiles(context.Background(), rt, *orgID, *grace, *deleteFiles)
+	if err != nil {
+		return err
+	}
+
+	size := int64(0)
+	for _, f := range orphaned {
+		size += f.Size
+	}
+
+	slog.Info("gc complete", "org_id", *orgID, "grace", *grace, "orphaned", len(orphaned), "orphaned_size", size, "deleted", deleted)
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"log/slog"
 	"os"
@@ -15,6 +16,7 @@ import (
 	"github.com/nyaruka/gocommon/dates"
 	"github.com/nyaruka/rp-archiver/archives"
 	"github.com/nyaruka/rp-archiver/runtime"
+	"github.com/nyaruka/rp-archiver/web"
 	slogmulti "github.com/samber/slog-multi"
 	slogsentry "github.com/samber/slog-sentry/v2"
 	"github.com/vinovest/sqlx"
@@ -26,11 +28,34 @@ var (
 	date    = "unknown"
 )
 
+// commands which can be run instead of the archiver service, e.g. rp-archiver restore --org=1 ...
+var commands = map[string]func(*runtime.Runtime, []string) error{
+	"erase-contact": eraseContact,
+	"gc":            gc,
+	"query":         query,
+	"restore":       restore,
+	"shred":         shred,
+	"verify":        verify,
+}
+
 func main() {
 	config := runtime.NewDefaultConfig()
 	loader := ezconf.NewLoader(&config, "archiver", "Archives RapidPro runs and msgs to S3", []string{"archiver.toml"})
+
+	// a leading argument which isn't a flag is a command, which parses its own flags and takes config from the file and environment
+	command, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+		loader.SetArgs()
+	}
+
 	loader.MustLoad()
 
+	runCommand, isCommand := commands[command]
+	if command != "" && !isCommand {
+		log.Fatalf("unknown command %s", command)
+	}
+
 	var level slog.Level
 	err := level.UnmarshalText([]byte(config.LogLevel))
 	if err != nil {
@@ -38,8 +63,14 @@ func main() {
 		os.Exit(1)
 	}
 
+	// commands and dry runs write their output to stdout so that it can be piped, e.g. to jq, so logs go to stderr
+	logOutput := os.Stdout
+	if isCommand || config.DryRun {
+		logOutput = os.Stderr
+	}
+
 	// configure our logger
-	logHandler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: level})
+	logHandler := slog.NewTextHandler(logOutput, &slog.HandlerOptions{Level: level})
 	slog.SetDefault(slog.New(logHandler))
 
 	logger := slog.With("comp", "main")
@@ -72,31 +103,94 @@ func main() {
 	if strings.Contains(config.DB, "TimeZone") {
 		logger.Error("invalid db connection string, do not specify a timezone, archiver always uses UTC", "db", config.DB)
 	}
+	if strings.Contains(config.ReadonlyDB, "TimeZone") {
+		logger.Error("invalid readonly db connection string, do not specify a timezone, archiver always uses UTC", "db", config.ReadonlyDB)
+	}
 
-	// force our DB connection to be in UTC
-	if strings.Contains(config.DB, "?") {
-		config.DB += "&TimeZone=UTC"
-	} else {
-		config.DB += "?TimeZone=UTC"
+	// force our DB connections to be in UTC
+	config.DB = forceUTC(config.DB)
+	if config.ReadonlyDB != "" {
+		config.ReadonlyDB = forceUTC(config.ReadonlyDB)
 	}
 
 	rt := &runtime.Runtime{
 		Config: config,
 	}
 
+	schemaChecked := false
+
 	rt.DB, err = sqlx.Open("postgres", config.DB)
 	if err != nil {
 		logger.Error("error connecting to db", "error", err)
 	} else {
-		rt.DB.SetMaxOpenConns(2)
+		// each org worker needs at most two connections, e.g. one iterating over rows and one for a transaction
+		rt.DB.SetMaxOpenConns(2 * max(config.OrgWorkers, 1))
 		logger.Info("db ok", "state", "starting")
+
+		// features which need database changes that haven't been made yet are disabled
+		rt.Schema, err = archives.CheckSchema(context.Background(), rt.DB)
+		if err != nil {
+			logger.Error("error checking db schema", "error", err)
+		} else {
+			schemaChecked = true
+		}
 	}
 
-	rt.S3, err = archives.NewS3Client(config, true)
-	if err != nil {
-		logger.Error("unable to initialize s3 client", "error", err)
-	} else {
-		logger.Info("s3 bucket ok", "state", "starting")
+	// archive records are optionally read from a replica to keep heavy queries off the primary
+	if config.ReadonlyDB != "" {
+		rt.ReadonlyDB, err = sqlx.Open("postgres", config.ReadonlyDB)
+		if err == nil {
+			err = pingDB(rt.ReadonlyDB)
+		}
+		if err != nil {
+			// records can still be read from the primary, just without keeping the load off it
+			logger.Error("error connecting to readonly db, reading from primary db instead", "error", err)
+			if rt.ReadonlyDB != nil {
+				rt.ReadonlyDB.Close()
+				rt.ReadonlyDB = nil
+			}
+		} else {
+			rt.ReadonlyDB.SetMaxOpenConns(max(config.OrgWorkers, 1))
+			logger.Info("readonly db ok", "state", "starting")
+		}
+	}
+
+	switch config.StorageType {
+	case archives.StorageTypeS3:
+		rt.S3, err = archives.NewS3Client(config, true)
+		if err != nil {
+			logger.Error("unable to initialize s3 client", "error", err)
+		} else {
+			logger.Info("s3 bucket ok", "state", "starting")
+		}
+	case archives.StorageTypeLocal:
+		// local storage is just another directory that we need to be able to write to
+		err = archives.EnsureTempArchiveDirectory(config.StorageDir)
+		if err != nil {
+			logger.Error("cannot write to storage directory", "error", err)
+		} else {
+			logger.Info("storage directory ok", "state", "starting")
+		}
+	default:
+		log.Fatalf("invalid storage type %s", config.StorageType)
+	}
+
+	if !archives.ArchiveFormat(config.ArchiveFormat).IsValid() {
+		log.Fatalf("invalid archive format %s", config.ArchiveFormat)
+	}
+	if !archives.ArchiveCodec(config.ArchiveCodec).IsValid() {
+		log.Fatalf("invalid archive codec %s", config.ArchiveCodec)
+	}
+	if config.DryRunFormat != "text" && config.DryRunFormat != "json" {
+		log.Fatalf("invalid dry run format %s", config.DryRunFormat)
+	}
+	if config.EncryptionKey != "" {
+		if _, err := archives.ParseEncryptionKey(config.EncryptionKey); err != nil {
+			log.Fatalf("invalid encryption key: %s", err)
+		}
+		if schemaChecked && !rt.Schema.EncryptionKeys {
+			log.Fatalf("encryption requires the encryption_algorithm and encryption_key columns of archives_archive, see migrations/0004_encryption_keys.sql")
+		}
 	}
 
 	wg := &sync.WaitGroup{}
@@ -115,14 +209,45 @@ func main() {
 		logger.Error("invalid start time supplied, format: HH:MM", "error", err)
 	}
 
-	rt.CW, err = cwatch.NewService(config.AWSAccessKeyID, config.AWSSecretAccessKey, config.AWSRegion, config.CloudwatchNamespace, config.DeploymentID)
-	if err != nil {
-		logger.Error("unable to create cloudwatch service", "error", err)
-	} else {
-		logger.Info("cloudwatch service ok", "state", "starting")
+	// cloudwatch metrics are optional, e.g. if only prometheus metrics are being used
+	if config.CloudwatchNamespace != "" {
+		rt.CW, err = cwatch.NewService(config.AWSAccessKeyID, config.AWSSecretAccessKey, config.AWSRegion, config.CloudwatchNamespace, config.DeploymentID)
+		if err != nil {
+			logger.Error("unable to create cloudwatch service", "error", err)
+		} else {
+			logger.Info("cloudwatch service ok", "state", "starting")
+		}
+	}
+
+	// the admin API is only served by the archiver service and not when running commands or a dry run
+	var server *web.Server
+	if !isCommand && !config.DryRun && config.HTTPAddress != "" {
+		server = web.NewServer(rt)
+		if err := server.Start(); err != nil {
+			log.Fatalf("error starting http server: %s", err)
+		}
+	}
+
+	// as are prometheus metrics, which are served separately so that they don't need the admin API's auth token
+	var metricsServer *web.MetricsServer
+	if !isCommand && !config.DryRun && config.MetricsAddress != "" {
+		metricsServer = web.NewMetricsServer(config.MetricsAddress)
+		if err := metricsServer.Start(); err != nil {
+			log.Fatalf("error starting metrics server: %s", err)
+		}
 	}
 
-	if config.Once {
+	if isCommand {
+		if err := runCommand(rt, args); err != nil {
+			logger.Error("error running command", "command", command, "error", err)
+			os.Exit(1)
+		}
+	} else if config.DryRun {
+		if err := dryRun(rt); err != nil {
+			logger.Error("error planning dry run", "error", err)
+			os.Exit(1)
+		}
+	} else if config.Once {
 		doArchival(rt)
 	} else {
 		for {
@@ -136,6 +261,13 @@ func main() {
 		}
 	}
 
+	if server != nil {
+		server.Stop()
+	}
+	if metricsServer != nil {
+		metricsServer.Stop()
+	}
+
 	wg.Wait()
 }
 
@@ -153,6 +285,22 @@ func doArchival(rt *runtime.Runtime) {
 	}
 }
 
+// checks that we can actually connect to the given database, as opening it doesn't
+func pingDB(db *sqlx.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	return db.PingContext(ctx)
+}
+
+// adds a UTC timezone to the given connection string
+func forceUTC(dsn string) string {
+	if strings.Contains(dsn, "?") {
+		return dsn + "&TimeZone=UTC"
+	}
+	return dsn + "?TimeZone=UTC"
+}
+
 func getNextArchivalTime(tod dates.TimeOfDay) time.Time {
 	t := dates.ExtractDate(dates.Now().In(time.UTC)).Combine(tod, time.UTC)
 
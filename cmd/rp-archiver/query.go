@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/nyaruka/rp-archiver/archives"
+	"github.com/nyaruka/rp-archiver/runtime"
+)
+
+// query searches the archived records of a single org and writes those matching as JSONL
+func query(rt *runtime.Runtime, args []string) error {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	orgID := flags.Int("org", 0, "id of the org to query records for")
+	archiveType := flags.String("type", "", "type of records to query, e.g. message, run, session or ticket")
+	from := flags.String("from", "", "start of the date range to query (inclusive), e.g. 2023-01-01")
+	to := flags.String("to", "", "end of the date range to query (exclusive), e.g. 2024-01-01")
+	contact := flags.String("contact", "", "only include records of the contact with this UUID")
+	flow := flags.String("flow", "", "only include records of the flow with this UUID")
+	channel := flags.String("channel", "", "only include messages of the channel with this UUID")
+	direction := flags.String("direction", "", "only include messages with this direction, one of in or out")
+	text := flags.String("text", "", "only include messages whose text contains this, ignoring case")
+	output := flags.String("output", "", "file to write matching records to, defaults to stdout")
+	flags.Parse(args)
+
+	fromDate, err := time.Parse(time.DateOnly, *from)
+	if err != nil {
+		return fmt.Errorf("invalid from date: %w", err)
+	}
+	toDate, err := time.Parse(time.DateOnly, *to)
+	if err != nil {
+		return fmt.Errorf("invalid to date: %w", err)
+	}
+
+	ctx := context.Background()
+
+	org, err := archives.GetOrg(ctx, rt, *orgID)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("error creating output file: %w", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	writer := bufio.NewWriter(out)
+
+	matched, err := archives.QueryArchivedRecords(ctx, rt, org, &archives.RecordQuery{
+		ArchiveType: archives.ArchiveType(*archiveType),
+		From:        fromDate,
+		To:          toDate,
+		ContactUUID: *contact,
+		FlowUUID:    *flow,
+		ChannelUUID: *channel,
+		Direction:   *direction,
+		Text:        *text,
+	}, writer)
+	if err != nil {
+		return err
+	}
+
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("error writing records: %w", err)
+	}
+
+	slog.Info("query complete", "org_id", org.ID, "archive_type", *archiveType, "from", fromDate, "to", toDate, "matched", matched)
+	return nil
+}
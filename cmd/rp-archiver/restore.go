@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nyaruka/rp-archiver/archives"
+	"github.com/nyaruka/rp-archiver/runtime"
+)
+
+// restore re-imports the archived records of a single org and date range back into the database
+func restore(rt *runtime.Runtime, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	orgID := flags.Int("org", 0, "id of the org to restore records for")
+	archiveType := flags.String("type", "", "type of records to restore, one of message or run")
+	from := flags.String("from", "", "start of the date range to restore (inclusive), e.g. 2023-01-01")
+	to := flags.String("to", "", "end of the date range to restore (exclusive), e.g. 2023-02-01")
+	flags.Parse(args)
+
+	fromDate, err := time.Parse(time.DateOnly, *from)
+	if err != nil {
+		return fmt.Errorf("invalid from date: %w", err)
+	}
+	toDate, err := time.Parse(time.DateOnly, *to)
+	if err != nil {
+		return fmt.Errorf("invalid to date: %w", err)
+	}
+
+	ctx := context.Background()
+
+	org, err := archives.GetOrg(ctx, rt, *orgID)
+	if err != nil {
+		return err
+	}
+
+	restored, skipped, err := archives.RestoreArchivedRecords(ctx, rt, org, archives.ArchiveType(*archiveType), fromDate, toDate)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("restore complete", "org_id", org.ID, "archive_type", *archiveType, "from", fromDate, "to", toDate, "restored", restored, "skipped", skipped)
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+
+	"github.com/nyaruka/rp-archiver/archives"
+	"github.com/nyaruka/rp-archiver/runtime"
+)
+
+// shred destroys the encryption keys of an org's archives which makes their files permanently unreadable
+func shred(rt *runtime.Runtime, args []string) error {
+	flags := flag.NewFlagSet("shred", flag.ExitOnError)
+	orgID := flags.Int("org", 0, "id of the org whose archive keys should be destroyed")
+	confirm := flags.Bool("confirm", false, "confirm that the org's archives should be made permanently unreadable")
+	flags.Parse(args)
+
+	if *orgID == 0 {
+		return errors.New("--org is required")
+	}
+	if !*confirm {
+		return errors.New("shredding can't be undone, run again with --confirm to proceed")
+	}
+
+	shredded, err := archives.ShredOrgEncryptionKeys(context.Background(), rt, *orgID)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("shred complete", "org_id", *orgID, "archives", shredded)
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/nyaruka/rp-archiver/archives"
+	"github.com/nyaruka/rp-archiver/runtime"
+)
+
+// verify checks archives against the files in storage and writes a JSON report of any problems found
+func verify(rt *runtime.Runtime, args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	orgID := flags.Int("org", 0, "id of the org to verify archives for, or 0 for all orgs")
+	deep := flags.Bool("deep", false, "whether to download each archive file to check its hash and record count")
+	output := flags.String("output", "", "file to write the JSON report to, defaults to stdout")
+	flags.Parse(args)
+
+	report, err := archives.VerifyArchives(context.Background(), rt, *orgID, *deep)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("error creating report file: %w", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return fmt.Errorf("error writing report: %w", err)
+	}
+
+	if len(report.Issues) > 0 {
+		return fmt.Errorf("found %d problems with archives", len(report.Issues))
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+-- Adds a table in which the archiver checkpoints the progress of purges, so that a purge which is interrupted resumes
+-- where it stopped rather than starting over. Without it, purges still work but aren't checkpointed.
+CREATE TABLE IF NOT EXISTS archives_purgeprogress (
+    archive_id integer PRIMARY KEY,
+    last_id bigint NOT NULL,
+    deleted_count integer NOT NULL,
+    updated_on timestamp with time zone NOT NULL
+);
@@ -0,0 +1,3 @@
+-- Changes the start dates of archives from dates to timestamps, so that archives can start at times other than midnight
+-- UTC, as hourly archives and archives in org timezones do. Existing start dates become midnight UTC.
+ALTER TABLE archives_archive ALTER COLUMN start_date TYPE timestamp with time zone USING start_date::timestamp AT TIME ZONE 'UTC';
@@ -0,0 +1,3 @@
+-- Adds the offset from UTC each archive was created with, so that archives can start at midnight in their org's timezone
+-- and keep their boundaries if it changes. Existing archives are UTC archives so have a zero offset.
+ALTER TABLE archives_archive ADD COLUMN IF NOT EXISTS utc_offset integer NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+-- Adds the columns in which the archiver stores how each archive's file is encrypted and its wrapped data key. Archives
+-- written before these existed aren't encrypted so have neither.
+ALTER TABLE archives_archive ADD COLUMN IF NOT EXISTS encryption_algorithm varchar(32) NULL;
+ALTER TABLE archives_archive ADD COLUMN IF NOT EXISTS encryption_key text NULL;
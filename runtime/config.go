@@ -2,28 +2,59 @@ package runtime
 
 // Config is our top level configuration object
 type Config struct {
-	DB        string `help:"the connection string for our database"`
-	LogLevel  string `help:"the log level, one of error, warn, info, debug"`
-	SentryDSN string `help:"the sentry configuration to log errors to, if any"`
+	DB             string `help:"the connection string for our database"`
+	ReadonlyDB     string `help:"the connection string for a read replica archive records are read from, if empty they are read from the primary database"`
+	ReadonlyMaxLag int    `help:"the replication lag in seconds of the read replica above which archive records are read from the primary database, 0 for no limit"`
+	LogLevel       string `help:"the log level, one of error, warn, info, debug"`
+	SentryDSN      string `help:"the sentry configuration to log errors to, if any"`
 
 	AWSAccessKeyID     string `help:"access key ID to use for AWS services"`
 	AWSSecretAccessKey string `help:"secret access key to use for AWS services"`
 	AWSRegion          string `help:"region to use for AWS services, e.g. us-east-1"`
 
+	StorageType string `help:"where archives are stored, one of s3, local"`
+	StorageDir  string `help:"directory archives are written to when using local storage"`
+
 	S3Endpoint  string `help:"S3 endpoint we will write archives to"`
 	S3Bucket    string `help:"S3 bucket we will write archives to"`
 	S3PathStyle bool   `help:"S3 should use path style URLs"`
 
+	ArchiveFormat string `help:"the format records are written in, one of jsonl, csv"`
+	ArchiveCodec  string `help:"the compression codec for archive files, one of gzip, zstd"`
+	EncryptionKey string `help:"base64 encoded 32 byte master key used to encrypt archive files, if empty files aren't encrypted"`
+
 	TempDir       string `help:"directory where temporary archive files are written"`
+	TempDirLimit  int    `help:"the megabytes of temporary archive files allowed before waiting to build more, 0 for no limit"`
 	CheckS3Hashes bool   `help:"whether to check S3 hashes of uploaded archives before deleting records"`
+	StreamRollups bool   `help:"whether to stream monthly rollups straight to storage rather than building them in the temp directory"`
+	YearlyRollups bool   `help:"whether to roll up monthly archives into yearly archives"`
+
+	DeleteRolledUpMonthlies bool `help:"whether to delete monthly archives once they've been rolled up into yearly archives"`
+
+	PurgeMaxLag       int `help:"the replication lag in seconds above which purging slows down, 0 to ignore replication lag"`
+	PurgeMaxActive    int `help:"the number of active database connections above which purging slows down, 0 to ignore connections"`
+	PurgeMaxBatchSize int `help:"the most records purging will delete in a single transaction"`
+	PurgeMaxSleep     int `help:"the most milliseconds purging will sleep between transactions when the database is under load"`
+
+	ArchiveMessages    bool   `help:"whether we should archive messages"`
+	ArchiveRuns        bool   `help:"whether we should archive runs"`
+	ArchiveSessions    bool   `help:"whether we should archive flow sessions"`
+	ArchiveChannelLogs bool   `help:"whether we should archive channel logs"`
+	ArchiveHTTPLogs    bool   `help:"whether we should archive HTTP logs"`
+	ArchiveTickets     bool   `help:"whether we should archive closed tickets"`
+	RetentionPeriod    int    `help:"the number of days to keep before archiving"`
+	OrgWorkers         int    `help:"the number of orgs to archive concurrently"`
+	StartTime          string `help:"what time archive jobs should run in UTC HH:MM "`
+	Once               bool   `help:"whether archiver should run once and exit (default false)"`
+	DryRun             bool   `help:"whether archiver should print what it would archive and purge and exit without changing anything"`
+	DryRunFormat       string `help:"the format of the dry run plan, one of text, json"`
+
+	HTTPAddress   string `help:"the address to serve the admin HTTP API on, e.g. :8080, if empty it isn't started"`
+	HTTPAuthToken string `help:"the token required in the Authorization header of admin HTTP API requests, if any"`
 
-	ArchiveMessages bool   `help:"whether we should archive messages"`
-	ArchiveRuns     bool   `help:"whether we should archive runs"`
-	RetentionPeriod int    `help:"the number of days to keep before archiving"`
-	StartTime       string `help:"what time archive jobs should run in UTC HH:MM "`
-	Once            bool   `help:"whether archiver should run once and exit (default false)"`
+	MetricsAddress string `help:"the address to serve prometheus metrics on, e.g. :9090, if empty they aren't served"`
 
-	CloudwatchNamespace string `help:"the namespace to use for cloudwatch metrics"`
+	CloudwatchNamespace string `help:"the namespace to use for cloudwatch metrics, if empty metrics aren't sent to cloudwatch"`
 	DeploymentID        string `help:"the deployment identifier to use for metrics"`
 }
 
@@ -31,24 +62,55 @@ type Config struct {
 func NewDefaultConfig() *Config {
 
 	return &Config{
-		DB: "postgres://localhost/archiver_test?sslmode=disable",
+		DB:             "postgres://localhost/archiver_test?sslmode=disable",
+		ReadonlyDB:     "",
+		ReadonlyMaxLag: 300,
 
 		AWSAccessKeyID:     "",
 		AWSSecretAccessKey: "",
 		AWSRegion:          "us-east-1",
 
+		StorageType: "s3",
+		StorageDir:  "/var/lib/archiver",
+
 		S3Endpoint:  "https://s3.amazonaws.com",
 		S3Bucket:    "temba-archives",
 		S3PathStyle: false,
 
+		ArchiveFormat: "jsonl",
+		ArchiveCodec:  "gzip",
+		EncryptionKey: "",
+
 		TempDir:       "/tmp",
+		TempDirLimit:  0,
 		CheckS3Hashes: true,
+		StreamRollups: false,
+		YearlyRollups: false,
+
+		DeleteRolledUpMonthlies: false,
+
+		PurgeMaxLag:       30,
+		PurgeMaxActive:    0,
+		PurgeMaxBatchSize: 100,
+		PurgeMaxSleep:     10000,
+
+		ArchiveMessages:    true,
+		ArchiveRuns:        true,
+		ArchiveSessions:    false,
+		ArchiveChannelLogs: false,
+		ArchiveHTTPLogs:    false,
+		ArchiveTickets:     false,
+		RetentionPeriod:    90,
+		OrgWorkers:         1,
+		StartTime:          "00:01",
+		Once:               false,
+		DryRun:             false,
+		DryRunFormat:       "text",
+
+		HTTPAddress:   "",
+		HTTPAuthToken: "",
 
-		ArchiveMessages: true,
-		ArchiveRuns:     true,
-		RetentionPeriod: 90,
-		StartTime:       "00:01",
-		Once:            false,
+		MetricsAddress: "",
 
 		CloudwatchNamespace: "Temba/Archiver",
 		DeploymentID:        "dev",
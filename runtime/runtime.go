@@ -7,8 +7,10 @@ import (
 )
 
 type Runtime struct {
-	Config *Config
-	DB     *sqlx.DB
-	S3     *s3x.Service
-	CW     *cwatch.Service
+	Config     *Config
+	DB         *sqlx.DB
+	ReadonlyDB *sqlx.DB // optional read replica that archive records are read from
+	S3         *s3x.Service
+	CW         *cwatch.Service
+	Schema     Schema // the optional database changes which have been made, see archives.CheckSchema
 }
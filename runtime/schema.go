@@ -0,0 +1,10 @@
+package runtime
+
+// Schema describes which of the optional database changes the archiver depends on have been made, as these come from
+// migrations which a database might not have had run yet. Features which need a missing change are disabled.
+type Schema struct {
+	PurgeProgress       bool // whether the archives_purgeprogress table exists, without which interrupted purges restart
+	TimestampStartDates bool // whether archives_archive.start_date is a timestamp, without which archives start at midnight UTC
+	UTCOffsets          bool // whether archives_archive.utc_offset exists, without which archives can't be in org timezones
+	EncryptionKeys      bool // whether archives_archive has the encryption columns, without which archives can't be encrypted
+}
@@ -1,11 +1,17 @@
 DROP TABLE IF EXISTS archives_archive CASCADE;
+DROP TABLE IF EXISTS archives_purgeprogress CASCADE;
 DROP TABLE IF EXISTS channels_channellog CASCADE;
+DROP TABLE IF EXISTS request_logs_httplog CASCADE;
+DROP TABLE IF EXISTS tickets_ticketevent CASCADE;
+DROP TABLE IF EXISTS tickets_ticket CASCADE;
+DROP TABLE IF EXISTS tickets_topic CASCADE;
 DROP TABLE IF EXISTS channels_channel CASCADE;
 DROP TABLE IF EXISTS flows_flowstart_contacts CASCADE;
 DROP TABLE IF EXISTS flows_flowstart_groups CASCADE;
 DROP TABLE IF EXISTS flows_flowstart_calls CASCADE;
 DROP TABLE IF EXISTS flows_flowstart CASCADE;
 DROP TABLE IF EXISTS flows_flowrun CASCADE;
+DROP TABLE IF EXISTS flows_flowsession CASCADE;
 DROP TABLE IF EXISTS flows_flow CASCADE;
 DROP TABLE IF EXISTS msgs_broadcast_contacts CASCADE;
 DROP TABLE IF EXISTS msgs_broadcast_groups CASCADE;
@@ -28,7 +34,9 @@ CREATE TABLE orgs_org (
     name character varying(255) NOT NULL,
     is_anon boolean NOT NULL,
     is_active boolean NOT NULL,
-    created_on timestamp with time zone NOT NULL
+    created_on timestamp with time zone NOT NULL,
+    timezone character varying(63) NOT NULL,
+    config jsonb
 );
 
 CREATE TABLE auth_user (
@@ -150,7 +158,7 @@ CREATE TABLE msgs_msg (
     msg_count integer NOT NULL,
     high_priority boolean NULL,
     error_count integer NOT NULL,
-    next_attempt timestamp with time zone NOT NULL,
+    next_attempt timestamp with time zone,
     failed_reason character varying(1),
     external_identifier character varying(255),
     log_uuids uuid[]
@@ -159,6 +167,7 @@ CREATE TABLE msgs_msg (
 CREATE TABLE msgs_label (
     id serial primary key,
     uuid character varying(36) NULL,
+    org_id integer NOT NULL REFERENCES orgs_org(id),
     name character varying(64)
 );
 
@@ -204,12 +213,78 @@ CREATE TABLE flows_flowrun (
     status varchar(1) NOT NULL
 );
 
+CREATE TABLE flows_flowsession (
+    id serial primary key,
+    uuid uuid NOT NULL UNIQUE,
+    org_id integer NOT NULL REFERENCES orgs_org(id),
+    contact_id integer NOT NULL REFERENCES contacts_contact(id),
+    session_type varchar(1) NOT NULL,
+    status varchar(1) NOT NULL,
+    output text NULL,
+    created_on timestamp with time zone NOT NULL,
+    ended_on timestamp with time zone NULL
+);
+
+CREATE TABLE channels_channellog (
+    id bigserial primary key,
+    uuid uuid NOT NULL,
+    channel_id integer NOT NULL REFERENCES channels_channel(id),
+    log_type character varying(16) NOT NULL,
+    http_logs jsonb NULL,
+    errors jsonb NULL,
+    is_error boolean NOT NULL,
+    elapsed_ms integer NOT NULL,
+    created_on timestamp with time zone NOT NULL
+);
+
+CREATE TABLE request_logs_httplog (
+    id serial primary key,
+    org_id integer NOT NULL REFERENCES orgs_org(id),
+    log_type character varying(32) NOT NULL,
+    url character varying(2048) NULL,
+    status_code integer NULL,
+    request text NULL,
+    response text NULL,
+    request_time integer NOT NULL,
+    num_retries integer NULL,
+    is_error boolean NOT NULL,
+    flow_id integer NULL REFERENCES flows_flow(id),
+    channel_id integer NULL REFERENCES channels_channel(id),
+    created_on timestamp with time zone NOT NULL
+);
+
+CREATE TABLE tickets_topic (
+    id serial primary key,
+    uuid uuid NOT NULL,
+    org_id integer NOT NULL REFERENCES orgs_org(id),
+    name character varying(64) NOT NULL
+);
+
+CREATE TABLE tickets_ticket (
+    id serial primary key,
+    uuid uuid NOT NULL UNIQUE,
+    org_id integer NOT NULL REFERENCES orgs_org(id),
+    contact_id integer NOT NULL REFERENCES contacts_contact(id),
+    topic_id integer NULL REFERENCES tickets_topic(id),
+    assignee_id integer NULL REFERENCES auth_user(id),
+    status character varying(1) NOT NULL,
+    opened_on timestamp with time zone NOT NULL,
+    closed_on timestamp with time zone NULL
+);
+
+CREATE TABLE tickets_ticketevent (
+    id serial primary key,
+    ticket_id integer NOT NULL REFERENCES tickets_ticket(id),
+    event_type character varying(1) NOT NULL,
+    created_on timestamp with time zone NOT NULL
+);
+
 CREATE TABLE archives_archive (
     id serial primary key,
     uuid uuid NOT NULL,
     archive_type varchar(16) NOT NULL, 
     created_on timestamp with time zone NOT NULL, 
-    start_date date NOT NULL, 
+    start_date timestamp with time zone NOT NULL, 
     period varchar(1) NOT NULL, 
     record_count integer NOT NULL, 
     size bigint NOT NULL, 
@@ -219,14 +294,24 @@ CREATE TABLE archives_archive (
     deleted_on timestamp with time zone NULL,
     build_time integer NOT NULL, 
     org_id integer NOT NULL,
-    rollup_id integer NULL
+    rollup_id integer NULL,
+    encryption_algorithm varchar(32) NULL,
+    encryption_key text NULL,
+    utc_offset integer NOT NULL DEFAULT 0
+);
+
+CREATE TABLE archives_purgeprogress (
+    archive_id integer primary key,
+    last_id bigint NOT NULL,
+    deleted_count integer NOT NULL,
+    updated_on timestamp with time zone NOT NULL
 );
 
-INSERT INTO orgs_org(id, name, is_active, is_anon, created_on) VALUES
-(1, 'Org 1', TRUE, FALSE, '2017-11-10 21:11:59.890662+00'),
-(2, 'Org 2', TRUE, FALSE, '2017-08-10 21:11:59.890662+00'),
-(3, 'Org 3', TRUE, TRUE, '2017-08-10 21:11:59.890662+00'),
-(4, 'Org 4', FALSE, TRUE, '2017-08-10 21:11:59.890662+00');
+INSERT INTO orgs_org(id, name, is_active, is_anon, created_on, timezone, config) VALUES
+(1, 'Org 1', TRUE, FALSE, '2017-11-10 21:11:59.890662+00', 'Africa/Kigali', NULL),
+(2, 'Org 2', TRUE, FALSE, '2017-08-10 21:11:59.890662+00', 'America/Los_Angeles', '{}'),
+(3, 'Org 3', TRUE, TRUE, '2017-08-10 21:11:59.890662+00', 'Asia/Kolkata', '{"retention_periods": {"session": 120}}'),
+(4, 'Org 4', FALSE, TRUE, '2017-08-10 21:11:59.890662+00', 'UTC', '{"retention_period": 365}');
 
 INSERT INTO channels_channel(id, uuid, org_id, name) VALUES
 (1, '8c1223c3-bd43-466b-81f1-e7266a9f4465', 1, 'Channel 1'),
@@ -295,10 +380,10 @@ INSERT INTO msgs_msg(id, uuid, org_id, broadcast_id, text, created_on, sent_on,
 (7, '019aa2be-0b49-70e7-bf7a-a3bdb43f48e7', 2, NULL, 'message 7', '2018-01-02 21:11:59.890662+00', '2018-01-02 21:11:59.890662+00', '2018-01-02 21:11:59.890662+00', 'I', 'H', 'X', 'T', NULL, 2, 6, 7, 2, NULL, 1, 0, '2018-01-02 21:11:59.890662+00'),
 (9, '019aa2be-5106-71a2-82cd-be475fc97729', 2, NULL, 'message 9', '2017-08-12 21:11:59.890662+00', '2017-08-12 21:11:59.890662+00', '2017-08-12 21:11:59.890662+00', 'O', 'S', 'V', 'T', NULL, NULL, 6, NULL, 3, NULL, 1, 0, '2017-08-12 21:11:59.890662+00');
 
-INSERT INTO msgs_label(id, uuid, name) VALUES
-(1, '1d9e3188-b74b-4ae0-a166-0de31aedb34a', 'Label 1'),
-(2, 'c5a69101-8dc3-444f-8b0b-5ab816e46eec', 'Label 2'),
-(3, '9e13d3b6-1ffa-406e-b66b-5cebe6738488', 'Label 3');
+INSERT INTO msgs_label(id, uuid, org_id, name) VALUES
+(1, '1d9e3188-b74b-4ae0-a166-0de31aedb34a', 2, 'Label 1'),
+(2, 'c5a69101-8dc3-444f-8b0b-5ab816e46eec', 2, 'Label 2'),
+(3, '9e13d3b6-1ffa-406e-b66b-5cebe6738488', 2, 'Label 3');
 
 INSERT INTO msgs_msg_labels(id, msg_id, label_id) VALUES
 (1, 1, 1),
@@ -391,3 +476,35 @@ WHERE id = 5;
 UPDATE flows_flowrun SET 
     path_times = s.path_times FROM (SELECT array_agg(CONCAT('2017-10-12T15:07:24.', LPAD(gs.val::text, 6, '0'), '+02:00')::timestamptz) as path_times FROM generate_series(1, 1000) as gs(val)) AS s
 WHERE id = 5;
+
+INSERT INTO flows_flowsession(id, uuid, org_id, contact_id, session_type, status, output, created_on, ended_on) VALUES
+(1, '0197b1b2-2ee3-7c1c-9b6c-8a1e0c9d0a01', 2, 6, 'M', 'C', '{"status": "completed"}', '2017-08-12 21:11:59.890662+00', '2017-08-12 21:15:59.890662+00'),
+(2, '0197b1b2-2ee3-7c1c-9b6c-8a1e0c9d0a02', 2, 8, 'M', 'X', '{"status": "expired"}', '2017-08-12 10:11:59.890662+00', '2017-08-12 22:11:59.890662+00'),
+(3, '0197b1b2-2ee3-7c1c-9b6c-8a1e0c9d0a03', 2, 6, 'M', 'W', '{"status": "waiting"}', '2017-08-13 21:11:59.890662+00', NULL),
+(4, '0197b1b2-2ee3-7c1c-9b6c-8a1e0c9d0a04', 3, 7, 'V', 'I', NULL, '2017-08-10 21:11:59.890662+02:00', '2017-08-10 21:12:59.890662+02:00');
+
+INSERT INTO channels_channellog(id, uuid, channel_id, log_type, http_logs, errors, is_error, elapsed_ms, created_on) VALUES
+(1, '0197b1b2-2ee3-7c1c-9b6c-8a1e0c9d0b01', 2, 'msg_send', '[{"url": "https://foo.bar/send", "status_code": 200}]', '[]', FALSE, 123, '2017-08-12 21:11:59.890662+00'),
+(2, '0197b1b2-2ee3-7c1c-9b6c-8a1e0c9d0b02', 2, 'msg_receive', '[{"url": "https://foo.bar/receive", "status_code": 400}]', '[{"code": "bad_request"}]', TRUE, 45, '2017-08-13 21:11:59.890662+00'),
+(3, '0197b1b2-2ee3-7c1c-9b6c-8a1e0c9d0b03', 2, 'msg_send', '[]', '[]', FALSE, 67, '2017-12-30 21:11:59.890662+00'),
+(4, '0197b1b2-2ee3-7c1c-9b6c-8a1e0c9d0b04', 3, 'msg_send', '[]', '[]', FALSE, 89, '2017-08-12 21:11:59.890662+00');
+
+INSERT INTO request_logs_httplog(id, org_id, log_type, url, status_code, request, response, request_time, num_retries, is_error, flow_id, channel_id, created_on) VALUES
+(1, 2, 'webhook_called', 'https://foo.bar/hook', 200, 'GET /hook HTTP/1.1', 'HTTP/1.1 200 OK', 45, 0, FALSE, 1, NULL, '2017-08-12 21:11:59.890662+00'),
+(2, 2, 'webhook_called', 'https://foo.bar/hook', 500, 'GET /hook HTTP/1.1', 'HTTP/1.1 500 Internal Server Error', 1045, 2, TRUE, 1, NULL, '2017-09-02 21:11:59.890662+00'),
+(3, 2, 'channel_connected', 'https://foo.bar/connect', 200, 'POST /connect HTTP/1.1', 'HTTP/1.1 200 OK', 23, 0, FALSE, NULL, 2, '2017-12-30 21:11:59.890662+00'),
+(4, 3, 'webhook_called', 'https://foo.bar/hook', 200, 'GET /hook HTTP/1.1', 'HTTP/1.1 200 OK', 45, 0, FALSE, NULL, NULL, '2017-08-12 21:11:59.890662+00');
+
+INSERT INTO tickets_topic(id, uuid, org_id, name) VALUES
+(1, '0197b1b2-2ee3-7c1c-9b6c-8a1e0c9d0c01', 2, 'General');
+
+INSERT INTO tickets_ticket(id, uuid, org_id, contact_id, topic_id, assignee_id, status, opened_on, closed_on) VALUES
+(1, '0197b1b2-2ee3-7c1c-9b6c-8a1e0c9d0d01', 2, 6, 1, 1, 'C', '2017-08-10 21:11:59.890662+00', '2017-08-12 21:11:59.890662+00'),
+(2, '0197b1b2-2ee3-7c1c-9b6c-8a1e0c9d0d02', 2, 8, 1, NULL, 'O', '2017-08-11 21:11:59.890662+00', NULL),
+(3, '0197b1b2-2ee3-7c1c-9b6c-8a1e0c9d0d03', 2, 6, NULL, NULL, 'C', '2017-09-01 21:11:59.890662+00', '2017-12-30 21:11:59.890662+00'),
+(4, '0197b1b2-2ee3-7c1c-9b6c-8a1e0c9d0d04', 3, 7, NULL, NULL, 'C', '2017-08-10 21:11:59.890662+00', '2017-08-11 21:11:59.890662+00');
+
+INSERT INTO tickets_ticketevent(id, ticket_id, event_type, created_on) VALUES
+(1, 1, 'O', '2017-08-10 21:11:59.890662+00'),
+(2, 1, 'C', '2017-08-12 21:11:59.890662+00'),
+(3, 2, 'O', '2017-08-11 21:11:59.890662+00');
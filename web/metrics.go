@@ -0,0 +1,66 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsServer is an HTTP server for prometheus metrics. It's separate from the admin API so that metrics can be
+// scraped without the auth token, which the admin API requires when it isn't on a loopback address.
+type MetricsServer struct {
+	httpServer *http.Server
+	wg         sync.WaitGroup
+}
+
+// NewMetricsServer creates a new metrics server which listens on the given address
+func NewMetricsServer(addr string) *MetricsServer {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+
+	return &MetricsServer{
+		httpServer: &http.Server{
+			Addr:         addr,
+			Handler:      mux,
+			ReadTimeout:  time.Second * 15,
+			WriteTimeout: time.Second * 15,
+		},
+	}
+}
+
+// Start starts listening for requests
+func (s *MetricsServer) Start() error {
+	listener, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %w", s.httpServer.Addr, err)
+	}
+
+	s.wg.Go(func() {
+		if err := s.httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error("error serving metrics", "error", err)
+		}
+	})
+
+	slog.Info("metrics server started", "address", s.httpServer.Addr)
+	return nil
+}
+
+// Stop stops the server
+func (s *MetricsServer) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		slog.Error("error shutting down metrics server", "error", err)
+	}
+
+	s.wg.Wait()
+
+	slog.Info("metrics server stopped")
+}
@@ -0,0 +1,28 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsServer(t *testing.T) {
+	server := NewMetricsServer("127.0.0.1:0")
+
+	// metrics don't require authentication so that they can be scraped by prometheus
+	w := httptest.NewRecorder()
+	server.httpServer.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "archiver_last_success_timestamp_seconds")
+
+	// and nothing else is served
+	w = httptest.NewRecorder()
+	server.httpServer.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/progress", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	require.NoError(t, server.Start())
+	server.Stop()
+}
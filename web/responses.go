@@ -0,0 +1,69 @@
+package web
+
+import (
+	"time"
+
+	"github.com/nyaruka/gocommon/uuids"
+	"github.com/nyaruka/rp-archiver/archives"
+)
+
+// start dates are just dates except for hourly archives, and are in the timezone the archive was created in
+func formatStartDate(a *archives.Archive) string {
+	startDate := a.StartDate.In(time.FixedZone("", a.UTCOffset))
+	if a.Period == archives.HourPeriod {
+		return startDate.Format(time.RFC3339)
+	}
+	return startDate.Format(time.DateOnly)
+}
+
+// an existing archive as returned by the API, which never includes its encryption key
+type archiveResponse struct {
+	ID            int                    `json:"id"`
+	UUID          uuids.UUID             `json:"uuid"`
+	ArchiveType   archives.ArchiveType   `json:"archive_type"`
+	Period        archives.ArchivePeriod `json:"period"`
+	StartDate     string                 `json:"start_date"`
+	RecordCount   int                    `json:"record_count"`
+	Size          int64                  `json:"size"`
+	Hash          string                 `json:"hash,omitempty"`
+	Location      string                 `json:"location,omitempty"`
+	NeedsDeletion bool                   `json:"needs_deletion"`
+	RollupID      *int                   `json:"rollup_id"`
+	Encrypted     bool                   `json:"encrypted"`
+}
+
+func newArchiveResponses(as []*archives.Archive) []*archiveResponse {
+	rs := make([]*archiveResponse, len(as))
+	for i, a := range as {
+		rs[i] = &archiveResponse{
+			ID:            a.ID,
+			UUID:          a.UUID,
+			ArchiveType:   a.ArchiveType,
+			Period:        a.Period,
+			StartDate:     formatStartDate(a),
+			RecordCount:   a.RecordCount,
+			Size:          a.Size,
+			Hash:          string(a.Hash),
+			Location:      string(a.Location),
+			NeedsDeletion: a.NeedsDeletion,
+			RollupID:      a.Rollup,
+			Encrypted:     a.EncryptionAlgorithm != "",
+		}
+	}
+	return rs
+}
+
+// an archive which is missing as returned by the API
+type missingResponse struct {
+	ArchiveType archives.ArchiveType   `json:"archive_type"`
+	Period      archives.ArchivePeriod `json:"period"`
+	StartDate   string                 `json:"start_date"`
+}
+
+func newMissingResponses(as []*archives.Archive) []*missingResponse {
+	rs := make([]*missingResponse, len(as))
+	for i, a := range as {
+		rs[i] = &missingResponse{ArchiveType: a.ArchiveType, Period: a.Period, StartDate: formatStartDate(a)}
+	}
+	return rs
+}
@@ -0,0 +1,251 @@
+package web
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/gocommon/dates"
+	"github.com/nyaruka/rp-archiver/archives"
+	"github.com/nyaruka/rp-archiver/runtime"
+)
+
+// Server is an HTTP server for inspecting archive state and triggering archiving of individual orgs
+type Server struct {
+	rt         *runtime.Runtime
+	httpServer *http.Server
+
+	// context for archiving triggered via the API, cancelled when the server stops
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewServer creates a new server which listens on the configured HTTP address
+func NewServer(rt *runtime.Runtime) *Server {
+	s := &Server{rt: rt}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	api := http.NewServeMux()
+	api.HandleFunc("GET /progress", s.handleProgress)
+	api.HandleFunc("GET /orgs/{org}/archives/{type}", s.handleArchives)
+	api.HandleFunc("GET /orgs/{org}/archives/{type}/missing", s.handleMissing)
+	api.HandleFunc("POST /orgs/{org}/archives/{type}/run", s.handleRun)
+
+	s.httpServer = &http.Server{
+		Addr:         rt.Config.HTTPAddress,
+		Handler:      s.authenticate(api),
+		ReadTimeout:  time.Second * 15,
+		WriteTimeout: time.Minute,
+	}
+
+	return s
+}
+
+// Start starts listening for requests. As the API can trigger archiving, which purges records from the database, it
+// requires an auth token unless it's only listening on a loopback address.
+func (s *Server) Start() error {
+	if s.rt.Config.HTTPAuthToken == "" && !isLoopbackAddress(s.httpServer.Addr) {
+		return fmt.Errorf("an auth token is required to serve the admin API on %s, unless it's a loopback address", s.httpServer.Addr)
+	}
+
+	listener, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %w", s.httpServer.Addr, err)
+	}
+
+	s.wg.Go(func() {
+		if err := s.httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error("error serving http", "error", err)
+		}
+	})
+
+	slog.Info("http server started", "address", s.httpServer.Addr)
+	return nil
+}
+
+// Stop stops the server, cancelling any archiving which was triggered via the API
+func (s *Server) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		slog.Error("error shutting down http server", "error", err)
+	}
+
+	s.cancel()
+	s.wg.Wait()
+
+	slog.Info("http server stopped")
+}
+
+// returns whether the given address, e.g. localhost:8080, only listens on a loopback interface
+func isLoopbackAddress(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requires the configured auth token if there is one
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.rt.Config.HTTPAuthToken != "" {
+			expected := "Token " + s.rt.Config.HTTPAuthToken
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+				writeError(w, http.StatusUnauthorized, errors.New("missing or invalid authorization"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleProgress(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"in_progress": archives.InProgress()})
+}
+
+func (s *Server) handleArchives(w http.ResponseWriter, r *http.Request) {
+	org, archiveType, ok := s.orgAndType(w, r)
+	if !ok {
+		return
+	}
+
+	current, err := archives.GetCurrentArchives(r.Context(), s.rt.DB, org, archiveType)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"archives": newArchiveResponses(current)})
+}
+
+func (s *Server) handleMissing(w http.ResponseWriter, r *http.Request) {
+	org, archiveType, ok := s.orgAndType(w, r)
+	if !ok {
+		return
+	}
+
+	now := dates.Now()
+
+	dailies, err := archives.GetMissingDailyArchives(r.Context(), s.rt.DB, now, org, archiveType)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	monthlies, err := archives.GetMissingMonthlyArchives(r.Context(), s.rt.DB, now, org, archiveType)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// only orgs archived hourly have hourlies
+	var hourlies []*archives.Archive
+	if org.HourlyArchives {
+		hourlies, err = archives.GetMissingHourlyArchives(r.Context(), s.rt.DB, now, org, archiveType)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"hourlies": newMissingResponses(hourlies), "dailies": newMissingResponses(dailies), "monthlies": newMissingResponses(monthlies)})
+}
+
+func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
+	org, archiveType, ok := s.orgAndType(w, r)
+	if !ok {
+		return
+	}
+
+	// only types which the service archives can be archived, as archiving also purges records
+	if !archiveType.IsEnabled(s.rt.Config) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("archiving not enabled for archive type: %s", archiveType))
+		return
+	}
+
+	// claim the org before responding so that we never accept a run which can't happen
+	claim, err := archives.ClaimOrg(org, archiveType)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+
+	// archiving can take hours so happens in the background and progress can be checked via /progress
+	s.wg.Go(func() {
+		// no single org should take more than 12 hours
+		ctx, cancel := context.WithTimeout(s.ctx, time.Hour*12)
+		defer cancel()
+
+		log := slog.With("org_id", org.ID, "archive_type", archiveType)
+		log.Info("archiving org triggered via http")
+
+		dailiesCreated, dailiesFailed, monthliesCreated, monthliesFailed, _, err := archives.ArchiveClaimedOrg(ctx, s.rt, dates.Now(), claim)
+		if err != nil {
+			log.Error("error archiving org", "error", err)
+			return
+		}
+
+		log.Info("archiving org complete", "dailies_created", len(dailiesCreated), "dailies_failed", len(dailiesFailed), "monthlies_created", len(monthliesCreated), "monthlies_failed", len(monthliesFailed))
+	})
+
+	writeJSON(w, http.StatusAccepted, map[string]any{"org_id": org.ID, "archive_type": archiveType})
+}
+
+// parses the org and archive type from the request path, writing an error response if they're invalid
+func (s *Server) orgAndType(w http.ResponseWriter, r *http.Request) (archives.Org, archives.ArchiveType, bool) {
+	orgID, err := strconv.Atoi(r.PathValue("org"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid org id: %s", r.PathValue("org")))
+		return archives.Org{}, "", false
+	}
+
+	archiveType := archives.ArchiveType(r.PathValue("type"))
+	if !archiveType.IsValid() {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid archive type: %s", archiveType))
+		return archives.Org{}, "", false
+	}
+
+	org, err := archives.GetOrg(r.Context(), s.rt, orgID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no such org: %d", orgID))
+		} else {
+			writeError(w, http.StatusInternalServerError, err)
+		}
+		return archives.Org{}, "", false
+	}
+
+	return org, archiveType, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("error writing http response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	if status == http.StatusInternalServerError {
+		slog.Error("error handling http request", "error", err)
+	}
+
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}